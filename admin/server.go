@@ -0,0 +1,286 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/logstream"
+)
+
+var ErrNoToken = errors.New("admin API requires admin.token")
+
+// ReplicationController defines the replication operations exposed by the admin API
+type ReplicationController interface {
+	PausePublishing()
+	ResumePublishing()
+	IsPublishPaused() bool
+	PauseReplication()
+	ResumeReplication()
+	IsReplicationPaused() bool
+	IsSchemaMismatchPaused() bool
+	SaveSnapshot()
+	ForceSaveSnapshot()
+	LastSaveSnapshotTime() time.Time
+	IsSnapshotLeader() bool
+	SkipHead(shardID uint64) (uint64, error)
+	RetryHead(shardID uint64) error
+	ReplicationState() map[string]uint64
+}
+
+// DBController defines the database operations exposed by the admin API
+type DBController interface {
+	ResyncTable(tableName string) (int64, error)
+	GetSchemaHash() string
+	GetPreviousHash() string
+	GetSchemaTables() []string
+}
+
+// State is the runtime state of the node returned by the admin API
+type State struct {
+	NodeID           uint64            `json:"node_id"`
+	PublishPaused    bool              `json:"publish_paused"`
+	ReplicationState map[string]uint64 `json:"replication_state"`
+	Replication      ReplicationStatus `json:"replication"`
+	Schema           SchemaStatus      `json:"schema"`
+	Snapshot         SnapshotStatus    `json:"snapshot"`
+}
+
+// ReplicationStatus reports whether replication is paused
+type ReplicationStatus struct {
+	Paused               bool `json:"paused"`
+	SchemaMismatchPaused bool `json:"schema_mismatch_paused"`
+}
+
+// SchemaStatus is the content of the schema cache
+type SchemaStatus struct {
+	Hash         string   `json:"hash"`
+	PreviousHash string   `json:"previous_hash,omitempty"`
+	Tables       []string `json:"tables"`
+}
+
+// SnapshotStatus reports the snapshot leadership of the node
+type SnapshotStatus struct {
+	Leader    bool      `json:"leader"`
+	LastSaved time.Time `json:"last_saved,omitempty"`
+}
+
+// AdminServer manages the HTTP server for the admin API
+type AdminServer struct {
+	config     *cfg.AdminConfiguration
+	replicator ReplicationController
+	streamDB   DBController
+	server     *http.Server
+}
+
+// NewAdminServer creates a new AdminServer instance
+func NewAdminServer(config *cfg.AdminConfiguration, replicator ReplicationController, streamDB DBController) *AdminServer {
+	return &AdminServer{
+		config:     config,
+		replicator: replicator,
+		streamDB:   streamDB,
+	}
+}
+
+// Start starts the admin server
+func (s *AdminServer) Start() error {
+	if !s.config.Enable {
+		return nil
+	}
+
+	if s.config.Token == "" {
+		return ErrNoToken
+	}
+
+	s.server = &http.Server{
+		Addr:    s.config.Bind,
+		Handler: s.handler(),
+	}
+
+	go func() {
+		log.Info().Str("bind", s.config.Bind).Msg("Starting admin server")
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Admin server error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the admin server
+func (s *AdminServer) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+
+	log.Info().Msg("Stopping admin server")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
+
+func (s *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", s.handleState)
+	mux.HandleFunc("POST /publish/pause", s.handlePublishPause)
+	mux.HandleFunc("POST /publish/resume", s.handlePublishResume)
+	mux.HandleFunc("POST /replication/pause", s.handleReplicationPause)
+	mux.HandleFunc("POST /replication/resume", s.handleReplicationResume)
+	mux.HandleFunc("POST /snapshot", s.handleSnapshot)
+	mux.HandleFunc("POST /tables/{table}/resync", s.handleResyncTable)
+	mux.HandleFunc("POST /shards/{shard}/skip", s.handleSkipHead)
+	mux.HandleFunc("POST /shards/{shard}/retry", s.handleRetryHead)
+
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests without the configured bearer token
+func (s *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="harmonylite"`)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+
+		log.Info().Str("method", r.Method).Str("path", r.URL.Path).Str("remote", r.RemoteAddr).Msg("Admin request")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *AdminServer) handleState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, State{
+		NodeID:           cfg.Config.NodeID,
+		PublishPaused:    s.replicator.IsPublishPaused(),
+		ReplicationState: s.replicator.ReplicationState(),
+		Replication: ReplicationStatus{
+			Paused:               s.replicator.IsReplicationPaused(),
+			SchemaMismatchPaused: s.replicator.IsSchemaMismatchPaused(),
+		},
+		Schema: SchemaStatus{
+			Hash:         s.streamDB.GetSchemaHash(),
+			PreviousHash: s.streamDB.GetPreviousHash(),
+			Tables:       s.streamDB.GetSchemaTables(),
+		},
+		Snapshot: SnapshotStatus{
+			Leader:    s.replicator.IsSnapshotLeader(),
+			LastSaved: s.replicator.LastSaveSnapshotTime(),
+		},
+	})
+}
+
+func (s *AdminServer) handlePublishPause(w http.ResponseWriter, r *http.Request) {
+	s.replicator.PausePublishing()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": s.replicator.IsPublishPaused()})
+}
+
+func (s *AdminServer) handlePublishResume(w http.ResponseWriter, r *http.Request) {
+	s.replicator.ResumePublishing()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": s.replicator.IsPublishPaused()})
+}
+
+func (s *AdminServer) handleReplicationPause(w http.ResponseWriter, r *http.Request) {
+	s.replicator.PauseReplication()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": s.replicator.IsReplicationPaused()})
+}
+
+func (s *AdminServer) handleReplicationResume(w http.ResponseWriter, r *http.Request) {
+	s.replicator.ResumeReplication()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": s.replicator.IsReplicationPaused()})
+}
+
+// handleSnapshot saves a snapshot when this node is the snapshot leader, or regardless of
+// leadership and the cluster-wide snapshot lock with ?force=true
+func (s *AdminServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	before := s.replicator.LastSaveSnapshotTime()
+	if r.URL.Query().Get("force") == "true" {
+		s.replicator.ForceSaveSnapshot()
+	} else {
+		s.replicator.SaveSnapshot()
+	}
+
+	saved := s.replicator.LastSaveSnapshotTime()
+	if !saved.After(before) {
+		writeError(w, http.StatusConflict, errors.New("snapshot not saved, check the node logs or retry with force=true"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]time.Time{"saved_at": saved})
+}
+
+func (s *AdminServer) handleResyncTable(w http.ResponseWriter, r *http.Request) {
+	count, err := s.streamDB.ResyncTable(r.PathValue("table"))
+	if errors.Is(err, db.ErrTableNotWatched) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"rows": count})
+}
+
+func (s *AdminServer) handleSkipHead(w http.ResponseWriter, r *http.Request) {
+	shardID, err := strconv.ParseUint(r.PathValue("shard"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, logstream.ErrInvalidShard)
+		return
+	}
+
+	seq, err := s.replicator.SkipHead(shardID)
+	if err != nil {
+		writeError(w, shardErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]uint64{"skipped_seq": seq})
+}
+
+func (s *AdminServer) handleRetryHead(w http.ResponseWriter, r *http.Request) {
+	shardID, err := strconv.ParseUint(r.PathValue("shard"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, logstream.ErrInvalidShard)
+		return
+	}
+
+	if err := s.replicator.RetryHead(shardID); err != nil {
+		writeError(w, shardErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]uint64{"shard": shardID})
+}
+
+func shardErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, logstream.ErrInvalidShard):
+		return http.StatusNotFound
+	case errors.Is(err, logstream.ErrNoHeadMessage):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
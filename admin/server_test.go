@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/logstream"
+)
+
+type mockReplicator struct {
+	publishPaused     bool
+	replicationPaused bool
+	leader            bool
+	lastSaved         time.Time
+	skipped           []uint64
+}
+
+func (m *mockReplicator) PausePublishing()                { m.publishPaused = true }
+func (m *mockReplicator) ResumePublishing()               { m.publishPaused = false }
+func (m *mockReplicator) IsPublishPaused() bool           { return m.publishPaused }
+func (m *mockReplicator) PauseReplication()               { m.replicationPaused = true }
+func (m *mockReplicator) ResumeReplication()              { m.replicationPaused = false }
+func (m *mockReplicator) IsReplicationPaused() bool       { return m.replicationPaused }
+func (m *mockReplicator) IsSchemaMismatchPaused() bool    { return false }
+func (m *mockReplicator) LastSaveSnapshotTime() time.Time { return m.lastSaved }
+func (m *mockReplicator) IsSnapshotLeader() bool          { return m.leader }
+func (m *mockReplicator) ForceSaveSnapshot()              { m.lastSaved = time.Now() }
+
+func (m *mockReplicator) SaveSnapshot() {
+	if m.leader {
+		m.ForceSaveSnapshot()
+	}
+}
+
+func (m *mockReplicator) SkipHead(shardID uint64) (uint64, error) {
+	if shardID != 1 {
+		return 0, logstream.ErrInvalidShard
+	}
+
+	m.skipped = append(m.skipped, shardID)
+	return 42, nil
+}
+
+func (m *mockReplicator) RetryHead(shardID uint64) error {
+	return nil
+}
+
+func (m *mockReplicator) ReplicationState() map[string]uint64 {
+	return map[string]uint64{"harmonylite-changes-1": 41}
+}
+
+type mockDB struct{}
+
+func (m *mockDB) ResyncTable(tableName string) (int64, error) {
+	if tableName != "users" {
+		return 0, fmt.Errorf("%w: %s", db.ErrTableNotWatched, tableName)
+	}
+
+	return 3, nil
+}
+
+func (m *mockDB) GetSchemaHash() string     { return "abc" }
+func (m *mockDB) GetPreviousHash() string   { return "" }
+func (m *mockDB) GetSchemaTables() []string { return []string{"users"} }
+
+func newTestServer(rep *mockReplicator) http.Handler {
+	config := &cfg.AdminConfiguration{Enable: true, Bind: "127.0.0.1:0", Token: "secret"}
+	return NewAdminServer(config, rep, &mockDB{}).handler()
+}
+
+func serve(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminServer_Authentication(t *testing.T) {
+	handler := newTestServer(&mockReplicator{})
+
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "GET", "/state", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "GET", "/state", "wrong").Code)
+	assert.Equal(t, http.StatusOK, serve(handler, "GET", "/state", "secret").Code)
+
+	server := NewAdminServer(&cfg.AdminConfiguration{Enable: true}, &mockReplicator{}, &mockDB{})
+	assert.ErrorIs(t, server.Start(), ErrNoToken)
+}
+
+func TestAdminServer_Endpoints(t *testing.T) {
+	rep := &mockReplicator{}
+	handler := newTestServer(rep)
+
+	t.Run("pause and resume", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(handler, "POST", "/publish/pause", "secret").Code)
+		assert.True(t, rep.publishPaused)
+		assert.Equal(t, http.StatusOK, serve(handler, "POST", "/replication/pause", "secret").Code)
+		assert.True(t, rep.replicationPaused)
+
+		var state State
+		rr := serve(handler, "GET", "/state", "secret")
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &state))
+		assert.True(t, state.PublishPaused)
+		assert.True(t, state.Replication.Paused)
+		assert.Equal(t, uint64(41), state.ReplicationState["harmonylite-changes-1"])
+		assert.Equal(t, []string{"users"}, state.Schema.Tables)
+
+		serve(handler, "POST", "/publish/resume", "secret")
+		serve(handler, "POST", "/replication/resume", "secret")
+		assert.False(t, rep.publishPaused)
+		assert.False(t, rep.replicationPaused)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, serve(handler, "POST", "/snapshot", "secret").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "POST", "/snapshot?force=true", "secret").Code)
+		assert.False(t, rep.lastSaved.IsZero())
+	})
+
+	t.Run("resync table", func(t *testing.T) {
+		rr := serve(handler, "POST", "/tables/users/resync", "secret")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"rows":3}`, rr.Body.String())
+		assert.Equal(t, http.StatusNotFound, serve(handler, "POST", "/tables/orders/resync", "secret").Code)
+	})
+
+	t.Run("skip and retry head", func(t *testing.T) {
+		rr := serve(handler, "POST", "/shards/1/skip", "secret")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"skipped_seq":42}`, rr.Body.String())
+		assert.Equal(t, []uint64{1}, rep.skipped)
+
+		assert.Equal(t, http.StatusNotFound, serve(handler, "POST", "/shards/2/skip", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(handler, "POST", "/shards/x/retry", "secret").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "POST", "/shards/1/retry", "secret").Code)
+	})
+
+	t.Run("methods", func(t *testing.T) {
+		assert.Equal(t, http.StatusMethodNotAllowed, serve(handler, "GET", "/publish/pause", "secret").Code)
+	})
+}
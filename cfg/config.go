@@ -1,12 +1,14 @@
 package cfg
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"os"
 	"path"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/BurntSushi/toml"
 	"github.com/denisbrodbeck/machineid"
@@ -15,6 +17,8 @@ import (
 )
 
 type SnapshotStoreType string
+type SnapshotRestoreMode string
+type TracingExporter string
 
 const NodeNamePrefix = "harmonylite-node"
 const EmbeddedClusterName = "e-harmonylite"
@@ -23,6 +27,15 @@ const (
 	S3     SnapshotStoreType = "s3"
 	WebDAV SnapshotStoreType = "webdav"
 	SFTP   SnapshotStoreType = "sftp"
+	File   SnapshotStoreType = "file"
+)
+const (
+	OfflineRestore SnapshotRestoreMode = "offline"
+	OnlineRestore  SnapshotRestoreMode = "online"
+)
+const (
+	OTLPExporter   TracingExporter = "otlp"
+	StdoutExporter TracingExporter = "stdout"
 )
 
 type ReplicationLogConfiguration struct {
@@ -34,21 +47,31 @@ type ReplicationLogConfiguration struct {
 }
 
 type WebDAVConfiguration struct {
-	Url string `toml:"url"`
+	Url     string `toml:"url" secret:"url"`
+	UrlFile string `toml:"url_file"` // File holding the URL, for URLs with credentials
 }
 
 type SFTPConfiguration struct {
-	Url string `toml:"url"`
+	Url     string `toml:"url" secret:"url"`
+	UrlFile string `toml:"url_file"` // File holding the URL, for URLs with credentials
+}
+
+type FileStorageConfiguration struct {
+	Path string `toml:"path"`
 }
 
 type S3Configuration struct {
 	DirPath      string `toml:"path"`
 	Endpoint     string `toml:"endpoint"`
-	AccessKey    string `toml:"access_key"`
-	SecretKey    string `toml:"secret"`
-	SessionToken string `toml:"session_token"`
+	AccessKey    string `toml:"access_key" secret:"true"`
+	SecretKey    string `toml:"secret" secret:"true"`
+	SessionToken string `toml:"session_token" secret:"true"`
 	Bucket       string `toml:"bucket"`
 	UseSSL       bool   `toml:"use_ssl"`
+
+	AccessKeyFile    string `toml:"access_key_file"`    // File holding the access key
+	SecretKeyFile    string `toml:"secret_file"`        // File holding the secret key
+	SessionTokenFile string `toml:"session_token_file"` // File holding the session token
 }
 
 type ObjectStoreConfiguration struct {
@@ -56,15 +79,71 @@ type ObjectStoreConfiguration struct {
 	BucketName string `toml:"bucket"`
 }
 
+type SnapshotRetentionConfiguration struct {
+	KeepLast  int `toml:"keep_last"`  // Number of most recent snapshots to keep
+	KeepDaily int `toml:"keep_daily"` // Days for which the newest snapshot of each day is kept
+}
+
+type SnapshotEncryptionConfiguration struct {
+	Enable  bool   `toml:"enabled"`
+	KeyFile string `toml:"key_file"` // File with base64 encoded keys, one per line, first one encrypts
+	KeyEnv  string `toml:"key_env"`  // Environment variable holding keys when no key file is set
+
+	// Restore objects without the encryption header, only while migrating plaintext snapshots
+	AllowPlaintext bool `toml:"allow_plaintext"`
+}
+
+type SnapshotCompressionConfiguration struct {
+	Enable bool `toml:"enabled"`
+	Level  int  `toml:"level"` // zstd level, 1 (fastest) to 22 (best compression)
+}
+
+type SnapshotIncrementalConfiguration struct {
+	Enable    bool `toml:"enabled"`
+	FullEvery int  `toml:"full_every"` // Every Nth snapshot is a full one, others only hold changed pages
+}
+
+type SnapshotWALConfiguration struct {
+	Enable             bool   `toml:"enabled"`
+	Interval           uint32 `toml:"interval"`                    // Milliseconds between shipping new WAL frames
+	GenerationInterval uint32 `toml:"generation_interval_seconds"` // Seconds after which a new base copy is archived
+	Retention          uint32 `toml:"retention_seconds"`           // Seconds for which archived WAL stays restorable
+}
+
+type SnapshotScheduleConfiguration struct {
+	Cron          string `toml:"cron"`           // Cron expression of snapshot times, e.g. "0 3 * * *"
+	MaxEntries    int64  `toml:"max_entries"`    // Entries across all shards since the last snapshot, 0 uses replication_log.max_entries, negative disables
+	MaxBytes      int64  `toml:"max_bytes"`      // Stream bytes across all shards since the last snapshot, 0 disables
+	CheckInterval uint32 `toml:"check_interval"` // Milliseconds between schedule checks on the snapshot leader
+}
+
+type PeerSnapshotConfiguration struct {
+	Enable    bool   `toml:"enabled"`
+	Timeout   uint32 `toml:"timeout"`    // Per request timeout in milliseconds
+	ChunkSize int    `toml:"chunk_size"` // Bytes transferred per request
+
+	// Serve and accept snapshots without snapshot.encryption, readable by any NATS client
+	AllowPlaintext bool `toml:"allow_plaintext"`
+}
+
 type SnapshotConfiguration struct {
-	Enable    bool                     `toml:"enabled"`
-	Interval  uint32                   `toml:"interval"`
-	LeaderTTL uint32                   `toml:"leader_ttl"` // Leader election TTL in milliseconds (default: 30000)
-	StoreType SnapshotStoreType        `toml:"store"`
-	Nats      ObjectStoreConfiguration `toml:"nats"`
-	S3        S3Configuration          `toml:"s3"`
-	WebDAV    WebDAVConfiguration      `toml:"webdav"`
-	SFTP      SFTPConfiguration        `toml:"sftp"`
+	Enable      bool                             `toml:"enabled"`
+	Interval    uint32                           `toml:"interval"`
+	LeaderTTL   uint32                           `toml:"leader_ttl"` // Leader election TTL in milliseconds (default: 30000)
+	StoreType   SnapshotStoreType                `toml:"store"`
+	RestoreMode SnapshotRestoreMode              `toml:"restore_mode"` // "offline" replaces database files, "online" copies into the live database
+	Retention   SnapshotRetentionConfiguration   `toml:"retention"`
+	Compression SnapshotCompressionConfiguration `toml:"compression"`
+	Encryption  SnapshotEncryptionConfiguration  `toml:"encryption"`
+	Incremental SnapshotIncrementalConfiguration `toml:"incremental"`
+	WAL         SnapshotWALConfiguration         `toml:"wal"`
+	Schedule    SnapshotScheduleConfiguration    `toml:"schedule"`
+	Peer        PeerSnapshotConfiguration        `toml:"peer"`
+	Nats        ObjectStoreConfiguration         `toml:"nats"`
+	S3          S3Configuration                  `toml:"s3"`
+	WebDAV      WebDAVConfiguration              `toml:"webdav"`
+	SFTP        SFTPConfiguration                `toml:"sftp"`
+	File        FileStorageConfiguration         `toml:"file"`
 }
 
 type NATSConfiguration struct {
@@ -74,7 +153,13 @@ type NATSConfiguration struct {
 	ServerConfigFile     string   `toml:"server_config"`
 	SeedFile             string   `toml:"seed_file"`
 	CredsUser            string   `toml:"user_name"`
-	CredsPassword        string   `toml:"user_password"`
+	CredsPassword        string   `toml:"user_password" secret:"true"`
+	CredsPasswordFile    string   `toml:"user_password_file"`   // File holding the user password
+	CredsFile            string   `toml:"creds_file"`           // User JWT and nkey seed (.creds) file
+	Token                string   `toml:"token" secret:"true"`  // Authentication token
+	TokenFile            string   `toml:"token_file"`           // File holding the authentication token
+	JetStreamDomain      string   `toml:"jetstream_domain"`     // JetStream domain, e.g. of a leafnode
+	JetStreamAPIPrefix   string   `toml:"jetstream_api_prefix"` // JetStream API prefix imported from another account
 	CAFile               string   `toml:"ca_file"`
 	CertFile             string   `toml:"cert_file"`
 	KeyFile              string   `toml:"key_file"`
@@ -95,37 +180,69 @@ type PrometheusConfiguration struct {
 	Subsystem string `toml:"subsystem"`
 }
 
+type TracingConfiguration struct {
+	Enable   bool            `toml:"enable"`
+	Exporter TracingExporter `toml:"exporter"` // otlp or stdout
+	Endpoint string          `toml:"endpoint"` // OTLP/HTTP collector address (default: OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318)
+	Insecure bool            `toml:"insecure"` // Send spans to the collector without TLS
+}
+
 type HealthCheckConfiguration struct {
-	Enable   bool   `toml:"enable"`
-	Bind     string `toml:"bind"`
-	Path     string `toml:"path"`
-	Detailed bool   `toml:"detailed"`
+	Enable        bool                   `toml:"enable"`
+	Bind          string                 `toml:"bind"`
+	Path          string                 `toml:"path"`
+	Detailed      bool                   `toml:"detailed"`
+	LivenessPath  string                 `toml:"liveness_path"`  // Path of the liveness probe (default: /livez)
+	ReadinessPath string                 `toml:"readiness_path"` // Path of the readiness probe (default: /readyz)
+	Readiness     ReadinessConfiguration `toml:"readiness"`
+}
+
+type ReadinessConfiguration struct {
+	MaxReplicationLag    uint64 `toml:"max_replication_lag"`     // Stream entries the node may be behind across shards (0 disables)
+	MaxPendingChanges    int64  `toml:"max_pending_changes"`     // Change log rows the node may have left to publish (0 disables)
+	FailOnSchemaMismatch bool   `toml:"fail_on_schema_mismatch"` // Not ready while replication is paused on a schema mismatch
+	FailOnRestore        bool   `toml:"fail_on_restore"`         // Not ready while a snapshot restore is in progress
+}
+
+type AdminConfiguration struct {
+	Enable    bool   `toml:"enable"`
+	Bind      string `toml:"bind"`                // Admin API listening address (default: 127.0.0.1:8091)
+	Token     string `toml:"token" secret:"true"` // Bearer token required on every admin request
+	TokenFile string `toml:"token_file"`          // File holding the bearer token
+}
+
+type SchemaConfiguration struct {
+	CompatibilityWindow int `toml:"compatibility_window"` // Number of prior schema versions accepted from peers (default: 1)
 }
 
 type Configuration struct {
-	SeqMapPath      string `toml:"seq_map_path"`
-	DBPath          string `toml:"db_path"`
-	NodeID          uint64 `toml:"node_id"`
-	Publish         bool   `toml:"publish"`
-	Replicate       bool   `toml:"replicate"`
-	ScanMaxChanges  uint32 `toml:"scan_max_changes"`
-	CleanupInterval uint32 `toml:"cleanup_interval"`
-	SleepTimeout    uint32 `toml:"sleep_timeout"`
-	PollingInterval uint32 `toml:"polling_interval"`
+	SeqMapPath      string   `toml:"seq_map_path"`
+	DBPath          string   `toml:"db_path"`
+	NodeID          uint64   `toml:"node_id"`
+	Publish         bool     `toml:"publish"`
+	Replicate       bool     `toml:"replicate"`
+	ScanMaxChanges  uint32   `toml:"scan_max_changes"`
+	CleanupInterval uint32   `toml:"cleanup_interval"`
+	SleepTimeout    uint32   `toml:"sleep_timeout"`
+	PollingInterval uint32   `toml:"polling_interval"`
+	IncludeTables   []string `toml:"include_tables"` // Tables to replicate, all tables when empty
 
 	Snapshot       SnapshotConfiguration       `toml:"snapshot"`
 	ReplicationLog ReplicationLogConfiguration `toml:"replication_log"`
+	Schema         SchemaConfiguration         `toml:"schema"`
 	NATS           NATSConfiguration           `toml:"nats"`
 	Logging        LoggingConfiguration        `toml:"logging"`
 	Prometheus     PrometheusConfiguration     `toml:"prometheus"`
+	Tracing        TracingConfiguration        `toml:"tracing"`
 	HealthCheck    *HealthCheckConfiguration   `toml:"health_check"`
+	Admin          AdminConfiguration          `toml:"admin"`
 }
 
 var ConfigPathFlag = flag.String("config", "", "Path to configuration file")
-var CleanupFlag = flag.Bool("cleanup", false, "Only cleanup harmonylite triggers and changelogs")
-var SaveSnapshotFlag = flag.Bool("save-snapshot", false, "Only take snapshot and upload")
-var SchemaStatusFlag = flag.Bool("schema-status", false, "Display schema status")
-var SchemaStatusClusterFlag = flag.Bool("schema-status-cluster", false, "Display cluster-wide schema status")
+var CleanupFlag = flag.Bool("cleanup", false, "Deprecated: use \"harmonylite cleanup\"")
+var SaveSnapshotFlag = flag.Bool("save-snapshot", false, "Deprecated: use \"harmonylite snapshot save\"")
+var SchemaStatusFlag = flag.Bool("schema-status", false, "Deprecated: use \"harmonylite schema status\"")
+var SchemaStatusClusterFlag = flag.Bool("schema-status-cluster", false, "Deprecated: use \"harmonylite schema status -cluster\"")
 var ClusterAddrFlag = flag.String("cluster-addr", "", "Cluster listening address")
 var ClusterPeersFlag = flag.String("cluster-peers", "", "Comma separated list of clusters")
 var LeafServerFlag = flag.String("leaf-servers", "", "Comma separated list of leaf servers")
@@ -133,68 +250,148 @@ var ProfServer = flag.String("pprof", "", "PProf listening address")
 var NodeIDFlag = flag.Uint64("node-id", 0, "Override node ID from config file")
 
 var DataRootDir = os.TempDir()
-var Config = &Configuration{
-	SeqMapPath:      path.Join(DataRootDir, "seq-map.cbor"),
-	DBPath:          path.Join(DataRootDir, "harmonylite.db"),
-	NodeID:          0,
-	Publish:         true,
-	Replicate:       true,
-	ScanMaxChanges:  512,
-	CleanupInterval: 5000,
-	SleepTimeout:    0,
-	PollingInterval: 0,
-
-	Snapshot: SnapshotConfiguration{
-		Enable:    true,
-		Interval:  0,
-		StoreType: Nats,
-		Nats: ObjectStoreConfiguration{
-			Replicas: 1,
+
+// Config is the configuration the node started with, settings applied by Reload are read
+// with Current
+var Config = defaultConfiguration()
+
+// reloaded is the configuration published by the last Reload
+var reloaded atomic.Pointer[Configuration]
+
+// Current returns the running configuration, including settings applied by Reload. Reloads
+// publish a new configuration instead of changing it, the returned one must not be modified.
+func Current() *Configuration {
+	if c := reloaded.Load(); c != nil {
+		return c
+	}
+
+	return Config
+}
+
+// defaultNodeID is derived from the machine ID when the configuration sets no node ID
+var defaultNodeID uint64
+
+func defaultConfiguration() *Configuration {
+	return &Configuration{
+		SeqMapPath:      path.Join(DataRootDir, "seq-map.cbor"),
+		DBPath:          path.Join(DataRootDir, "harmonylite.db"),
+		NodeID:          0,
+		Publish:         true,
+		Replicate:       true,
+		ScanMaxChanges:  512,
+		CleanupInterval: 5000,
+		SleepTimeout:    0,
+		PollingInterval: 0,
+
+		Snapshot: SnapshotConfiguration{
+			Enable:      true,
+			Interval:    0,
+			StoreType:   Nats,
+			RestoreMode: OfflineRestore,
+			Retention: SnapshotRetentionConfiguration{
+				KeepLast:  3,
+				KeepDaily: 0,
+			},
+			Compression: SnapshotCompressionConfiguration{
+				Enable: true,
+				Level:  3,
+			},
+			Encryption: SnapshotEncryptionConfiguration{
+				Enable: false,
+				KeyEnv: "HARMONYLITE_SNAPSHOT_KEYS",
+			},
+			Incremental: SnapshotIncrementalConfiguration{
+				Enable:    false,
+				FullEvery: 6,
+			},
+			WAL: SnapshotWALConfiguration{
+				Enable:             false,
+				Interval:           1000,
+				GenerationInterval: 86400,
+				Retention:          604800,
+			},
+			Schedule: SnapshotScheduleConfiguration{
+				Cron:          "",
+				MaxEntries:    0,
+				MaxBytes:      0,
+				CheckInterval: 5000,
+			},
+			Peer: PeerSnapshotConfiguration{
+				Enable:    false,
+				Timeout:   10000,
+				ChunkSize: 256 * 1024,
+			},
+			Nats: ObjectStoreConfiguration{
+				Replicas: 1,
+			},
+			S3:     S3Configuration{},
+			WebDAV: WebDAVConfiguration{},
+			SFTP:   SFTPConfiguration{},
+			File:   FileStorageConfiguration{},
+		},
+
+		ReplicationLog: ReplicationLogConfiguration{
+			Shards:         1,
+			MaxEntries:     1024,
+			Replicas:       1,
+			Compress:       true,
+			UpdateExisting: false,
+		},
+
+		Schema: SchemaConfiguration{
+			CompatibilityWindow: 1,
+		},
+
+		NATS: NATSConfiguration{
+			URLs:                 []string{},
+			SubjectPrefix:        "harmonylite-change-log",
+			StreamPrefix:         "harmonylite-changes",
+			ServerConfigFile:     "",
+			SeedFile:             "",
+			CredsPassword:        "",
+			CredsUser:            "",
+			BindAddress:          ":-1",
+			ConnectRetries:       5,
+			ReconnectWaitSeconds: 2,
+		},
+
+		Logging: LoggingConfiguration{
+			Verbose: false,
+			Format:  "console",
+		},
+
+		Prometheus: PrometheusConfiguration{
+			Bind:      ":3010",
+			Enable:    false,
+			Namespace: "harmonylite",
+			Subsystem: "",
+		},
+
+		Tracing: TracingConfiguration{
+			Enable:   false,
+			Exporter: OTLPExporter,
 		},
-		S3:     S3Configuration{},
-		WebDAV: WebDAVConfiguration{},
-		SFTP:   SFTPConfiguration{},
-	},
-
-	ReplicationLog: ReplicationLogConfiguration{
-		Shards:         1,
-		MaxEntries:     1024,
-		Replicas:       1,
-		Compress:       true,
-		UpdateExisting: false,
-	},
-
-	NATS: NATSConfiguration{
-		URLs:                 []string{},
-		SubjectPrefix:        "harmonylite-change-log",
-		StreamPrefix:         "harmonylite-changes",
-		ServerConfigFile:     "",
-		SeedFile:             "",
-		CredsPassword:        "",
-		CredsUser:            "",
-		BindAddress:          ":-1",
-		ConnectRetries:       5,
-		ReconnectWaitSeconds: 2,
-	},
-
-	Logging: LoggingConfiguration{
-		Verbose: false,
-		Format:  "console",
-	},
-
-	Prometheus: PrometheusConfiguration{
-		Bind:      ":3010",
-		Enable:    false,
-		Namespace: "harmonylite",
-		Subsystem: "",
-	},
-
-	HealthCheck: &HealthCheckConfiguration{
-		Enable:   false, // Disabled by default
-		Bind:     "0.0.0.0:8090",
-		Path:     "/health",
-		Detailed: true,
-	},
+
+		HealthCheck: &HealthCheckConfiguration{
+			Enable:        false, // Disabled by default
+			Bind:          "0.0.0.0:8090",
+			Path:          "/health",
+			Detailed:      true,
+			LivenessPath:  "/livez",
+			ReadinessPath: "/readyz",
+			Readiness: ReadinessConfiguration{
+				MaxReplicationLag:    0,
+				MaxPendingChanges:    0,
+				FailOnSchemaMismatch: true,
+				FailOnRestore:        true,
+			},
+		},
+		Admin: AdminConfiguration{
+			Enable: false,
+			Bind:   "127.0.0.1:8091",
+			Token:  "",
+		},
+	}
 }
 
 func init() {
@@ -212,33 +409,60 @@ func init() {
 		}
 
 		Config.NodeID = hasher.Sum64()
+		defaultNodeID = Config.NodeID
 	}
 }
 
 func Load(filePath string) error {
-	_, err := toml.DecodeFile(filePath, Config)
-	if os.IsNotExist(err) {
-		return nil
-	}
-
+	rootDir, err := decode(filePath, Config)
 	if err != nil {
 		return err
 	}
 
+	reloaded.Store(nil)
+	DataRootDir = rootDir
+	return nil
+}
+
+// decode reads the configuration file into c, when there is one, then applies environment
+// overrides and flags, and validates the result. Returns the data root directory.
+func decode(filePath string, c *Configuration) (string, error) {
+	var unknownErr error
+	if filePath != "" {
+		md, err := toml.DecodeFile(filePath, c)
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("configuration file %s not found", filePath)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		unknownErr = unknownKeys(c, filePath, md)
+	}
+
+	if err := applyEnv(c); err != nil {
+		return "", errors.Join(unknownErr, err)
+	}
+
+	if err := resolveSecrets(c); err != nil {
+		return "", errors.Join(unknownErr, err)
+	}
+
 	if *NodeIDFlag != 0 {
-		Config.NodeID = *NodeIDFlag
+		c.NodeID = *NodeIDFlag
 	}
 
-	DataRootDir, err = filepath.Abs(path.Dir(Config.DBPath))
+	rootDir, err := filepath.Abs(path.Dir(c.DBPath))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if Config.SeqMapPath == "" {
-		Config.SeqMapPath = path.Join(DataRootDir, "seq-map.cbor")
+	if c.SeqMapPath == "" {
+		c.SeqMapPath = path.Join(rootDir, "seq-map.cbor")
 	}
 
-	return nil
+	return rootDir, errors.Join(unknownErr, c.Validate())
 }
 
 func (c *Configuration) SnapshotStorageType() SnapshotStoreType {
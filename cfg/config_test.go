@@ -0,0 +1,198 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadFile loads content into a fresh configuration, restoring Config after the test
+func loadFile(t *testing.T, content string) error {
+	saved := Config
+	t.Cleanup(func() { Config = saved })
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(configPath, []byte(content), 0644))
+
+	Config = defaultConfiguration()
+	Config.NodeID = defaultNodeID
+	return Load(configPath)
+}
+
+func TestLoad_EnvOverrides(t *testing.T) {
+	t.Setenv("HARMONYLITE_CLEANUP_INTERVAL", "42")
+	t.Setenv("HARMONYLITE_SNAPSHOT_S3_BUCKET", "backups")
+	t.Setenv("HARMONYLITE_NATS_URLS", "nats://a:4222, nats://b:4222")
+	t.Setenv("HARMONYLITE_HEALTH_CHECK_ENABLE", "true")
+
+	err := loadFile(t, `
+db_path = "/tmp/env.db"
+cleanup_interval = 1000
+
+[snapshot]
+store = "s3"
+
+[snapshot.s3]
+endpoint = "s3.example.com"
+`)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(42), Config.CleanupInterval)
+	assert.Equal(t, "backups", Config.Snapshot.S3.Bucket)
+	assert.Equal(t, []string{"nats://a:4222", "nats://b:4222"}, Config.NATS.URLs)
+	assert.True(t, Config.HealthCheck.Enable)
+
+	t.Setenv("HARMONYLITE_CLEANUP_INTERVAL", "soon")
+	err = loadFile(t, `db_path = "/tmp/env.db"`)
+	assert.ErrorContains(t, err, `invalid value "soon" for HARMONYLITE_CLEANUP_INTERVAL`)
+}
+
+func TestEnvName_Unique(t *testing.T) {
+	names := map[string]string{}
+	for _, s := range settings(defaultConfiguration()) {
+		name := EnvName(s.key)
+		assert.NotContains(t, names, name, "%s and %s share an environment variable", names[name], s.key)
+		names[name] = s.key
+	}
+
+	assert.Equal(t, "HARMONYLITE_SNAPSHOT_SCHEDULE_MAX_ENTRIES", EnvName("snapshot.schedule.max_entries"))
+}
+
+func TestLoad_UnknownKeys(t *testing.T) {
+	err := loadFile(t, `
+db_path = "/tmp/unknown.db"
+cleanup_intervall = 100
+
+[loging]
+verbose = true
+`)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `unknown key "cleanup_intervall"`)
+	assert.ErrorContains(t, err, `did you mean "cleanup_interval"?`)
+	assert.ErrorContains(t, err, `did you mean "logging"?`)
+	assert.NotContains(t, err.Error(), "loging.verbose", "keys of unknown tables aren't repeated")
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	saved := Config
+	t.Cleanup(func() { Config = saved })
+
+	Config = defaultConfiguration()
+	assert.ErrorContains(t, Load(filepath.Join(t.TempDir(), "missing.toml")), "not found")
+
+	Config = defaultConfiguration()
+	assert.NoError(t, Load(""), "defaults are used without a configuration file")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+		errs   []string
+	}{
+		{
+			name:   "defaults",
+			modify: func(c *Configuration) {},
+		},
+		{
+			name: "too many replicas",
+			modify: func(c *Configuration) {
+				c.ReplicationLog.Replicas = 7
+			},
+			errs: []string{"replication_log.replicas is 7"},
+		},
+		{
+			name: "s3 without bucket",
+			modify: func(c *Configuration) {
+				c.Snapshot.StoreType = S3
+			},
+			errs: []string{"snapshot.s3.bucket is required", "snapshot.s3.endpoint is required"},
+		},
+		{
+			name: "storage ignored with snapshots disabled",
+			modify: func(c *Configuration) {
+				c.Snapshot.Enable = false
+				c.Snapshot.StoreType = S3
+			},
+		},
+		{
+			name: "wal without snapshots",
+			modify: func(c *Configuration) {
+				c.Snapshot.Enable = false
+				c.Snapshot.WAL.Enable = true
+			},
+			errs: []string{"snapshot.wal.enabled needs snapshot.enabled"},
+		},
+		{
+			name: "unencrypted peer snapshots",
+			modify: func(c *Configuration) {
+				c.Snapshot.Peer.Enable = true
+			},
+			errs: []string{"enable snapshot.encryption or set snapshot.peer.allow_plaintext"},
+		},
+		{
+			name: "admin without token on the health check address",
+			modify: func(c *Configuration) {
+				c.Admin.Enable = true
+				c.Admin.Bind = "0.0.0.0:8090"
+				c.HealthCheck.Enable = true
+			},
+			errs: []string{"admin.enable needs admin.token", "health_check.bind and admin.bind both listen on 0.0.0.0:8090"},
+		},
+		{
+			name: "unknown enums",
+			modify: func(c *Configuration) {
+				c.Snapshot.StoreType = "ftp"
+				c.Snapshot.RestoreMode = "live"
+				c.Logging.Format = "text"
+			},
+			errs: []string{`snapshot.store is "ftp"`, `snapshot.restore_mode is "live"`, `logging.format is "text"`},
+		},
+		{
+			name: "half configured client certificate",
+			modify: func(c *Configuration) {
+				c.NATS.CertFile = "/etc/harmonylite/client.crt"
+			},
+			errs: []string{"nats.cert_file and nats.key_file must be set together"},
+		},
+		{
+			name: "unknown tracing exporter",
+			modify: func(c *Configuration) {
+				c.Tracing.Enable = true
+				c.Tracing.Exporter = "jaeger"
+			},
+			errs: []string{`tracing.exporter is "jaeger"`},
+		},
+		{
+			name: "conflicting NATS authentication",
+			modify: func(c *Configuration) {
+				c.NATS.CredsFile = "/etc/harmonylite/user.creds"
+				c.NATS.SeedFile = "/etc/harmonylite/user.seed"
+				c.NATS.JetStreamDomain = "edge"
+				c.NATS.JetStreamAPIPrefix = "$JS.hub.API"
+			},
+			errs: []string{"nats.creds_file and nats.seed_file both set", "nats.jetstream_domain and nats.jetstream_api_prefix both set"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfiguration()
+			tt.modify(c)
+
+			err := c.Validate()
+			if len(tt.errs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			for _, e := range tt.errs {
+				assert.ErrorContains(t, err, e)
+			}
+		})
+	}
+}
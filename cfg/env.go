@@ -0,0 +1,115 @@
+package cfg
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of the environment variables overriding settings
+const EnvPrefix = "HARMONYLITE_"
+
+// setting is a configuration value along with its configuration file key
+type setting struct {
+	key   string
+	value reflect.Value
+	field reflect.StructField
+}
+
+// EnvName returns the environment variable overriding a configuration file key, e.g.
+// HARMONYLITE_SNAPSHOT_S3_BUCKET for snapshot.s3.bucket
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// settings lists every value of c that can be set in the configuration file
+func settings(c *Configuration) []setting {
+	return appendSettings(nil, reflect.ValueOf(c).Elem(), "", reflect.StructField{})
+}
+
+func appendSettings(list []setting, v reflect.Value, key string, field reflect.StructField) []setting {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return append(list, setting{key: key, value: v, field: field})
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if key != "" {
+			name = key + "." + name
+		}
+
+		list = appendSettings(list, v.Field(i), name, f)
+	}
+
+	return list
+}
+
+// applyEnv overrides settings of c with the environment variables that are set
+func applyEnv(c *Configuration) error {
+	for _, s := range settings(c) {
+		name := EnvName(s.key)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setString(s.value, raw); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", raw, name, err)
+		}
+	}
+
+	return nil
+}
+
+// setString parses raw into v, lists are comma separated
+func setString(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a non-negative integer up to %d bits", v.Type().Bits())
+		}
+		v.SetUint(u)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(items)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
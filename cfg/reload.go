@@ -0,0 +1,101 @@
+package cfg
+
+import (
+	"reflect"
+	"strings"
+)
+
+// liveKeys are the settings applied to a running node on reload, any key under them included
+var liveKeys = []string{
+	"cleanup_interval",
+	"include_tables",
+	"snapshot.interval",
+	"snapshot.schedule",
+	"nats.ca_file",
+	"nats.cert_file",
+	"nats.key_file",
+	"logging",
+	"prometheus.bind",
+	"health_check",
+}
+
+// ReloadResult lists the configuration keys changed by a reload
+type ReloadResult struct {
+	Applied []string // Changes published to Current
+	Restart []string // Changes ignored until the next restart
+}
+
+// Changed tells if a key applied by the reload is key or under key
+func (r *ReloadResult) Changed(key string) bool {
+	for _, k := range r.Applied {
+		if underKey(k, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload re-reads the configuration file over the defaults and publishes it as Current, with
+// the settings that can't change while running kept at their running value. The running
+// configuration is never modified, components holding it keep reading consistent values.
+func Reload(filePath string) (*ReloadResult, error) {
+	cur := Current()
+	next := defaultConfiguration()
+	next.NodeID = defaultNodeID
+	if _, err := decode(filePath, next); err != nil {
+		return nil, err
+	}
+
+	res := &ReloadResult{}
+	reloadValue(reflect.ValueOf(cur).Elem(), reflect.ValueOf(next).Elem(), "", res)
+	reloaded.Store(next)
+	return res, nil
+}
+
+// reloadValue compares settings in cur with next, copying changed restart-only settings back
+// from cur to next
+func reloadValue(cur reflect.Value, next reflect.Value, key string, res *ReloadResult) {
+	if cur.Kind() == reflect.Pointer {
+		if cur.IsNil() || next.IsNil() {
+			reloadLeaf(cur, next, key, res)
+			return
+		}
+
+		cur, next = cur.Elem(), next.Elem()
+	}
+
+	if cur.Kind() != reflect.Struct {
+		reloadLeaf(cur, next, key, res)
+		return
+	}
+
+	for i := 0; i < cur.NumField(); i++ {
+		name, _, _ := strings.Cut(cur.Type().Field(i).Tag.Get("toml"), ",")
+		if key != "" {
+			name = key + "." + name
+		}
+
+		reloadValue(cur.Field(i), next.Field(i), name, res)
+	}
+}
+
+func reloadLeaf(cur reflect.Value, next reflect.Value, key string, res *ReloadResult) {
+	if reflect.DeepEqual(cur.Interface(), next.Interface()) {
+		return
+	}
+
+	for _, live := range liveKeys {
+		if underKey(key, live) {
+			res.Applied = append(res.Applied, key)
+			return
+		}
+	}
+
+	next.Set(cur)
+	res.Restart = append(res.Restart, key)
+}
+
+func underKey(key string, parent string) bool {
+	return key == parent || strings.HasPrefix(key, parent+".")
+}
@@ -0,0 +1,95 @@
+package cfg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	saved := Config
+	t.Cleanup(func() {
+		Config = saved
+		reloaded.Store(nil)
+	})
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(configPath, []byte(content), 0644))
+	}
+
+	write(`
+db_path = "/tmp/reload.db"
+cleanup_interval = 5000
+
+[replication_log]
+shards = 1
+
+[logging]
+verbose = false
+`)
+	Config = defaultConfiguration()
+	Config.NodeID = defaultNodeID
+	require.NoError(t, Load(configPath))
+
+	write(`
+db_path = "/tmp/reload.db"
+cleanup_interval = 1000
+include_tables = ["users"]
+
+[replication_log]
+shards = 4
+
+[logging]
+verbose = true
+
+[health_check]
+bind = "127.0.0.1:9000"
+`)
+	running := Current()
+	res, err := Reload(configPath)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"cleanup_interval", "include_tables", "logging.verbose", "health_check.bind"}, res.Applied)
+	assert.Equal(t, []string{"replication_log.shards"}, res.Restart)
+	assert.True(t, res.Changed("health_check"))
+	assert.False(t, res.Changed("snapshot.schedule"))
+
+	assert.Equal(t, uint32(1000), Current().CleanupInterval)
+	assert.True(t, Current().Logging.Verbose)
+	assert.Equal(t, []string{"users"}, Current().IncludeTables)
+	assert.Equal(t, "127.0.0.1:9000", Current().HealthCheck.Bind)
+	assert.Equal(t, uint64(1), Current().ReplicationLog.Shards, "restart-only setting kept")
+
+	// The running configuration is published anew, never modified
+	assert.Same(t, Config, running)
+	assert.Equal(t, uint32(5000), running.CleanupInterval)
+	assert.False(t, running.Logging.Verbose)
+
+	// Keys removed from the file go back to their default
+	write(`
+db_path = "/tmp/reload.db"
+
+[replication_log]
+shards = 1
+`)
+	res, err = Reload(configPath)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"cleanup_interval", "include_tables", "logging.verbose", "health_check.bind"}, res.Applied)
+	assert.Empty(t, res.Restart)
+	assert.Equal(t, uint32(5000), Current().CleanupInterval)
+
+	write(`db_path = `)
+	_, err = Reload(configPath)
+	assert.Error(t, err)
+	assert.Equal(t, uint32(5000), Current().CleanupInterval)
+
+	// Loading the configuration again drops reloaded settings
+	write(`db_path = "/tmp/reload.db"`)
+	require.NoError(t, Load(configPath))
+	assert.Same(t, Config, Current())
+}
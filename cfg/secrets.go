@@ -0,0 +1,118 @@
+package cfg
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Prefixes of secret values read from an environment variable or a file
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// redactedValue replaces secrets in printed configurations
+const redactedValue = "[redacted]"
+
+// resolveSecrets replaces secret settings with the content of their *_file setting, or of
+// the environment variable or file they reference with env:NAME or file:/path
+func resolveSecrets(c *Configuration) error {
+	all := settings(c)
+	byKey := make(map[string]setting, len(all))
+	for _, s := range all {
+		byKey[s.key] = s
+	}
+
+	v := &validator{}
+	for _, s := range all {
+		if s.field.Tag.Get("secret") == "" {
+			continue
+		}
+
+		value := s.value.String()
+		if f, ok := byKey[s.key+"_file"]; ok && f.value.String() != "" {
+			if value != "" {
+				v.check(false, "%s and %s are both set, keep only one", s.key, f.key)
+				continue
+			}
+
+			value = secretFilePrefix + f.value.String()
+		}
+
+		resolved, err := resolveSecret(value)
+		if err != nil {
+			v.check(false, "%s: %s", s.key, err)
+			continue
+		}
+
+		s.value.SetString(resolved)
+	}
+
+	return v.err()
+}
+
+func resolveSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, secretEnvPrefix); ok {
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return secret, nil
+	}
+
+	if p, ok := strings.CutPrefix(value, secretFilePrefix); ok {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return value, nil
+}
+
+// Redacted returns a copy of the configuration safe to log or print, secrets are replaced
+// and passwords are removed from URLs
+func (c *Configuration) Redacted() *Configuration {
+	r := defaultConfiguration()
+	src := settings(c)
+	for i, s := range settings(r) {
+		s.value.Set(src[i].value)
+		if s.value.Kind() == reflect.Slice && !s.value.IsNil() {
+			s.value.Set(reflect.AppendSlice(reflect.MakeSlice(s.value.Type(), 0, s.value.Len()), s.value))
+		}
+
+		switch s.field.Tag.Get("secret") {
+		case "":
+		case "url":
+			s.value.SetString(redactURL(s.value.String()))
+		default:
+			if s.value.String() != "" {
+				s.value.SetString(redactedValue)
+			}
+		}
+	}
+
+	return r
+}
+
+// redactURL masks the password of a storage URL, WebDAV URLs carry it in the secret query
+// parameter
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedValue
+	}
+
+	if qp := u.Query(); qp.Has("secret") {
+		qp.Set("secret", "xxxxx")
+		u.RawQuery = qp.Encode()
+	}
+
+	return u.Redacted()
+}
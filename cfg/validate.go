@@ -0,0 +1,216 @@
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// maxStreamReplicas is the largest replica count JetStream accepts for a stream
+const maxStreamReplicas = 5
+
+// Validate reports invalid and contradictory settings, the returned error joins one error
+// per problem
+func (c *Configuration) Validate() error {
+	v := &validator{}
+
+	v.check(c.DBPath != "", "db_path is required")
+	v.check(c.ScanMaxChanges > 0, "scan_max_changes must be at least 1")
+
+	v.check(c.ReplicationLog.Shards > 0, "replication_log.shards must be at least 1")
+	v.check(c.ReplicationLog.Replicas >= 0 && c.ReplicationLog.Replicas <= maxStreamReplicas,
+		"replication_log.replicas is %d, JetStream allows 1 to %d replicas (0 picks one from the shard count)",
+		c.ReplicationLog.Replicas, maxStreamReplicas)
+	v.check(c.Schema.CompatibilityWindow >= 0, "schema.compatibility_window can't be negative")
+
+	c.validateSnapshot(v)
+
+	v.check(c.Logging.Format == "console" || c.Logging.Format == "json",
+		"logging.format is %q, expected console or json", c.Logging.Format)
+	v.check(!c.Tracing.Enable || c.Tracing.Exporter == OTLPExporter || c.Tracing.Exporter == StdoutExporter,
+		"tracing.exporter is %q, expected otlp or stdout", c.Tracing.Exporter)
+	v.check((c.NATS.CertFile == "") == (c.NATS.KeyFile == ""),
+		"nats.cert_file and nats.key_file must be set together")
+	v.check(c.NATS.CredsFile == "" || c.NATS.SeedFile == "",
+		"nats.creds_file and nats.seed_file both set, a .creds file already holds the nkey seed")
+	v.check(c.NATS.Token == "" || c.NATS.CredsUser == "",
+		"nats.token and nats.user_name both set, pick one authentication method")
+	v.check(c.NATS.JetStreamDomain == "" || c.NATS.JetStreamAPIPrefix == "",
+		"nats.jetstream_domain and nats.jetstream_api_prefix both set, a domain implies its API prefix")
+
+	if hc := c.HealthCheck; hc != nil && hc.Enable {
+		v.check(strings.HasPrefix(hc.Path, "/"), "health_check.path must start with /")
+		v.check(hc.LivenessPath == "" || strings.HasPrefix(hc.LivenessPath, "/"),
+			"health_check.liveness_path must start with / (empty disables the endpoint)")
+		v.check(hc.ReadinessPath == "" || strings.HasPrefix(hc.ReadinessPath, "/"),
+			"health_check.readiness_path must start with / (empty disables the endpoint)")
+	}
+
+	v.check(!c.Admin.Enable || c.Admin.Token != "", "admin.enable needs admin.token or admin.token_file, the admin API only accepts authenticated requests")
+
+	// Servers enabled on the same address fail to start
+	binds := map[string]string{}
+	for _, s := range []struct {
+		key     string
+		enabled bool
+		bind    string
+	}{
+		{"prometheus.bind", c.Prometheus.Enable, c.Prometheus.Bind},
+		{"health_check.bind", c.HealthCheck != nil && c.HealthCheck.Enable, healthBind(c)},
+		{"admin.bind", c.Admin.Enable, c.Admin.Bind},
+	} {
+		if !s.enabled {
+			continue
+		}
+
+		if other, ok := binds[s.bind]; ok {
+			v.check(false, "%s and %s both listen on %s", other, s.key, s.bind)
+		}
+		binds[s.bind] = s.key
+	}
+
+	return v.err()
+}
+
+func (c *Configuration) validateSnapshot(v *validator) {
+	s := &c.Snapshot
+
+	switch s.StoreType {
+	case Nats, S3, WebDAV, SFTP, File:
+	default:
+		v.check(false, "snapshot.store is %q, expected one of nats, s3, webdav, sftp or file", s.StoreType)
+	}
+
+	v.check(s.RestoreMode == OfflineRestore || s.RestoreMode == OnlineRestore,
+		"snapshot.restore_mode is %q, expected offline or online", s.RestoreMode)
+	v.check(!s.WAL.Enable || s.Enable, "snapshot.wal.enabled needs snapshot.enabled, WAL is archived to the snapshot storage")
+	if !s.Enable {
+		return
+	}
+
+	switch s.StoreType {
+	case S3:
+		v.check(s.S3.Bucket != "", "snapshot.s3.bucket is required with the s3 snapshot store")
+		v.check(s.S3.Endpoint != "", "snapshot.s3.endpoint is required with the s3 snapshot store")
+	case WebDAV:
+		v.check(s.WebDAV.Url != "", "snapshot.webdav.url or snapshot.webdav.url_file is required with the webdav snapshot store")
+	case SFTP:
+		v.check(s.SFTP.Url != "", "snapshot.sftp.url or snapshot.sftp.url_file is required with the sftp snapshot store")
+	case File:
+		v.check(s.File.Path != "", "snapshot.file.path is required with the file snapshot store")
+	}
+
+	v.check(!s.Compression.Enable || (s.Compression.Level >= 1 && s.Compression.Level <= 22),
+		"snapshot.compression.level is %d, zstd levels go from 1 to 22", s.Compression.Level)
+	v.check(!s.Incremental.Enable || s.Incremental.FullEvery >= 1,
+		"snapshot.incremental.full_every must be at least 1")
+	v.check(!s.Encryption.Enable || s.Encryption.KeyFile != "" || s.Encryption.KeyEnv != "",
+		"snapshot.encryption.enabled needs snapshot.encryption.key_file or snapshot.encryption.key_env")
+	v.check(!s.WAL.Enable || s.WAL.Interval > 0, "snapshot.wal.interval must be at least 1")
+	v.check(s.Retention.KeepLast >= 0 && s.Retention.KeepDaily >= 0, "snapshot.retention values can't be negative")
+	v.check(!s.Peer.Enable || (s.Peer.Timeout > 0 && s.Peer.ChunkSize > 0),
+		"snapshot.peer.timeout and snapshot.peer.chunk_size must be at least 1")
+	v.check(!s.Peer.Enable || s.Encryption.Enable || s.Peer.AllowPlaintext,
+		"snapshot.peer sends the whole database to any NATS client, enable snapshot.encryption or set snapshot.peer.allow_plaintext")
+}
+
+func healthBind(c *Configuration) string {
+	if c.HealthCheck == nil {
+		return ""
+	}
+
+	return c.HealthCheck.Bind
+}
+
+// validator collects configuration problems
+type validator struct {
+	errs []error
+}
+
+func (v *validator) check(ok bool, format string, args ...any) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf(format, args...))
+	}
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// unknownKeys reports keys of the configuration file that match no setting, suggesting the
+// closest known key
+func unknownKeys(c *Configuration, filePath string, md toml.MetaData) error {
+	known := make(map[string]bool)
+	for _, s := range settings(c) {
+		for key := s.key; key != ""; key, _ = cutLast(key) {
+			known[key] = true
+		}
+	}
+
+	undecoded := md.Undecoded()
+	unknown := make(map[string]bool, len(undecoded))
+	v := &validator{}
+	for _, k := range undecoded {
+		key := k.String()
+		unknown[key] = true
+
+		// Only report the table when none of its keys exist
+		if parent := k[:len(k)-1]; len(parent) > 0 && unknown[parent.String()] {
+			continue
+		}
+
+		if suggestion := closestKey(key, known); suggestion != "" {
+			v.check(false, "unknown key %q in %s, did you mean %q?", key, filePath, suggestion)
+		} else {
+			v.check(false, "unknown key %q in %s", key, filePath)
+		}
+	}
+
+	return v.err()
+}
+
+// closestKey returns the known key within a few typos of key
+func closestKey(key string, known map[string]bool) string {
+	best, bestDistance := "", 3
+	for k := range known {
+		if d := editDistance(key, k); d < bestDistance || (d == bestDistance && k < best) {
+			best, bestDistance = k, d
+		}
+	}
+
+	return best
+}
+
+// cutLast removes the last part of a dotted key
+func cutLast(key string) (string, string) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return "", key
+	}
+
+	return key[:i], key[i+1:]
+}
+
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
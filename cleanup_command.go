@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+)
+
+type cleanupResult struct {
+	DBPath  string `json:"db_path"`
+	Cleaned bool   `json:"cleaned"`
+}
+
+func runCleanupCommand(args []string) error {
+	fs := newFlagSet("cleanup", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
+	if err != nil {
+		return err
+	}
+
+	if err := streamDB.RemoveCDC(true); err != nil {
+		return fmt.Errorf("removing triggers and change logs: %w", err)
+	}
+
+	log.Info().Msg("Cleanup complete...")
+	result := cleanupResult{DBPath: cfg.Config.DBPath, Cleaned: true}
+	return printOutput(*output, result, func() {
+		fmt.Printf("Cleaned: %s\n", result.DBPath)
+	})
+}
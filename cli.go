@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/health"
+	"github.com/wongfei2009/harmonylite/utils"
+	"github.com/wongfei2009/harmonylite/version"
+)
+
+// command is a harmonylite subcommand, run receives the arguments after the command name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []*command
+
+var versionFlag = flag.Bool("version", false, "Display version information")
+
+// globalFlags are accepted before the command name and by every command
+var globalFlags = []string{"config", "node-id", "cluster-addr", "cluster-peers", "leaf-servers"}
+
+func init() {
+	commands = []*command{
+		{name: "run", summary: "Run the replication node (default)", run: runCommand},
+		{name: "cleanup", summary: "Remove HarmonyLite triggers and change log tables", run: runCleanupCommand},
+		{name: "snapshot", summary: "Save, list, inspect, download, restore and delete snapshots", run: runSnapshotCommand},
+		{name: "restore", summary: "Restore the database to a point in time from archived WAL", run: runRestoreCommand},
+		{name: "schema", summary: "Show schema status and run coordinated migrations", run: runSchemaCommand},
+		{name: "stream", summary: "Inspect replication streams and the local watermark", run: runStreamCommand},
+		{name: "config", summary: "Show the effective configuration", run: runConfigCommand},
+		{name: "status", summary: "Show the health of a running node", run: runStatusCommand},
+		{name: "version", summary: "Display version information", run: runVersionCommand},
+	}
+}
+
+func main() {
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if *versionFlag {
+		fmt.Println(version.Get().String())
+		return
+	}
+
+	name, args := "run", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	} else {
+		name, args = legacyCommand(name, args)
+	}
+
+	// Coordinated migrations used to be a top-level command
+	if name == "migrate" {
+		name, args = "schema", append([]string{"migrate"}, args...)
+	}
+
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(args); err != nil {
+		log.Error().Err(err).Str("command", name).Msg("Command failed")
+		os.Exit(1)
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// legacyCommand maps the deprecated action flags to their command
+func legacyCommand(name string, args []string) (string, []string) {
+	legacy := ""
+	switch {
+	case *cfg.CleanupFlag:
+		legacy, name, args = "-cleanup", "cleanup", nil
+	case *cfg.SaveSnapshotFlag:
+		legacy, name, args = "-save-snapshot", "snapshot", []string{"save"}
+	case *cfg.SchemaStatusClusterFlag:
+		legacy, name, args = "-schema-status-cluster", "schema", []string{"status", "-cluster"}
+	case *cfg.SchemaStatusFlag:
+		legacy, name, args = "-schema-status", "schema", []string{"status"}
+	}
+
+	if legacy != "" {
+		fmt.Fprintf(os.Stderr, "%s is deprecated, use \"harmonylite %s\"\n", legacy, strings.Join(append([]string{name}, args...), " "))
+	}
+
+	return name, args
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: harmonylite [global options] <command> [options]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+
+	fmt.Fprintln(out, "\nGlobal options:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nRun \"harmonylite <command> -help\" for the options of a command.")
+}
+
+// newFlagSet creates the flag set of a command, usage describes its arguments. Global options
+// are accepted after the command name too.
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, g := range globalFlags {
+		f := flag.CommandLine.Lookup(g)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: harmonylite %s [options] %s\n\nOptions:\n", name, usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// outputFlag adds the -output option selecting the format of command results
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "text", "Output format: text or json")
+}
+
+// printOutput writes v as JSON, or calls text for the human readable output
+func printOutput(format string, v any, text func()) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "text":
+		text()
+		return nil
+	}
+
+	return fmt.Errorf("unknown output format %q, expected text or json", format)
+}
+
+// parseCommand parses the options of a command and loads the configuration. Logs go to
+// stderr so they don't mix with the command output.
+func parseCommand(fs *flag.FlagSet, args []string, output *string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if output != nil && *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, expected text or json", *output)
+	}
+
+	return loadConfig(os.Stderr)
+}
+
+// loadConfig loads the configuration file and sets up logging to out
+func loadConfig(out io.Writer) error {
+	err := errors.Join(cfg.Load(*cfg.ConfigPathFlag), checkConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		for _, e := range configErrors(err) {
+			fmt.Fprintf(os.Stderr, "  - %s\n", e)
+		}
+
+		return fmt.Errorf("invalid configuration")
+	}
+
+	setupLogging(out)
+
+	// Initialize default health check config if not set
+	if cfg.Config.HealthCheck == nil {
+		cfg.Config.HealthCheck = health.DefaultConfig()
+	}
+
+	return nil
+}
+
+// checkConfig validates settings parsed outside of cfg
+func checkConfig() error {
+	if expr := cfg.Config.Snapshot.Schedule.Cron; expr != "" {
+		if _, err := utils.ParseCron(expr); err != nil {
+			return fmt.Errorf("snapshot.schedule.cron: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// setupLogging configures the global logger to write to out
+func setupLogging(out io.Writer) {
+	conf := cfg.Current().Logging
+	var writer io.Writer = zerolog.ConsoleWriter{Out: out}
+	if conf.Format == "json" {
+		writer = out
+	}
+	gLog := zerolog.New(writer).
+		With().
+		Timestamp().
+		Uint64("node_id", cfg.Config.NodeID).
+		Logger()
+
+	if conf.Verbose {
+		log.Logger = gLog.Level(zerolog.DebugLevel)
+	} else {
+		log.Logger = gLog.Level(zerolog.InfoLevel)
+	}
+}
+
+func runVersionCommand(args []string) error {
+	fs := newFlagSet("version", "")
+	output := outputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	info := version.Get()
+	return printOutput(*output, info, func() {
+		fmt.Println(info.String())
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+const configUsage = `Usage: harmonylite config <command> [options]
+
+Commands:
+  show [options]       Print the effective configuration with secrets redacted, defaults, environment and flags included
+  validate [options]   Check the configuration file, environment overrides and flags`
+
+func runConfigCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return fmt.Errorf("config command required")
+	}
+
+	switch args[0] {
+	case "show":
+		return configShow(args[1:])
+	case "validate":
+		return configValidate(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, configUsage)
+	return fmt.Errorf("unknown config command %q", args[0])
+}
+
+func configShow(args []string) error {
+	fs := newFlagSet("config show", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	// Secrets stay out of terminals and log collectors
+	redacted := cfg.Config.Redacted()
+
+	var err error
+	pErr := printOutput(*output, configValues(reflect.ValueOf(redacted)), func() {
+		err = toml.NewEncoder(os.Stdout).Encode(redacted)
+	})
+	if err != nil {
+		return err
+	}
+
+	return pErr
+}
+
+type configValidation struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func configValidate(args []string) error {
+	fs := newFlagSet("config validate", "")
+	output := outputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	result := configValidation{Valid: true}
+	err := errors.Join(cfg.Load(*cfg.ConfigPathFlag), checkConfig())
+
+	if err != nil {
+		result.Valid = false
+		result.Errors = configErrors(err)
+	}
+
+	pErr := printOutput(*output, result, func() {
+		if result.Valid {
+			fmt.Println("Configuration is valid")
+			return
+		}
+
+		fmt.Println("Configuration is invalid:")
+		for _, e := range result.Errors {
+			fmt.Printf("  - %s\n", e)
+		}
+	})
+	if pErr != nil {
+		return pErr
+	}
+
+	if !result.Valid {
+		return fmt.Errorf("invalid configuration")
+	}
+
+	return nil
+}
+
+// configErrors splits joined configuration errors into one message per problem
+func configErrors(err error) []string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	messages := make([]string, 0)
+	for _, e := range joined.Unwrap() {
+		messages = append(messages, configErrors(e)...)
+	}
+
+	return messages
+}
+
+// configValues converts configuration structs to maps keyed like the configuration file
+func configValues(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValues(v.Elem())
+	case reflect.Struct:
+		values := make(map[string]any, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			key, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+			if !f.IsExported() || key == "-" {
+				continue
+			}
+			if key == "" {
+				key = f.Name
+			}
+			values[key] = configValues(v.Field(i))
+		}
+		return values
+	}
+
+	return v.Interface()
+}
@@ -12,7 +12,10 @@ import (
 	"time"
 
 	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/telemetry"
 	"github.com/wongfei2009/harmonylite/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	_ "embed"
 
@@ -64,9 +67,10 @@ type globalChangeLogEntry struct {
 }
 
 type changeLogEntry struct {
-	Id    int64  `db:"id"`
-	Type  string `db:"type"`
-	State string `db:"state"`
+	Id        int64  `db:"id"`
+	Type      string `db:"type"`
+	State     string `db:"state"`
+	CreatedAt int64  `db:"created_at"`
 }
 
 func init() {
@@ -79,8 +83,8 @@ func init() {
 	)
 }
 
-func (conn *SqliteStreamDB) Replicate(event *ChangeLogEvent) error {
-	if err := conn.consumeReplicationEvent(event); err != nil {
+func (conn *SqliteStreamDB) Replicate(ctx context.Context, event *ChangeLogEvent) error {
+	if err := conn.consumeReplicationEvent(ctx, event); err != nil {
 		return err
 	}
 	return nil
@@ -147,6 +151,10 @@ func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error)
 		return "", errors.New("table info not found")
 	}
 
+	return conn.tableCDCScript(tableName, columns)
+}
+
+func (conn *SqliteStreamDB) tableCDCScript(tableName string, columns []*ColumnInfo) (string, error) {
 	buf := new(bytes.Buffer)
 	err := tableChangeLogTpl.Execute(buf, &triggerTemplateData{
 		Prefix:    conn.prefix,
@@ -162,13 +170,27 @@ func (conn *SqliteStreamDB) tableCDCScriptFor(tableName string) (string, error)
 	return spaceStripper.ReplaceAllString(buf.String(), "\n    "), nil
 }
 
-func (conn *SqliteStreamDB) consumeReplicationEvent(event *ChangeLogEvent) error {
+func (conn *SqliteStreamDB) consumeReplicationEvent(ctx context.Context, event *ChangeLogEvent) (err error) {
+	_, span := telemetry.StartSpan(ctx, "changelog.apply", trace.WithAttributes(
+		attribute.String("harmonylite.table", event.TableName),
+		attribute.String("harmonylite.change.type", event.Type),
+		attribute.Int64("harmonylite.change.id", event.Id),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
 		return err
 	}
 	defer sqlConn.Return()
 
+	// Only applied changes are counted, so tables are limited to the watched ones
+	defer func() {
+		if err == nil {
+			conn.stats.appliedChanges.WithLabelValues(event.TableName, event.Type).Inc()
+		}
+	}()
+
 	return sqlConn.DB().WithTx(func(tnx *goqu.TxDatabase) error {
 		primaryKeyMap := conn.getPrimaryKeyMap(event)
 		if primaryKeyMap == nil {
@@ -373,6 +395,11 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 	}
 	defer conn.publishLock.Unlock()
 
+	conn.publishChangeLogLocked()
+}
+
+// publishChangeLogLocked publishes pending changes, the caller holds publishLock
+func (conn *SqliteStreamDB) publishChangeLogLocked() {
 	cnt, err := conn.countChanges()
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to count global changes")
@@ -395,7 +422,11 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 		return
 	}
 
-	for _, change := range changes {
+	ctx, span := telemetry.StartSpan(context.Background(), "changelog.publish",
+		trace.WithAttributes(attribute.Int("harmonylite.changes", len(changes))))
+	defer span.End()
+
+	for i, change := range changes {
 		logEntry := changeLogEntry{}
 		found := false
 		found, err = conn.getChangeEntry(&logEntry, change)
@@ -413,13 +444,21 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 			return
 		}
 
-		err = conn.consumeChangeLogs(change.TableName, []*changeLogEntry{&logEntry})
+		// Time the oldest change waited in the change log before publishing
+		if i == 0 {
+			span.SetAttributes(attribute.Int64("harmonylite.change_log.wait_ms", time.Now().UnixMilli()-logEntry.CreatedAt))
+		}
+
+		err = conn.consumeChangeLogs(ctx, change.TableName, []*changeLogEntry{&logEntry})
 		if err != nil {
 			if errors.Is(err, ErrLogNotReadyToPublish) || errors.Is(err, context.Canceled) {
 				break
 			}
 
+			span.RecordError(err)
 			log.Error().Err(err).Msg("Unable to consume changes")
+		} else {
+			conn.stats.publishedChanges.WithLabelValues(change.TableName, logEntry.Type).Inc()
 		}
 
 		err = conn.markChangePublished(change)
@@ -431,6 +470,11 @@ func (conn *SqliteStreamDB) publishChangeLog() {
 	}
 }
 
+// PublishPendingChanges publishes any change logs still pending, e.g. after publishing was paused
+func (conn *SqliteStreamDB) PublishPendingChanges() {
+	conn.publishChangeLog()
+}
+
 func (conn *SqliteStreamDB) markChangePublished(change globalChangeLogEntry) error {
 	sqlConn, err := conn.pool.Borrow()
 	if err != nil {
@@ -471,7 +515,7 @@ func (conn *SqliteStreamDB) getChangeEntry(entry *changeLogEntry, change globalC
 	}
 	defer sqlConn.Return()
 
-	return sqlConn.DB().Select("id", "type", "state").
+	return sqlConn.DB().Select("id", "type", "state", "created_at").
 		From(conn.metaTable(change.TableName, changeLogName)).
 		Where(
 			goqu.C("state").Eq(Pending),
@@ -481,7 +525,7 @@ func (conn *SqliteStreamDB) getChangeEntry(entry *changeLogEntry, change globalC
 		ScanStruct(entry)
 }
 
-func (conn *SqliteStreamDB) consumeChangeLogs(tableName string, changes []*changeLogEntry) error {
+func (conn *SqliteStreamDB) consumeChangeLogs(ctx context.Context, tableName string, changes []*changeLogEntry) error {
 	rowIds := lo.Map(changes, func(e *changeLogEntry, i int) int64 {
 		return e.Id
 	})
@@ -519,12 +563,13 @@ func (conn *SqliteStreamDB) consumeChangeLogs(tableName string, changes []*chang
 			Logger()
 
 		if conn.OnChange != nil {
-			err = conn.OnChange(&ChangeLogEvent{
+			err = conn.OnChange(ctx, &ChangeLogEvent{
 				Id:         changeRowID,
 				Type:       changeRow.Type,
 				TableName:  tableName,
 				Row:        row,
 				SchemaHash: conn.GetSchemaHash(),
+				CreatedAt:  changeRow.CreatedAt,
 				tableInfo:  conn.watchTablesSchema[tableName],
 			})
 
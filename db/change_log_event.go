@@ -25,6 +25,7 @@ type ChangeLogEvent struct {
 	TableName  string
 	Row        map[string]any
 	SchemaHash string        `cbor:"sh,omitempty"` // Hash of all watched tables at creation
+	CreatedAt  int64         `cbor:"ca,omitempty"` // Unix milliseconds the change was logged
 	tableInfo  []*ColumnInfo `cbor:"-"`
 }
 
@@ -56,6 +57,7 @@ func (e ChangeLogEvent) Unwrap() (ChangeLogEvent, error) {
 		TableName: e.TableName,
 		Type:      e.Type,
 		Row:       map[string]any{},
+		CreatedAt: e.CreatedAt,
 		tableInfo: e.tableInfo,
 	}
 
@@ -145,6 +147,7 @@ func (e ChangeLogEvent) prepare() ChangeLogEvent {
 		Type:      e.Type,
 		TableName: e.TableName,
 		Row:       preparedRow,
+		CreatedAt: e.CreatedAt,
 		tableInfo: e.tableInfo,
 	}
 }
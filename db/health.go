@@ -92,6 +92,21 @@ func (conn *SqliteStreamDB) GetTrackedTablesCount() int {
 	return len(conn.watchTablesSchema)
 }
 
+// GetPendingChangesCount returns the number of change log rows waiting to be published, -1 on failure
+func (conn *SqliteStreamDB) GetPendingChangesCount() int64 {
+	if conn.pool == nil {
+		return -1
+	}
+
+	cnt, err := conn.countChanges()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to count pending changes")
+		return -1
+	}
+
+	return cnt
+}
+
 // DB returns the underlying database for health check purposes
 func (conn *SqliteStreamDB) DB() interface{} {
 	return conn.pool
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const migratingChangeLogSuffix = "__migrating"
+
+// ApplyMigration executes the given DDL statements and refreshes CDC state in a single transaction.
+// Change log tables of altered tables are rebuilt (keeping pending rows), new tables start being
+// watched and dropped tables stop being watched. Returns the recomputed schema hash.
+func (conn *SqliteStreamDB) ApplyMigration(ddl string) (string, error) {
+	if conn.schemaCache == nil || !conn.schemaCache.IsInitialized() {
+		return "", fmt.Errorf("schema cache not initialized")
+	}
+
+	// Hold publishing while triggers and change logs are being swapped
+	conn.publishLock.Lock()
+	defer conn.publishLock.Unlock()
+
+	return conn.rewatchTablesLocked(ddl)
+}
+
+// RefreshWatchedTables applies a changed include_tables setting. Pending changes are published
+// first, then change logs of tables no longer included are removed and newly included tables
+// start being watched. Returns the recomputed schema hash.
+func (conn *SqliteStreamDB) RefreshWatchedTables() (string, error) {
+	if conn.schemaCache == nil || !conn.schemaCache.IsInitialized() {
+		return "", fmt.Errorf("schema cache not initialized")
+	}
+
+	conn.publishLock.Lock()
+	defer conn.publishLock.Unlock()
+
+	conn.publishChangeLogLocked()
+	return conn.rewatchTablesLocked("")
+}
+
+// rewatchTablesLocked executes ddl, when given, and rebuilds triggers and change logs for the
+// tables to watch in a single transaction. The caller holds publishLock.
+func (conn *SqliteStreamDB) rewatchTablesLocked(ddl string) (string, error) {
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return "", err
+	}
+	defer sqlConn.Return()
+
+	oldSchema := conn.watchTablesSchema
+	newSchema := map[string][]*ColumnInfo{}
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		// Triggers reference table columns, drop them so DDL can rebuild tables freely
+		if err := conn.dropTriggersTx(tx); err != nil {
+			return err
+		}
+
+		if ddl != "" {
+			if _, err := tx.Exec(ddl); err != nil {
+				return fmt.Errorf("executing migration: %w", err)
+			}
+		}
+
+		tables := make([]string, 0)
+		if err := listDBTables(&tables, tx); err != nil {
+			return err
+		}
+
+		for _, name := range tables {
+			colInfo, err := getTableInfo(tx, name)
+			if err != nil {
+				return err
+			}
+
+			newSchema[name] = colInfo
+		}
+
+		changed := make([]string, 0)
+		for name, oldCols := range oldSchema {
+			newCols, ok := newSchema[name]
+			if !ok {
+				log.Info().Str("table", name).Msg("Table no longer watched, removing change log")
+				if _, err := tx.Exec(fmt.Sprintf(deleteHarmonyLiteTables, conn.metaTable(name, changeLogName))); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !sameColumns(oldCols, newCols) {
+				changed = append(changed, name)
+				if err := conn.detachChangeLogTx(tx, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		conn.watchTablesSchema = newSchema
+		for name := range newSchema {
+			script, err := conn.tableCDCScriptFor(name)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(script); err != nil {
+				return fmt.Errorf("installing CDC for %s: %w", name, err)
+			}
+		}
+
+		for _, name := range changed {
+			if err := conn.reattachChangeLogTx(tx, name, oldSchema[name]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		conn.watchTablesSchema = oldSchema
+		return "", err
+	}
+
+	tables := make([]string, 0, len(newSchema))
+	for name := range newSchema {
+		tables = append(tables, name)
+	}
+	conn.schemaCache.SetTables(tables)
+
+	if err := conn.UpdateSchemaState(); err != nil {
+		return "", err
+	}
+
+	return conn.GetSchemaHash(), nil
+}
+
+// dropTriggersTx removes all HarmonyLite triggers within transaction
+func (conn *SqliteStreamDB) dropTriggersTx(tx *goqu.TxDatabase) error {
+	triggers := make([]string, 0)
+	err := tx.
+		Select("name").
+		From("sqlite_master").
+		Where(goqu.C("type").Eq("trigger"), goqu.C("name").Like(conn.prefix+"%")).
+		Prepared(true).
+		ScanVals(&triggers)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range triggers {
+		if _, err := tx.Exec(fmt.Sprintf(deleteTriggerQuery, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detachChangeLogTx moves the change log of tableName aside so it can be recreated with new columns
+func (conn *SqliteStreamDB) detachChangeLogTx(tx *goqu.TxDatabase, tableName string) error {
+	changeLog := conn.metaTable(tableName, changeLogName)
+	queries := []string{
+		fmt.Sprintf("DROP INDEX IF EXISTS %s_state_index", changeLog),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s%s", changeLog, changeLog, migratingChangeLogSuffix),
+	}
+
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return fmt.Errorf("detaching change log of %s: %w", tableName, err)
+		}
+	}
+
+	return nil
+}
+
+// reattachChangeLogTx copies rows of the detached change log into the recreated one, keeping ids
+// so that global change log entries stay valid. Only columns present in both schemas are copied.
+func (conn *SqliteStreamDB) reattachChangeLogTx(tx *goqu.TxDatabase, tableName string, oldCols []*ColumnInfo) error {
+	changeLog := conn.metaTable(tableName, changeLogName)
+	newCols := map[string]bool{}
+	for _, c := range conn.watchTablesSchema[tableName] {
+		newCols[c.Name] = true
+	}
+
+	columns := "id, type, created_at, state"
+	for _, c := range oldCols {
+		if newCols[c.Name] {
+			columns += ", val_" + c.Name
+		}
+	}
+
+	queries := []string{
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s", changeLog, columns, columns, changeLog, migratingChangeLogSuffix),
+		fmt.Sprintf("DROP TABLE %s%s", changeLog, migratingChangeLogSuffix),
+	}
+
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return fmt.Errorf("rebuilding change log of %s: %w", tableName, err)
+		}
+	}
+
+	return nil
+}
+
+func sameColumns(a, b []*ColumnInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type || a[i].IsPrimaryKey != b[i].IsPrimaryKey {
+			return false
+		}
+	}
+
+	return true
+}
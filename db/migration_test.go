@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func TestSqliteStreamDB_ApplyMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "migration.db")
+	raw, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)`)
+	require.NoError(t, err)
+
+	streamDB, err := OpenStreamDB(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, streamDB.InstallCDC([]string{"users"}))
+
+	// Pending change captured before the migration
+	_, err = raw.Exec(`INSERT INTO users (id, name) VALUES (1, 'alice')`)
+	require.NoError(t, err)
+
+	oldHash := streamDB.GetSchemaHash()
+	newHash, err := streamDB.ApplyMigration(`
+		ALTER TABLE users ADD COLUMN email TEXT;
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER);
+	`)
+	require.NoError(t, err)
+	assert.NotEqual(t, oldHash, newHash)
+	assert.Equal(t, oldHash, streamDB.GetPreviousHash())
+	assert.Equal(t, 2, streamDB.GetTrackedTablesCount())
+
+	// Existing change log rows survive the rebuild
+	var count int
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM __harmonylite__users_change_log WHERE val_id = 1`).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	// New column is captured by the recreated triggers
+	_, err = raw.Exec(`INSERT INTO users (id, name, email) VALUES (2, 'bob', 'bob@example.com')`)
+	require.NoError(t, err)
+	var email string
+	require.NoError(t, raw.QueryRow(`SELECT val_email FROM __harmonylite__users_change_log WHERE val_id = 2`).Scan(&email))
+	assert.Equal(t, "bob@example.com", email)
+
+	// New tables are watched
+	_, err = raw.Exec(`INSERT INTO orders (id, user_id) VALUES (1, 2)`)
+	require.NoError(t, err)
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM __harmonylite__orders_change_log`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestSqliteStreamDB_ApplyMigrationFailureKeepsCDC(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "migration-fail.db")
+	raw, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)`)
+	require.NoError(t, err)
+
+	streamDB, err := OpenStreamDB(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, streamDB.InstallCDC([]string{"users"}))
+
+	oldHash := streamDB.GetSchemaHash()
+	_, err = streamDB.ApplyMigration(`ALTER TABLE missing ADD COLUMN email TEXT`)
+	assert.Error(t, err)
+	assert.Equal(t, oldHash, streamDB.GetSchemaHash())
+
+	// Triggers are still in place after the rollback
+	_, err = raw.Exec(`INSERT INTO users (id, name) VALUES (1, 'alice')`)
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM __harmonylite__users_change_log`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestSqliteStreamDB_RefreshWatchedTables(t *testing.T) {
+	original := cfg.Config.IncludeTables
+	defer func() {
+		cfg.Config.IncludeTables = original
+	}()
+
+	dbPath := filepath.Join(t.TempDir(), "include.db")
+	raw, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);
+		CREATE TABLE orders (id INTEGER PRIMARY KEY, user_id INTEGER);
+	`)
+	require.NoError(t, err)
+
+	cfg.Config.IncludeTables = []string{"users"}
+	tables, err := GetAllDBTables(dbPath)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users"}, tables)
+
+	streamDB, err := OpenStreamDB(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, streamDB.InstallCDC(tables))
+	published := make([]string, 0)
+	streamDB.OnChange = func(_ context.Context, event *ChangeLogEvent) error {
+		published = append(published, event.TableName)
+		return nil
+	}
+
+	// Pending change of a table that stops being watched
+	_, err = raw.Exec(`INSERT INTO users (id, name) VALUES (1, 'alice')`)
+	require.NoError(t, err)
+
+	oldHash := streamDB.GetSchemaHash()
+	cfg.Config.IncludeTables = []string{"orders"}
+	newHash, err := streamDB.RefreshWatchedTables()
+	require.NoError(t, err)
+	assert.NotEqual(t, oldHash, newHash)
+	assert.Equal(t, []string{"users"}, published)
+	assert.Equal(t, []string{"orders"}, streamDB.GetSchemaTables())
+
+	var count int
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM sqlite_schema WHERE name = '__harmonylite__users_change_log'`).Scan(&count))
+	assert.Zero(t, count)
+
+	_, err = raw.Exec(`INSERT INTO users (id, name) VALUES (2, 'bob')`)
+	require.NoError(t, err)
+	_, err = raw.Exec(`INSERT INTO orders (id, user_id) VALUES (1, 2)`)
+	require.NoError(t, err)
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM __harmonylite__orders_change_log`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/wongfei2009/harmonylite/pool"
+)
+
+var ErrPageSizeMismatch = errors.New("snapshot page size differs from the database")
+
+// RestoreOnlineFrom copies the database at bkFilePath into the database at destPath with the
+// SQLite backup API, instead of replacing its files like RestoreFrom. All pages are copied in
+// a single step under the write lock of the destination, connections to it keep reading the
+// old content until the copy commits and read the restored content right after.
+// Pages of a WAL database can't change size, both databases must use the same page size,
+// callers that can replace the files of the database use RestoreFrom on ErrPageSizeMismatch.
+func RestoreOnlineFrom(destPath, bkFilePath string) error {
+	destDB, dest, err := pool.OpenRaw(fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=30000", destPath))
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	srcDB, src, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro", bkFilePath))
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	srcSize, err := pageSize(srcDB)
+	if err != nil {
+		return err
+	}
+
+	destSize, err := pageSize(destDB)
+	if err != nil {
+		return err
+	}
+
+	if srcSize != destSize {
+		return fmt.Errorf("%w: snapshot uses %d bytes, database uses %d bytes", ErrPageSizeMismatch, srcSize, destSize)
+	}
+
+	bk, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+
+	_, err = bk.Step(-1)
+	if fErr := bk.Finish(); err == nil {
+		err = fErr
+	}
+
+	return err
+}
+
+func pageSize(conn *sql.DB) (int, error) {
+	size := 0
+	err := conn.QueryRow("PRAGMA page_size;").Scan(&size)
+	return size, err
+}
+
+// RestoreOnline replaces the content of the live database with the snapshot at bkFilePath
+// while applications keep using it. Publishing is held until the restore completes, pending
+// changes are published once it is held. When CDC is installed, change logs and triggers for
+// the snapshot tables are added to the snapshot before it's copied, so changes are captured
+// from the moment the restored content becomes visible.
+func (conn *SqliteStreamDB) RestoreOnline(bkFilePath string) error {
+	conn.publishLock.Lock()
+	defer conn.publishLock.Unlock()
+
+	cdcInstalled := conn.schemaCache != nil && conn.schemaCache.IsInitialized()
+	if cdcInstalled {
+		conn.publishChangeLogLocked()
+	}
+
+	if !cdcInstalled {
+		return RestoreOnlineFrom(conn.dbPath, bkFilePath)
+	}
+
+	schema, err := conn.installCDCInto(bkFilePath)
+	if err != nil {
+		return fmt.Errorf("installing CDC into snapshot: %w", err)
+	}
+
+	err = RestoreOnlineFrom(conn.dbPath, bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	conn.watchTablesSchema = schema
+	tables := make([]string, 0, len(schema))
+	for name := range schema {
+		tables = append(tables, name)
+	}
+	conn.schemaCache.SetTables(tables)
+
+	return conn.UpdateSchemaState()
+}
+
+// installCDCInto creates HarmonyLite tables and triggers for every table of the database
+// at p, returning the schema of the watched tables
+func (conn *SqliteStreamDB) installCDCInto(p string) (map[string][]*ColumnInfo, error) {
+	sqlDB, rawDB, err := pool.OpenRaw(fmt.Sprintf("%s?_foreign_keys=false", p))
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+	defer rawDB.Close()
+
+	schema := map[string][]*ColumnInfo{}
+	gSQL := goqu.New("sqlite", sqlDB)
+	err = gSQL.WithTx(func(tx *goqu.TxDatabase) error {
+		tables := make([]string, 0)
+		if err := listDBTables(&tables, tx); err != nil {
+			return err
+		}
+
+		for _, name := range tables {
+			colInfo, err := getTableInfo(tx, name)
+			if err != nil {
+				return err
+			}
+
+			schema[name] = colInfo
+		}
+
+		if _, err := tx.Exec(createSchemaVersionTable); err != nil {
+			return fmt.Errorf("creating schema version table: %w", err)
+		}
+
+		script, err := conn.globalCDCScript()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(script); err != nil {
+			return err
+		}
+
+		for name, columns := range schema {
+			script, err := conn.tableCDCScript(name, columns)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(script); err != nil {
+				return fmt.Errorf("installing CDC for %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
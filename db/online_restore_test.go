@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openRestoreTestDB(t *testing.T, name string, rows int, pageSize int) (string, *sql.DB) {
+	p := filepath.Join(t.TempDir(), name)
+	raw, err := sql.Open("sqlite3", p+"?_journal_mode=WAL&_busy_timeout=5000")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		raw.Close()
+	})
+
+	// Page size has to be set before WAL mode fixes it
+	_, err = raw.Exec(fmt.Sprintf("PRAGMA journal_mode=DELETE; PRAGMA page_size=%d; VACUUM; PRAGMA journal_mode=WAL;", pageSize))
+	require.NoError(t, err)
+	_, err = raw.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+
+	for i := 0; i < rows; i++ {
+		_, err = raw.Exec("INSERT INTO users (name) VALUES (?)", fmt.Sprintf("user-%d", i))
+		require.NoError(t, err)
+	}
+
+	return p, raw
+}
+
+func countUsers(t *testing.T, raw *sql.DB) int {
+	count := 0
+	require.NoError(t, raw.QueryRow("SELECT count(*) FROM users").Scan(&count))
+	return count
+}
+
+func TestRestoreOnlineFrom(t *testing.T) {
+	t.Run("connected readers see restored content", func(t *testing.T) {
+		livePath, live := openRestoreTestDB(t, "live.db", 10, 4096)
+		snapshotPath, _ := openRestoreTestDB(t, "snapshot.db", 3, 4096)
+		assert.Equal(t, 10, countUsers(t, live))
+
+		require.NoError(t, RestoreOnlineFrom(livePath, snapshotPath))
+		assert.Equal(t, 3, countUsers(t, live))
+		require.NoError(t, IntegrityCheck(livePath))
+
+		mode := ""
+		require.NoError(t, live.QueryRow("PRAGMA journal_mode;").Scan(&mode))
+		assert.Equal(t, "wal", mode)
+	})
+
+	t.Run("page size mismatch", func(t *testing.T) {
+		livePath, live := openRestoreTestDB(t, "live.db", 10, 4096)
+		snapshotPath, _ := openRestoreTestDB(t, "snapshot.db", 3, 8192)
+
+		assert.ErrorIs(t, RestoreOnlineFrom(livePath, snapshotPath), ErrPageSizeMismatch)
+		assert.Equal(t, 10, countUsers(t, live))
+	})
+
+	t.Run("page size mismatch without tables", func(t *testing.T) {
+		livePath := filepath.Join(t.TempDir(), "live.db")
+		live, err := sql.Open("sqlite3", livePath+"?_journal_mode=WAL&_busy_timeout=5000")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			live.Close()
+		})
+		_, err = live.Exec("PRAGMA user_version = 1")
+		require.NoError(t, err)
+
+		// Replacing the files is left to callers
+		snapshotPath, snapshot := openRestoreTestDB(t, "snapshot.db", 3, 8192)
+		require.NoError(t, snapshot.Close())
+		assert.ErrorIs(t, RestoreOnlineFrom(livePath, snapshotPath), ErrPageSizeMismatch)
+	})
+}
+
+func TestSqliteStreamDB_RestoreOnline(t *testing.T) {
+	livePath, live := openRestoreTestDB(t, "live.db", 1, 4096)
+	streamDB, err := OpenStreamDB(livePath)
+	require.NoError(t, err)
+	require.NoError(t, streamDB.InstallCDC([]string{"users"}))
+
+	published := make([]string, 0)
+	streamDB.OnChange = func(_ context.Context, event *ChangeLogEvent) error {
+		published = append(published, fmt.Sprint(event.Row["name"]))
+		return nil
+	}
+
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.db")
+	require.NoError(t, streamDB.BackupTo(snapshotPath))
+
+	_, err = live.Exec("ALTER TABLE users ADD COLUMN email TEXT")
+	require.NoError(t, err)
+	_, err = live.Exec("INSERT INTO users (name) VALUES ('after-snapshot')")
+	require.NoError(t, err)
+
+	require.NoError(t, streamDB.RestoreOnline(snapshotPath))
+	assert.Equal(t, 1, countUsers(t, live))
+
+	// Changes pending before the restore are published rather than overwritten
+	assert.Equal(t, []string{"after-snapshot"}, published)
+	assert.Equal(t, 1, streamDB.GetTrackedTablesCount())
+
+	// Writes right after the restore are captured
+	_, err = live.Exec("INSERT INTO users (name) VALUES ('after-restore')")
+	require.NoError(t, err)
+	count := 0
+	require.NoError(t, live.QueryRow("SELECT count(*) FROM __harmonylite__users_change_log WHERE val_name = 'after-restore'").Scan(&count))
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrTableNotWatched = errors.New("table is not watched")
+
+// ResyncTable queues every row of a watched table as an insert to publish, peers replace their
+// copy of each row with the local one. Rows that only exist on peers are left untouched.
+// Returns the number of rows queued.
+func (conn *SqliteStreamDB) ResyncTable(tableName string) (int64, error) {
+	columns, ok := conn.watchTablesSchema[tableName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrTableNotWatched, tableName)
+	}
+
+	valCols := make([]string, 0, len(columns))
+	srcCols := make([]string, 0, len(columns))
+	for _, col := range columns {
+		valCols = append(valCols, quoteIdent("val_"+col.Name))
+		srcCols = append(srcCols, quoteIdent(col.Name))
+	}
+
+	changeLogTable := quoteIdent(conn.metaTable(tableName, changeLogName))
+	insertQuery := fmt.Sprintf(
+		`INSERT INTO %s (%s, type, created_at, state) SELECT %s, 'insert', ?, ? FROM %s`,
+		changeLogTable,
+		strings.Join(valCols, ", "),
+		strings.Join(srcCols, ", "),
+		quoteIdent(tableName),
+	)
+	globalQuery := fmt.Sprintf(
+		`INSERT INTO %s (change_table_id, table_name) SELECT id, ? FROM %s WHERE id > ? ORDER BY id`,
+		quoteIdent(conn.globalMetaTable()),
+		changeLogTable,
+	)
+
+	sqlConn, err := conn.pool.Borrow()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlConn.Return()
+
+	count := int64(0)
+	err = sqlConn.DB().WithTx(func(tx *goqu.TxDatabase) error {
+		lastID := int64(0)
+		err := tx.QueryRow(fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM %s`, changeLogTable)).Scan(&lastID)
+		if err != nil {
+			return err
+		}
+
+		rs, err := tx.Exec(insertQuery, time.Now().UnixMilli(), Pending)
+		if err != nil {
+			return err
+		}
+
+		count, err = rs.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(globalQuery, tableName, lastID)
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	log.Info().Str("table", tableName).Int64("rows", count).Msg("Queued table rows for resync")
+	go conn.PublishPendingChanges()
+	return count, nil
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteStreamDB_ResyncTable(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "resync.db")
+	raw, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO users (name) VALUES ('alice'), ('bob')`)
+	require.NoError(t, err)
+
+	streamDB, err := OpenStreamDB(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, streamDB.InstallCDC([]string{"users"}))
+
+	count, err := streamDB.ResyncTable("users")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	var queued int
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM __harmonylite__users_change_log WHERE type = 'insert' AND val_name IN ('alice', 'bob')`).Scan(&queued))
+	assert.Equal(t, 2, queued)
+
+	_, err = streamDB.ResyncTable("orders")
+	assert.ErrorIs(t, err, ErrTableNotWatched)
+}
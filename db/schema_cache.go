@@ -70,6 +70,21 @@ func (sc *SchemaCache) Recompute(ctx context.Context) (string, error) {
 	return hash, nil
 }
 
+// SetTables replaces the set of tables included in the schema hash
+// The new set takes effect on the next Recompute
+func (sc *SchemaCache) SetTables(tables []string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.tables = tables
+}
+
+// GetTables returns the tables included in the schema hash
+func (sc *SchemaCache) GetTables() []string {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return append([]string(nil), sc.tables...)
+}
+
 // IsInitialized returns true if the cache has been initialized
 func (sc *SchemaCache) IsInitialized() bool {
 	sc.mu.RLock()
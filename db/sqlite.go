@@ -7,19 +7,30 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/fsnotify/fsnotify"
 	"github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
 	"github.com/wongfei2009/harmonylite/pool"
 	"github.com/wongfei2009/harmonylite/telemetry"
 )
 
 const snapshotTransactionMode = "exclusive"
 
+const createSchemaVersionTable = `
+	CREATE TABLE IF NOT EXISTS __harmonylite__schema_version (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		schema_hash TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		harmonylite_version TEXT
+	);`
+
 var PoolSize = 4
 var HarmonyLitePrefix = "__harmonylite__"
 
@@ -28,10 +39,14 @@ type statsSqliteStreamDB struct {
 	pendingPublish telemetry.Gauge
 	countChanges   telemetry.Histogram
 	scanChanges    telemetry.Histogram
+
+	// Partitioned by watched table and operation (insert, update or delete)
+	publishedChanges telemetry.CounterVec
+	appliedChanges   telemetry.CounterVec
 }
 
 type SqliteStreamDB struct {
-	OnChange      func(event *ChangeLogEvent) error
+	OnChange      func(ctx context.Context, event *ChangeLogEvent) error
 	pool          *pool.SQLitePool
 	rawConnection *sqlite3.SQLiteConn
 	publishLock   *sync.Mutex
@@ -107,6 +122,45 @@ func RestoreFrom(destPath, bkFilePath string) error {
 	return nil
 }
 
+// IntegrityCheck runs PRAGMA integrity_check on the database at path
+func IntegrityCheck(path string) error {
+	conn, rawConn, err := pool.OpenRaw(fmt.Sprintf("%s?mode=ro", path))
+	if err != nil {
+		return err
+	}
+	defer rawConn.Close()
+	defer conn.Close()
+
+	rows, err := conn.Query("PRAGMA integrity_check;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	problems := make([]string, 0)
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// GetAllDBTables lists the tables of the database at path to watch
 func GetAllDBTables(path string) ([]string, error) {
 	connectionStr := fmt.Sprintf("%s?_journal_mode=WAL", path)
 	conn, rawConn, err := pool.OpenRaw(connectionStr)
@@ -157,6 +211,10 @@ func OpenStreamDB(path string) (*SqliteStreamDB, error) {
 			pendingPublish: telemetry.NewGauge("pending_publish", "rows pending publishing"),
 			countChanges:   telemetry.NewHistogram("count_changes", "latency counting changes in microseconds"),
 			scanChanges:    telemetry.NewHistogram("scan_changes", "latency scanning change rows in DB"),
+			publishedChanges: telemetry.NewCounterVec("published_changes_total", "Changes published by this node",
+				[]string{"table", "operation"}),
+			appliedChanges: telemetry.NewCounterVec("applied_changes_total", "Replicated changes applied by this node",
+				[]string{"table", "operation"}),
 		},
 	}
 
@@ -181,13 +239,6 @@ func (conn *SqliteStreamDB) InstallCDC(tables []string) error {
 		}
 
 		// Create schema version table
-		createSchemaVersionTable := `
-			CREATE TABLE IF NOT EXISTS __harmonylite__schema_version (
-				id INTEGER PRIMARY KEY CHECK (id = 1),
-				schema_hash TEXT NOT NULL,
-				updated_at INTEGER NOT NULL,
-				harmonylite_version TEXT
-			);`
 		_, err := tx.Exec(createSchemaVersionTable)
 		if err != nil {
 			return fmt.Errorf("creating schema version table: %w", err)
@@ -394,6 +445,14 @@ func (conn *SqliteStreamDB) GetPreviousHash() string {
 	return conn.schemaCache.GetPreviousHash()
 }
 
+// GetSchemaTables returns the tables included in the schema hash
+func (conn *SqliteStreamDB) GetSchemaTables() []string {
+	if conn.schemaCache == nil {
+		return nil
+	}
+	return conn.schemaCache.GetTables()
+}
+
 // GetSchemaCache returns the schema cache for direct access
 func (conn *SqliteStreamDB) GetSchemaCache() *SchemaCache {
 	return conn.schemaCache
@@ -486,12 +545,18 @@ func copyFile(toPath, fromPath string) error {
 	return err
 }
 
+// listDBTables lists the tables to watch, limited to include_tables when set
 func listDBTables(names *[]string, gSQL *goqu.TxDatabase) error {
-	err := gSQL.Select("name").From("sqlite_schema").Where(
+	conditions := []exp.Expression{
 		goqu.C("type").Eq("table"),
 		goqu.C("name").NotLike("sqlite_%"),
-		goqu.C("name").NotLike(HarmonyLitePrefix+"%"),
-	).ScanVals(names)
+		goqu.C("name").NotLike(HarmonyLitePrefix + "%"),
+	}
+	if include := cfg.Current().IncludeTables; len(include) > 0 {
+		conditions = append(conditions, goqu.C("name").In(include))
+	}
+
+	err := gSQL.Select("name").From("sqlite_schema").Where(conditions...).ScanVals(names)
 
 	if err != nil {
 		return err
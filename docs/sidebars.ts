@@ -25,7 +25,7 @@ const sidebars: SidebarsConfig = {
     {
       type: 'category',
       label: 'Operations',
-      items: ['troubleshooting', 'health-check', 'faq'],
+      items: ['troubleshooting', 'health-check', 'admin-api', 'faq'],
     },
     {
       type: 'category',
@@ -4,17 +4,19 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"net/http/pprof"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/wongfei2009/harmonylite/telemetry"
 	"github.com/wongfei2009/harmonylite/utils"
 	"github.com/wongfei2009/harmonylite/version"
 
+	"github.com/wongfei2009/harmonylite/admin"
 	"github.com/wongfei2009/harmonylite/cfg"
 	"github.com/wongfei2009/harmonylite/db"
 	"github.com/wongfei2009/harmonylite/health"
@@ -22,37 +24,23 @@ import (
 	"github.com/wongfei2009/harmonylite/snapshot"
 
 	"github.com/asaskevich/EventBus"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func main() {
-	versionFlag := flag.Bool("version", false, "Display version information")
-	flag.Parse()
-
-	if *versionFlag {
-		fmt.Println(version.Get().String())
-		return
-	}
-	err := cfg.Load(*cfg.ConfigPathFlag)
-	if err != nil {
-		panic(err)
+func runCommand(args []string) error {
+	fs := newFlagSet("run", "")
+	fs.Var(flag.Lookup("pprof").Value, "pprof", flag.Lookup("pprof").Usage)
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
-	var writer io.Writer = zerolog.NewConsoleWriter()
-	if cfg.Config.Logging.Format == "json" {
-		writer = os.Stdout
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
 	}
-	gLog := zerolog.New(writer).
-		With().
-		Timestamp().
-		Uint64("node_id", cfg.Config.NodeID).
-		Logger()
-
-	if cfg.Config.Logging.Verbose {
-		log.Logger = gLog.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = gLog.Level(zerolog.InfoLevel)
+
+	if err := loadConfig(os.Stdout); err != nil {
+		return err
 	}
 
 	if *cfg.ProfServer != "" {
@@ -73,55 +61,26 @@ func main() {
 
 	log.Debug().Msg("Initializing telemetry")
 	telemetry.InitializeTelemetry()
-
-	// Initialize default health check config if not set
-	if cfg.Config.HealthCheck == nil {
-		cfg.Config.HealthCheck = health.DefaultConfig()
+	if err := telemetry.InitializeTracing(); err != nil {
+		return err
 	}
+	defer shutdownTracing()
 
 	log.Debug().Str("path", cfg.Config.DBPath).Msg("Checking if database file exists")
+	bootstrap := false
 	if _, err := os.Stat(cfg.Config.DBPath); os.IsNotExist(err) {
-		log.Error().Str("path", cfg.Config.DBPath).Msg("Database file does not exist. HarmonyLite is meant to replicate an existing database.")
-		return
+		if !canRestoreSnapshot() {
+			return fmt.Errorf("database file %s does not exist, HarmonyLite is meant to replicate an existing database, enable snapshots (or peer snapshots) and replication to bootstrap it from the latest snapshot", cfg.Config.DBPath)
+		}
+
+		log.Info().Str("path", cfg.Config.DBPath).Msg("Database file does not exist, bootstrapping from latest snapshot")
+		bootstrap = true
 	}
 
 	log.Debug().Str("path", cfg.Config.DBPath).Msg("Opening database")
 	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to open database")
-		return
-	}
-
-	if *cfg.CleanupFlag {
-		err = streamDB.RemoveCDC(true)
-		if err != nil {
-			log.Panic().Err(err).Msg("Unable to clean up...")
-		} else {
-			log.Info().Msg("Cleanup complete...")
-		}
-
-		return
-	}
-
-	// Handle schema status commands
-	if *cfg.SchemaStatusFlag || *cfg.SchemaStatusClusterFlag {
-		// For cluster status, we need the replicator
-		if *cfg.SchemaStatusClusterFlag {
-			snpStore, err := snapshot.NewSnapshotStorage()
-			if err != nil {
-				log.Panic().Err(err).Msg("Unable to initialize snapshot storage")
-			}
-
-			replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, snpStore))
-			if err != nil {
-				log.Panic().Err(err).Msg("Unable to initialize replicators")
-			}
-
-			printClusterSchemaStatus(replicator)
-		} else {
-			printLocalSchemaStatus(streamDB)
-		}
-		return
+		return fmt.Errorf("opening database: %w", err)
 	}
 
 	snpStore, err := snapshot.NewSnapshotStorage()
@@ -134,31 +93,39 @@ func main() {
 		log.Panic().Err(err).Msg("Unable to initialize replicators")
 	}
 
-	// Initialize health check server
-	if cfg.Config.HealthCheck.Enable {
-		// streamDB implements health.DBChecker
-		// replicator implements health.ReplicationChecker
-		healthChecker := health.NewHealthChecker(streamDB, replicator, cfg.Config.NodeID, version.Get().Version)
-		healthServer := health.NewHealthServer(cfg.Config.HealthCheck, healthChecker)
+	reloader := &nodeReloader{replicator: replicator, streamDB: streamDB}
+
+	// Initialize health check server, it can be enabled later by a configuration reload
+	// streamDB implements health.DBChecker
+	// replicator implements health.ReplicationChecker
+	reloader.healthChecker = health.NewHealthChecker(streamDB, replicator, cfg.Config.NodeID, version.Get().Version)
+	reloader.healthServer = health.NewHealthServer(cfg.Config.HealthCheck, reloader.healthChecker)
+	if err := reloader.healthServer.Start(); err != nil {
+		log.Warn().Err(err).Msg("Failed to start health check server")
+	}
 
-		if err := healthServer.Start(); err != nil {
-			log.Warn().Err(err).Msg("Failed to start health check server")
+	// Make sure health server is stopped when application exits
+	defer func() {
+		if err := reloader.healthServer.Stop(); err != nil {
+			log.Warn().Err(err).Msg("Error stopping health check server")
 		}
+	}()
 
-		// Make sure health server is stopped when application exits
-		defer func() {
-			if err := healthServer.Stop(); err != nil {
-				log.Warn().Err(err).Msg("Error stopping health check server")
-			}
-		}()
+	adminServer := admin.NewAdminServer(&cfg.Config.Admin, replicator, streamDB)
+	if err := adminServer.Start(); err != nil {
+		log.Panic().Err(err).Msg("Unable to start admin server")
 	}
+	defer adminServer.Stop()
 
-	if *cfg.SaveSnapshotFlag {
-		replicator.ForceSaveSnapshot()
-		return
-	}
+	if bootstrap {
+		err = replicator.Bootstrap()
+		if err != nil {
+			removeDatabaseFiles(cfg.Config.DBPath)
+			log.Panic().Err(err).Msg("Unable to bootstrap database from snapshot")
+		}
 
-	if cfg.Config.Snapshot.Enable && cfg.Config.Replicate {
+		log.Info().Str("path", cfg.Config.DBPath).Msg("Database bootstrapped from snapshot")
+	} else if canRestoreSnapshot() {
 		err = replicator.RestoreSnapshot()
 		if err != nil {
 			log.Panic().Err(err).Msg("Unable to restore snapshot")
@@ -169,13 +136,27 @@ func main() {
 	if cfg.Config.Snapshot.Enable && cfg.Config.Publish {
 		replicator.StartSnapshotLeader()
 		defer replicator.StopSnapshotLeader()
+
+		reloader.scheduler, err = logstream.NewSnapshotScheduler(replicator)
+		if err != nil {
+			log.Panic().Err(err).Msg("Invalid snapshot schedule")
+		}
+		reloader.scheduler.Start()
+		defer func() {
+			reloader.scheduler.Stop()
+		}()
+
+		if cfg.Config.Snapshot.WAL.Enable {
+			archiver := snapshot.NewWALArchiver(cfg.Config.DBPath, snpStore)
+			archiver.Start(replicator.IsSnapshotLeader)
+			defer archiver.Stop()
+		}
 	}
 
 	log.Info().Msg("Listing tables to watch...")
 	tableNames, err := db.GetAllDBTables(cfg.Config.DBPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to list all tables")
-		return
+		return fmt.Errorf("listing tables: %w", err)
 	}
 
 	eventBus := EventBus.New()
@@ -184,8 +165,7 @@ func main() {
 	streamDB.OnChange = onTableChanged(replicator, ctxSt, eventBus, cfg.Config.NodeID)
 	log.Info().Msg("Starting change data capture pipeline...")
 	if err := streamDB.InstallCDC(tableNames); err != nil {
-		log.Error().Err(err).Msg("Unable to install change data capture pipeline")
-		return
+		return fmt.Errorf("installing change data capture pipeline: %w", err)
 	}
 
 	// Publish schema state to registry after CDC installation
@@ -205,6 +185,17 @@ func main() {
 		}
 	}
 
+	if err := replicator.ServeMigrations(streamDB); err != nil {
+		log.Warn().Err(err).Msg("Unable to serve coordinated schema migrations")
+	}
+	replicator.OnPublishResumed(streamDB.PublishPendingChanges)
+
+	if cfg.Config.Snapshot.Peer.Enable && cfg.Config.Replicate {
+		if err := replicator.ServePeerSnapshots(streamDB); err != nil {
+			log.Warn().Err(err).Msg("Unable to serve snapshots to peers")
+		}
+	}
+
 	errChan := make(chan error)
 	for i := uint64(0); i < cfg.Config.ReplicationLog.Shards; i++ {
 		go changeListener(streamDB, replicator, ctxSt, eventBus, i+1, errChan)
@@ -215,13 +206,20 @@ func main() {
 		"pulse",
 		time.Duration(cfg.Config.SleepTimeout)*time.Millisecond,
 	)
-	cleanupInterval := time.Duration(cfg.Config.CleanupInterval) * time.Millisecond
-	cleanupTicker := time.NewTicker(cleanupInterval)
+	cleanupTicker := time.NewTicker(cleanupInterval())
 	defer cleanupTicker.Stop()
+	reloader.cleanupTicker = cleanupTicker
 
-	snapshotInterval := time.Duration(cfg.Config.Snapshot.Interval) * time.Millisecond
-	snapshotTicker := utils.NewTimeoutPublisher(snapshotInterval)
-	defer snapshotTicker.Stop()
+	// Keep registry entry alive, entries expire if not refreshed
+	schemaStateTicker := time.NewTicker(logstream.SchemaStateRefreshInterval)
+	defer schemaStateTicker.Stop()
+
+	lagTicker := time.NewTicker(logstream.LagRefreshInterval)
+	defer lagTicker.Stop()
+
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	defer signal.Stop(reloadSignal)
 
 	for {
 		select {
@@ -230,24 +228,22 @@ func main() {
 				log.Panic().Err(err).Msg("Terminated listener")
 			}
 		case t := <-cleanupTicker.C:
-			cnt, err := streamDB.CleanupChangeLogs(t.Add(-cleanupInterval))
+			cnt, err := streamDB.CleanupChangeLogs(t.Add(-cleanupInterval()))
 			if err != nil {
 				log.Warn().Err(err).Msg("Unable to cleanup change logs")
 			} else if cnt > 0 {
 				log.Debug().Int64("count", cnt).Msg("Cleaned up DB change logs")
 			}
-		case <-snapshotTicker.Channel():
-			if cfg.Config.Snapshot.Enable && cfg.Config.Publish {
-				lastSnapshotTime := replicator.LastSaveSnapshotTime()
-				now := time.Now()
-				if now.Sub(lastSnapshotTime) >= snapshotInterval {
-					log.Info().
-						Time("last_snapshot", lastSnapshotTime).
-						Dur("duration", now.Sub(lastSnapshotTime)).
-						Msg("Triggering timer based snapshot save")
-					replicator.SaveSnapshot()
+		case <-schemaStateTicker.C:
+			if hash := streamDB.GetSchemaHash(); hash != "" {
+				if err := replicator.PublishSchemaState(hash, streamDB.GetPreviousHash()); err != nil {
+					log.Debug().Err(err).Msg("Unable to refresh schema state in registry")
 				}
 			}
+		case <-lagTicker.C:
+			replicator.RefreshLagMetrics()
+		case <-reloadSignal:
+			reloader.reload()
 		case <-sleepTimeout.Channel():
 			log.Info().Msg("No more events to process, initiating shutdown")
 			ctxSt.Cancel()
@@ -259,11 +255,35 @@ func main() {
 				}
 			}
 
+			shutdownTracing()
 			os.Exit(0)
 		}
 	}
 }
 
+// shutdownTracing exports the spans still buffered
+func shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := telemetry.ShutdownTracing(ctx); err != nil {
+		log.Warn().Err(err).Msg("Unable to flush traces")
+	}
+}
+
+// canRestoreSnapshot tells if snapshots can be restored from storage or peers
+func canRestoreSnapshot() bool {
+	return (cfg.Config.Snapshot.Enable || cfg.Config.Snapshot.Peer.Enable) && cfg.Config.Replicate
+}
+
+// removeDatabaseFiles deletes a partially bootstrapped database so the next start retries
+func removeDatabaseFiles(dbPath string) {
+	for _, p := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("path", p).Msg("Unable to remove database file")
+		}
+	}
+}
+
 func changeListener(
 	streamDB *db.SqliteStreamDB,
 	rep *logstream.Replicator,
@@ -296,112 +316,6 @@ func onChangeEventSimple(ctxSt *utils.StateContext, events EventBus.BusPublisher
 	}
 }
 
-func printLocalSchemaStatus(streamDB *db.SqliteStreamDB) {
-	fmt.Println("Local Schema Status")
-	fmt.Println("===================")
-
-	schemaHash := streamDB.GetSchemaHash()
-	if schemaHash == "" {
-		fmt.Println("Schema hash: Not initialized")
-		return
-	}
-
-	fmt.Printf("Schema Hash: %s\n", schemaHash)
-	fmt.Printf("Node ID: %d\n", cfg.Config.NodeID)
-	fmt.Printf("HarmonyLite Version: %s\n", version.Get().Version)
-
-	// Get watched tables
-	tableNames, err := db.GetAllDBTables(cfg.Config.DBPath)
-	if err != nil {
-		fmt.Printf("Error listing tables: %v\n", err)
-		return
-	}
-
-	fmt.Println("\nWatched Tables:")
-	for _, table := range tableNames {
-		fmt.Printf("  - %s\n", table)
-	}
-}
-
-func printClusterSchemaStatus(replicator *logstream.Replicator) {
-	fmt.Println("Cluster Schema Status")
-	fmt.Println("=====================")
-
-	states, err := replicator.GetClusterSchemaState()
-	if err != nil {
-		fmt.Printf("Error retrieving cluster schema state: %v\n", err)
-		return
-	}
-
-	if len(states) == 0 {
-		fmt.Println("No schema state information available from cluster")
-		return
-	}
-
-	fmt.Printf("Total Nodes: %d\n", len(states))
-
-	// Check consistency
-	report, err := replicator.CheckClusterSchemaConsistency()
-	if err != nil {
-		fmt.Printf("Error checking consistency: %v\n", err)
-		return
-	}
-
-	if report.Consistent {
-		fmt.Println("Consistent: Yes")
-	} else {
-		fmt.Println("Consistent: No")
-	}
-
-	// Group nodes by hash
-	hashGroups := make(map[string][]uint64)
-	for nodeID, state := range states {
-		hashGroups[state.SchemaHash] = append(hashGroups[state.SchemaHash], nodeID)
-	}
-
-	fmt.Println("\nHash Groups:")
-	for hash, nodeIDs := range hashGroups {
-		hashPreview := hash
-		if len(hash) > 16 {
-			hashPreview = hash[:16]
-		}
-		fmt.Printf("  %s: ", hashPreview)
-		for i, nodeID := range nodeIDs {
-			if i > 0 {
-				fmt.Print(", ")
-			}
-			fmt.Printf("Node %d", nodeID)
-		}
-		fmt.Println()
-	}
-
-	// Show detailed node information
-	fmt.Println("\nNode Details:")
-	for nodeID, state := range states {
-		fmt.Printf("  Node %d:\n", nodeID)
-		fmt.Printf("    Schema Hash: %s\n", state.SchemaHash)
-		fmt.Printf("    HarmonyLite Version: %s\n", state.HarmonyLiteVersion)
-		fmt.Printf("    Updated At: %s\n", state.UpdatedAt.Format(time.RFC3339))
-	}
-
-	// Show mismatches if any
-	if !report.Consistent {
-		fmt.Println("\nSchema Mismatches:")
-		for _, mismatch := range report.Mismatches {
-			expPreview := mismatch.ExpectedHash
-			actPreview := mismatch.ActualHash
-			if len(expPreview) > 16 {
-				expPreview = expPreview[:16]
-			}
-			if len(actPreview) > 16 {
-				actPreview = actPreview[:16]
-			}
-			fmt.Printf("  Node %d: hash mismatch (expected: %s, actual: %s)\n",
-				mismatch.NodeId, expPreview, actPreview)
-		}
-	}
-}
-
 func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, events EventBus.BusPublisher) func(data []byte) error {
 	return func(data []byte) error {
 		events.Publish("pulse")
@@ -420,12 +334,12 @@ func onChangeEvent(streamDB *db.SqliteStreamDB, ctxSt *utils.StateContext, event
 			return err
 		}
 
-		return streamDB.Replicate(&ev.Payload)
+		return streamDB.Replicate(context.Background(), &ev.Payload)
 	}
 }
 
-func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(event *db.ChangeLogEvent) error {
-	return func(event *db.ChangeLogEvent) error {
+func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events EventBus.BusPublisher, nodeID uint64) func(ctx context.Context, event *db.ChangeLogEvent) error {
+	return func(ctx context.Context, event *db.ChangeLogEvent) error {
 		events.Publish("pulse")
 		if ctxSt.IsCanceled() {
 			return context.Canceled
@@ -435,6 +349,11 @@ func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events E
 			return nil
 		}
 
+		// Keep change pending until publishing is resumed cluster-wide
+		if r.IsPublishPaused() {
+			return db.ErrLogNotReadyToPublish
+		}
+
 		ev := &logstream.ReplicationEvent[db.ChangeLogEvent]{
 			FromNodeId: nodeID,
 			Payload:    *event,
@@ -450,7 +369,7 @@ func onTableChanged(r *logstream.Replicator, ctxSt *utils.StateContext, events E
 			return err
 		}
 
-		err = r.Publish(hash, data)
+		err = r.Publish(ctx, hash, data)
 		if err != nil {
 			return err
 		}
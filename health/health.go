@@ -1,7 +1,10 @@
 package health
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/wongfei2009/harmonylite/cfg"
 )
 
 // DBChecker defines the interface for database health checks
@@ -9,6 +12,7 @@ type DBChecker interface {
 	IsConnected() bool
 	AreCDCHooksInstalled() bool
 	GetTrackedTablesCount() int
+	GetPendingChangesCount() int64
 	DB() interface{}
 }
 
@@ -17,20 +21,47 @@ type ReplicationChecker interface {
 	IsConnected() bool
 	GetLastReplicatedEventTime() time.Time
 	GetLastPublishedEventTime() time.Time
+	GetShardStatus() []ShardStatus
+	IsSchemaMismatchPaused() bool
+	IsRestoring() bool
+}
+
+// ShardStatus represents the replication progress of the node on one shard
+type ShardStatus struct {
+	Shard        uint64    `json:"shard"`
+	Stream       string    `json:"stream"`
+	LastSeq      uint64    `json:"last_seq"`
+	AppliedSeq   uint64    `json:"applied_seq"`
+	AppliedAt    time.Time `json:"applied_at,omitempty"`
+	PublishedSeq uint64    `json:"published_seq,omitempty"`
+	PublishedAt  time.Time `json:"published_at,omitempty"`
+	Lag          uint64    `json:"lag"`
 }
 
 // Status represents the health status of the HarmonyLite node
 type Status struct {
-	Status                      string    `json:"status"`
-	NodeID                      uint64    `json:"node_id"`
-	UptimeSeconds               int64     `json:"uptime_seconds"`
-	DBConnected                 bool      `json:"db_connected"`
-	NatsConnected               bool      `json:"nats_connected"`
-	CDCInstalled                bool      `json:"cdc_installed"`
-	TablesTracked               int       `json:"tables_tracked"`
-	LastReplicatedEventTime     time.Time `json:"last_replicated_event_timestamp,omitempty"`
-	LastPublishedEventTime      time.Time `json:"last_published_event_timestamp,omitempty"`
-	Version                     string    `json:"version"`
+	Status                  string        `json:"status"`
+	NodeID                  uint64        `json:"node_id"`
+	UptimeSeconds           int64         `json:"uptime_seconds"`
+	DBConnected             bool          `json:"db_connected"`
+	NatsConnected           bool          `json:"nats_connected"`
+	CDCInstalled            bool          `json:"cdc_installed"`
+	TablesTracked           int           `json:"tables_tracked"`
+	LastReplicatedEventTime time.Time     `json:"last_replicated_event_timestamp,omitempty"`
+	LastPublishedEventTime  time.Time     `json:"last_published_event_timestamp,omitempty"`
+	ReplicationLag          uint64        `json:"replication_lag"`
+	Shards                  []ShardStatus `json:"shards,omitempty"`
+	Version                 string        `json:"version"`
+}
+
+// Readiness represents whether the node is ready to serve traffic
+type Readiness struct {
+	Status               string   `json:"status"`
+	Reasons              []string `json:"reasons,omitempty"`
+	ReplicationLag       uint64   `json:"replication_lag"`
+	PendingChanges       int64    `json:"pending_changes"`
+	SchemaMismatchPaused bool     `json:"schema_mismatch_paused"`
+	RestoreInProgress    bool     `json:"restore_in_progress"`
 }
 
 // HealthChecker provides methods to check the health of the HarmonyLite node
@@ -58,13 +89,13 @@ func (c *HealthChecker) Check() Status {
 	dbConnected := c.checkDBConnection()
 	natsConnected := c.checkNatsConnection()
 	cdcInstalled := c.checkCDCHooks()
-	
+
 	healthy := dbConnected && natsConnected && cdcInstalled
 	status := "healthy"
 	if !healthy {
 		status = "unhealthy"
 	}
-	
+
 	healthStatus := Status{
 		Status:        status,
 		NodeID:        c.nodeID,
@@ -75,16 +106,21 @@ func (c *HealthChecker) Check() Status {
 		TablesTracked: c.getTablesTrackedCount(),
 		Version:       c.version,
 	}
-	
+
 	// Add timestamps if available
 	if lastReplicated := c.getLastReplicatedEventTime(); !lastReplicated.IsZero() {
 		healthStatus.LastReplicatedEventTime = lastReplicated
 	}
-	
+
 	if lastPublished := c.getLastPublishedEventTime(); !lastPublished.IsZero() {
 		healthStatus.LastPublishedEventTime = lastPublished
 	}
-	
+
+	healthStatus.Shards = c.getShardStatus()
+	for _, shard := range healthStatus.Shards {
+		healthStatus.ReplicationLag += shard.Lag
+	}
+
 	return healthStatus
 }
 
@@ -93,7 +129,7 @@ func (c *HealthChecker) checkDBConnection() bool {
 	if c.streamDB == nil {
 		return false
 	}
-	
+
 	return c.streamDB.IsConnected()
 }
 
@@ -102,7 +138,7 @@ func (c *HealthChecker) checkNatsConnection() bool {
 	if c.replicator == nil {
 		return false
 	}
-	
+
 	return c.replicator.IsConnected()
 }
 
@@ -111,7 +147,7 @@ func (c *HealthChecker) checkCDCHooks() bool {
 	if c.streamDB == nil {
 		return false
 	}
-	
+
 	return c.streamDB.AreCDCHooksInstalled()
 }
 
@@ -120,7 +156,7 @@ func (c *HealthChecker) getTablesTrackedCount() int {
 	if c.streamDB == nil {
 		return 0
 	}
-	
+
 	return c.streamDB.GetTrackedTablesCount()
 }
 
@@ -129,7 +165,7 @@ func (c *HealthChecker) getLastReplicatedEventTime() time.Time {
 	if c.replicator == nil {
 		return time.Time{}
 	}
-	
+
 	return c.replicator.GetLastReplicatedEventTime()
 }
 
@@ -138,6 +174,85 @@ func (c *HealthChecker) getLastPublishedEventTime() time.Time {
 	if c.replicator == nil {
 		return time.Time{}
 	}
-	
+
 	return c.replicator.GetLastPublishedEventTime()
 }
+
+// getShardStatus returns the replication progress on each shard
+func (c *HealthChecker) getShardStatus() []ShardStatus {
+	if c.replicator == nil {
+		return nil
+	}
+
+	return c.replicator.GetShardStatus()
+}
+
+// Live reports whether the node is alive, it only fails when the database can't be used
+// and restarting the process is the way to recover
+func (c *HealthChecker) Live() bool {
+	return c.checkDBConnection()
+}
+
+// Ready reports whether the node is healthy and caught up within the given thresholds
+func (c *HealthChecker) Ready(config *cfg.ReadinessConfiguration) Readiness {
+	status := c.Check()
+	readiness := Readiness{
+		ReplicationLag: status.ReplicationLag,
+		PendingChanges: c.getPendingChangesCount(),
+	}
+
+	reasons := make([]string, 0)
+	if !status.DBConnected {
+		reasons = append(reasons, "database not connected")
+	}
+
+	if !status.NatsConnected {
+		reasons = append(reasons, "NATS not connected")
+	}
+
+	if !status.CDCInstalled {
+		reasons = append(reasons, "CDC hooks not installed")
+	}
+
+	if config.MaxReplicationLag > 0 && readiness.ReplicationLag > config.MaxReplicationLag {
+		reasons = append(reasons, fmt.Sprintf("replication lag %d exceeds %d", readiness.ReplicationLag, config.MaxReplicationLag))
+	}
+
+	if config.MaxPendingChanges > 0 {
+		if readiness.PendingChanges < 0 {
+			reasons = append(reasons, "unable to count pending changes")
+		} else if readiness.PendingChanges > config.MaxPendingChanges {
+			reasons = append(reasons, fmt.Sprintf("pending changes %d exceed %d", readiness.PendingChanges, config.MaxPendingChanges))
+		}
+	}
+
+	if c.replicator != nil {
+		readiness.SchemaMismatchPaused = c.replicator.IsSchemaMismatchPaused()
+		readiness.RestoreInProgress = c.replicator.IsRestoring()
+	}
+
+	if config.FailOnSchemaMismatch && readiness.SchemaMismatchPaused {
+		reasons = append(reasons, "replication paused on schema mismatch")
+	}
+
+	if config.FailOnRestore && readiness.RestoreInProgress {
+		reasons = append(reasons, "snapshot restore in progress")
+	}
+
+	readiness.Status = "ready"
+	if len(reasons) > 0 {
+		readiness.Status = "not_ready"
+		readiness.Reasons = reasons
+	}
+
+	return readiness
+}
+
+// getPendingChangesCount returns the number of changes left to publish, -1 when unknown
+func (c *HealthChecker) getPendingChangesCount() int64 {
+	if c.streamDB == nil {
+		return -1
+	}
+
+	return c.streamDB.GetPendingChangesCount()
+}
@@ -6,7 +6,7 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
-	
+
 	"github.com/wongfei2009/harmonylite/cfg"
 )
 
@@ -15,6 +15,7 @@ import (
 // MockStreamDB implements the minimal interface needed for testing
 type MockStreamDB struct {
 	connected bool
+	pending   int64
 }
 
 func (m *MockStreamDB) IsConnected() bool {
@@ -29,6 +30,10 @@ func (m *MockStreamDB) GetTrackedTablesCount() int {
 	return 3
 }
 
+func (m *MockStreamDB) GetPendingChangesCount() int64 {
+	return m.pending
+}
+
 func (m *MockStreamDB) DB() interface{} {
 	return nil
 }
@@ -36,6 +41,8 @@ func (m *MockStreamDB) DB() interface{} {
 // MockReplicator implements the minimal interface needed for testing
 type MockReplicator struct {
 	connected bool
+	paused    bool
+	restoring bool
 }
 
 func (m *MockReplicator) IsConnected() bool {
@@ -50,6 +57,21 @@ func (m *MockReplicator) GetLastPublishedEventTime() time.Time {
 	return time.Now()
 }
 
+func (m *MockReplicator) IsSchemaMismatchPaused() bool {
+	return m.paused
+}
+
+func (m *MockReplicator) IsRestoring() bool {
+	return m.restoring
+}
+
+func (m *MockReplicator) GetShardStatus() []ShardStatus {
+	return []ShardStatus{
+		{Shard: 1, Stream: "harmonylite-changes-1", LastSeq: 10, AppliedSeq: 7, Lag: 3},
+		{Shard: 2, Stream: "harmonylite-changes-2", LastSeq: 5, AppliedSeq: 5},
+	}
+}
+
 func TestHealthServer_HandleHealthCheck(t *testing.T) {
 	// Test cases
 	tests := []struct {
@@ -104,11 +126,11 @@ func TestHealthServer_HandleHealthCheck(t *testing.T) {
 			mockDB := &MockStreamDB{
 				connected: tc.healthy,
 			}
-			
+
 			mockReplicator := &MockReplicator{
 				connected: tc.healthy,
 			}
-			
+
 			// Create real health checker with mocks
 			checker := NewHealthChecker(mockDB, mockReplicator, 1, "test-version")
 
@@ -150,6 +172,137 @@ func TestHealthServer_HandleHealthCheck(t *testing.T) {
 				if status.NodeID != 1 {
 					t.Errorf("Expected nodeID to be 1, got %d", status.NodeID)
 				}
+
+				if len(status.Shards) != 2 {
+					t.Errorf("Expected 2 shards, got %d", len(status.Shards))
+				}
+
+				if status.ReplicationLag != 3 {
+					t.Errorf("Expected replication lag to be 3, got %d", status.ReplicationLag)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthServer_HandleProbes(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		db             *MockStreamDB
+		replicator     *MockReplicator
+		readiness      cfg.ReadinessConfiguration
+		expectedStatus int
+		expectedReason string
+	}{
+		{
+			name:           "Live",
+			path:           "/livez",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: false},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "NotLive",
+			path:           "/livez",
+			db:             &MockStreamDB{connected: false},
+			replicator:     &MockReplicator{connected: true},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "Ready",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true, pending: 5},
+			replicator:     &MockReplicator{connected: true},
+			readiness:      cfg.ReadinessConfiguration{MaxReplicationLag: 3, MaxPendingChanges: 5},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "NotReady_NatsDisconnected",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: false},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReason: "NATS not connected",
+		},
+		{
+			name:           "NotReady_ReplicationLag",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: true},
+			readiness:      cfg.ReadinessConfiguration{MaxReplicationLag: 2},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReason: "replication lag 3 exceeds 2",
+		},
+		{
+			name:           "NotReady_PendingChanges",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true, pending: 6},
+			replicator:     &MockReplicator{connected: true},
+			readiness:      cfg.ReadinessConfiguration{MaxPendingChanges: 5},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReason: "pending changes 6 exceed 5",
+		},
+		{
+			name:           "NotReady_SchemaMismatch",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: true, paused: true},
+			readiness:      cfg.ReadinessConfiguration{FailOnSchemaMismatch: true},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReason: "replication paused on schema mismatch",
+		},
+		{
+			name:           "Ready_SchemaMismatchAllowed",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: true, paused: true},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "NotReady_Restoring",
+			path:           "/readyz",
+			db:             &MockStreamDB{connected: true},
+			replicator:     &MockReplicator{connected: true, restoring: true},
+			readiness:      cfg.ReadinessConfiguration{FailOnRestore: true},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedReason: "snapshot restore in progress",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Readiness = tc.readiness
+			server := NewHealthServer(config, NewHealthChecker(tc.db, tc.replicator, 1, "test-version"))
+
+			req, err := http.NewRequest("GET", tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			if tc.path == config.LivenessPath {
+				server.handleLiveness(rr, req)
+			} else {
+				server.handleReadiness(rr, req)
+			}
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+
+			if tc.expectedReason == "" {
+				return
+			}
+
+			var readiness Readiness
+			if err := json.Unmarshal(rr.Body.Bytes(), &readiness); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+
+			if len(readiness.Reasons) != 1 || readiness.Reasons[0] != tc.expectedReason {
+				t.Errorf("Expected reason %q, got %v", tc.expectedReason, readiness.Reasons)
 			}
 		})
 	}
@@ -159,11 +312,11 @@ func TestHealthServer_StartStop(t *testing.T) {
 	mockDB := &MockStreamDB{
 		connected: true,
 	}
-	
+
 	mockReplicator := &MockReplicator{
 		connected: true,
 	}
-	
+
 	checker := NewHealthChecker(mockDB, mockReplicator, 1, "test-version")
 
 	config := &cfg.HealthCheckConfiguration{
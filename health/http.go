@@ -36,6 +36,13 @@ func (s *HealthServer) Start() error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc(s.config.Path, s.handleHealthCheck)
+	if s.config.LivenessPath != "" {
+		mux.HandleFunc(s.config.LivenessPath, s.handleLiveness)
+	}
+
+	if s.config.ReadinessPath != "" {
+		mux.HandleFunc(s.config.ReadinessPath, s.handleReadiness)
+	}
 
 	s.server = &http.Server{
 		Addr:    s.config.Bind,
@@ -46,6 +53,8 @@ func (s *HealthServer) Start() error {
 		log.Info().
 			Str("bind", s.config.Bind).
 			Str("path", s.config.Path).
+			Str("liveness_path", s.config.LivenessPath).
+			Str("readiness_path", s.config.ReadinessPath).
 			Msg("Starting health check server")
 
 		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -84,3 +93,34 @@ func (s *HealthServer) handleHealthCheck(w http.ResponseWriter, r *http.Request)
 		json.NewEncoder(w).Encode(status)
 	}
 }
+
+// handleLiveness handles HTTP requests for liveness probes
+func (s *HealthServer) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	if !s.checker.Live() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("database unavailable\n"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadiness handles HTTP requests for readiness probes
+func (s *HealthServer) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	readiness := s.checker.Ready(&s.config.Readiness)
+
+	if s.config.Detailed {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	if readiness.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if s.config.Detailed {
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
@@ -0,0 +1,219 @@
+package logstream
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrInvalidShard = errors.New("invalid shard")
+var ErrNoHeadMessage = errors.New("no message left to apply on shard")
+
+// pauseGate blocks callers of wait while paused
+type pauseGate struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (g *pauseGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ch != nil {
+		return false
+	}
+
+	g.ch = make(chan struct{})
+	return true
+}
+
+func (g *pauseGate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ch == nil {
+		return false
+	}
+
+	close(g.ch)
+	g.ch = nil
+	return true
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ch != nil
+}
+
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+
+	if ch != nil {
+		<-ch
+	}
+}
+
+// PausePublishing holds local changes on this node until ResumePublishing, independently of
+// the cluster-wide pause used by coordinated migrations
+func (r *Replicator) PausePublishing() {
+	if !r.publishHeld.Swap(true) {
+		log.Warn().Msg("Publishing paused on this node")
+	}
+}
+
+// ResumePublishing lifts a pause set by PausePublishing, pending changes are published unless
+// publishing is still paused cluster-wide
+func (r *Replicator) ResumePublishing() {
+	if !r.publishHeld.Swap(false) {
+		return
+	}
+
+	log.Info().Msg("Publishing resumed on this node")
+	if !r.publishPaused.Load() {
+		r.notifyPublishResumed()
+	}
+}
+
+// PauseReplication stops listeners from applying events until ResumeReplication
+func (r *Replicator) PauseReplication() {
+	if r.replicationGate.pause() {
+		log.Warn().Msg("Replication paused on this node")
+	}
+}
+
+// HoldApplying runs fn once listeners finished applying their current event, no event is
+// applied until fn returns
+func (r *Replicator) HoldApplying(fn func() error) error {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	return fn()
+}
+
+// ResumeReplication lets listeners apply events again
+func (r *Replicator) ResumeReplication() {
+	if r.replicationGate.resume() {
+		log.Info().Msg("Replication resumed on this node")
+	}
+}
+
+// IsReplicationPaused returns true if replication was paused with PauseReplication
+func (r *Replicator) IsReplicationPaused() bool {
+	return r.replicationGate.paused()
+}
+
+// ReplicationState returns the last stream sequence replicated on every stream
+func (r *Replicator) ReplicationState() map[string]uint64 {
+	return r.repState.all()
+}
+
+// SkipHead moves the listener of a shard and the replication watermark past the next message
+// the listener would apply, the message is never applied on this node. Returns the sequence of the skipped message.
+func (r *Replicator) SkipHead(shardID uint64) (uint64, error) {
+	js, ok := r.streamMap[shardID]
+	if !ok {
+		return 0, ErrInvalidShard
+	}
+
+	strName := streamName(shardID, r.compressionEnabled)
+	info, err := js.StreamInfo(strName)
+	if err != nil {
+		return 0, err
+	}
+
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	head := r.progress.snapshot(shardID).appliedSeq + 1
+	if head < info.State.FirstSeq {
+		head = info.State.FirstSeq
+	}
+
+	if head > info.State.LastSeq {
+		return 0, ErrNoHeadMessage
+	}
+
+	if _, err := r.repState.save(strName, head); err != nil {
+		return 0, err
+	}
+
+	r.progress.resumed(shardID, head)
+	r.resubscribes.Add(1)
+	log.Warn().Str("stream", strName).Uint64("seq", head).Msg("Skipped head message")
+	return head, nil
+}
+
+// RetryHead redelivers the next message to apply on a shard right away, a message held back by
+// a schema mismatch is retried against a recomputed local schema
+func (r *Replicator) RetryHead(shardID uint64) error {
+	if _, ok := r.streamMap[shardID]; !ok {
+		return ErrInvalidShard
+	}
+
+	r.mu.Lock()
+	if !r.schemaMismatchAt.IsZero() {
+		r.lastRecomputeAt = time.Time{}
+	}
+	r.mu.Unlock()
+
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	r.resubscribes.Add(1)
+	log.Info().Uint64("shard", shardID).Msg("Retrying head message")
+	return nil
+}
+
+// StreamStatus is the JetStream state of a shard stream along with the local watermark
+type StreamStatus struct {
+	Shard      uint64    `json:"shard"`
+	Stream     string    `json:"stream"`
+	Messages   uint64    `json:"messages"`
+	Bytes      uint64    `json:"bytes"`
+	FirstSeq   uint64    `json:"first_seq"`
+	LastSeq    uint64    `json:"last_seq"`
+	LastTime   time.Time `json:"last_time,omitempty"`
+	Consumers  int       `json:"consumers"`
+	AppliedSeq uint64    `json:"applied_seq"`
+	Lag        uint64    `json:"lag"`
+}
+
+// GetStreamStatus returns the state of every shard stream, sorted by shard
+func (r *Replicator) GetStreamStatus() ([]StreamStatus, error) {
+	statuses := make([]StreamStatus, 0, len(r.streamMap))
+	for shard := uint64(1); shard <= uint64(len(r.streamMap)); shard++ {
+		js, ok := r.streamMap[shard]
+		if !ok {
+			return nil, ErrInvalidShard
+		}
+
+		strName := streamName(shard, r.compressionEnabled)
+		info, err := js.StreamInfo(strName)
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: %w", strName, err)
+		}
+
+		status := StreamStatus{
+			Shard:      shard,
+			Stream:     strName,
+			Messages:   info.State.Msgs,
+			Bytes:      info.State.Bytes,
+			FirstSeq:   info.State.FirstSeq,
+			LastSeq:    info.State.LastSeq,
+			LastTime:   info.State.LastTime,
+			Consumers:  info.State.Consumers,
+			AppliedSeq: r.repState.get(strName),
+		}
+		if status.LastSeq > status.AppliedSeq {
+			status.Lag = status.LastSeq - status.AppliedSeq
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
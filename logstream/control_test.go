@@ -0,0 +1,159 @@
+package logstream
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func TestPauseGate(t *testing.T) {
+	g := &pauseGate{}
+	g.wait()
+	assert.False(t, g.paused())
+
+	assert.True(t, g.pause())
+	assert.False(t, g.pause(), "already paused")
+
+	released := make(chan struct{})
+	go func() {
+		g.wait()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		t.Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.True(t, g.resume())
+	assert.False(t, g.resume(), "already resumed")
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("wait not released by resume")
+	}
+}
+
+func TestReplicator_PausePublishing(t *testing.T) {
+	r := &Replicator{}
+	resumed := make(chan struct{}, 2)
+	r.OnPublishResumed(func() {
+		resumed <- struct{}{}
+	})
+
+	r.PausePublishing()
+	assert.True(t, r.IsPublishPaused())
+
+	// Lifting the cluster-wide pause keeps the local one
+	r.setPublishPaused(true, nil)
+	r.setPublishPaused(false, nil)
+	assert.True(t, r.IsPublishPaused())
+	assert.Empty(t, resumed)
+
+	r.ResumePublishing()
+	assert.False(t, r.IsPublishPaused())
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("pending changes not published on resume")
+	}
+}
+
+func TestReplicator_SkipHead(t *testing.T) {
+	original := cfg.Config.SeqMapPath
+	defer func() {
+		cfg.Config.SeqMapPath = original
+	}()
+	cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+
+	repState := &replicationState{}
+	require.NoError(t, repState.init())
+	defer repState.fl.Close()
+
+	r := &Replicator{
+		repState: repState,
+		streamMap: map[uint64]nats.JetStreamContext{
+			1: &streamInfoJS{firstSeq: 1, lastSeq: 10},
+			2: &streamInfoJS{firstSeq: 20, lastSeq: 30},
+		},
+		progress: newShardProgress(),
+	}
+
+	// The head follows what the listener applied, not the saved watermark
+	_, err := repState.save(streamName(1, false), 2)
+	require.NoError(t, err)
+	r.progress.applied(1, 4, time.Now())
+
+	seq, err := r.SkipHead(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), seq)
+	assert.Equal(t, uint64(5), r.ReplicationState()[streamName(1, false)])
+	assert.Equal(t, uint64(5), r.progress.snapshot(1).appliedSeq)
+	assert.Equal(t, uint64(1), r.resubscribes.Load())
+
+	// Retrying resubscribes after the same sequence
+	require.NoError(t, r.RetryHead(1))
+	assert.Equal(t, uint64(5), r.progress.snapshot(1).appliedSeq)
+	assert.Equal(t, uint64(2), r.resubscribes.Load())
+
+	// Head is the first message left in a truncated stream
+	seq, err = r.SkipHead(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), seq)
+
+	r.progress.applied(1, 10, time.Now())
+	_, err = r.SkipHead(1)
+	assert.ErrorIs(t, err, ErrNoHeadMessage)
+
+	_, err = r.SkipHead(3)
+	assert.ErrorIs(t, err, ErrInvalidShard)
+	assert.ErrorIs(t, r.RetryHead(3), ErrInvalidShard)
+}
+
+func TestReplicator_HoldApplying(t *testing.T) {
+	r := &Replicator{}
+	held := errors.New("held")
+	assert.ErrorIs(t, r.HoldApplying(func() error {
+		// Listeners can't take the apply lock meanwhile
+		assert.False(t, r.applyLock.TryRLock())
+		return held
+	}), held)
+	assert.True(t, r.applyLock.TryRLock())
+}
+
+func TestReplicator_GetStreamStatus(t *testing.T) {
+	r := &Replicator{
+		repState: &replicationState{
+			seq:  map[string]uint64{streamName(1, false): 7},
+			lock: &sync.RWMutex{},
+		},
+		streamMap: map[uint64]nats.JetStreamContext{
+			1: &streamInfoJS{firstSeq: 3, lastSeq: 10},
+			2: &streamInfoJS{firstSeq: 1, lastSeq: 4},
+		},
+	}
+
+	statuses, err := r.GetStreamStatus()
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+
+	assert.Equal(t, streamName(1, false), statuses[0].Stream)
+	assert.Equal(t, uint64(3), statuses[0].FirstSeq)
+	assert.Equal(t, uint64(7), statuses[0].AppliedSeq)
+	assert.Equal(t, uint64(3), statuses[0].Lag)
+
+	assert.Equal(t, uint64(2), statuses[1].Shard)
+	assert.Equal(t, uint64(4), statuses[1].Lag)
+
+	r.streamMap[2] = &streamInfoJS{err: nats.ErrStreamNotFound}
+	_, err = r.GetStreamStatus()
+	assert.ErrorIs(t, err, nats.ErrStreamNotFound)
+}
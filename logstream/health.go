@@ -1,62 +1,215 @@
 package logstream
 
 import (
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/health"
+	"github.com/wongfei2009/harmonylite/telemetry"
 )
 
+// LagRefreshInterval is how often replication lag metrics are refreshed from the streams
+const LagRefreshInterval = 10 * time.Second
+
+// shardActivity is what this node last applied from and published to a shard
+type shardActivity struct {
+	appliedSeq   uint64
+	appliedAt    time.Time
+	publishedSeq uint64
+	publishedAt  time.Time
+}
+
+// shardProgress tracks the replication progress of this node on every shard
+type shardProgress struct {
+	mu       sync.Mutex
+	activity map[uint64]*shardActivity
+
+	lag          telemetry.GaugeVec
+	lastSeq      telemetry.GaugeVec
+	appliedSeq   telemetry.GaugeVec
+	appliedAt    telemetry.GaugeVec
+	publishedSeq telemetry.GaugeVec
+	publishedAt  telemetry.GaugeVec
+}
+
+func newShardProgress() *shardProgress {
+	labels := []string{"shard"}
+	return &shardProgress{
+		activity:     map[uint64]*shardActivity{},
+		lag:          telemetry.NewGaugeVec("replication_lag", "Stream entries not yet applied by this node", labels),
+		lastSeq:      telemetry.NewGaugeVec("stream_last_seq", "Last sequence of the shard stream", labels),
+		appliedSeq:   telemetry.NewGaugeVec("applied_seq", "Last stream sequence applied by this node", labels),
+		appliedAt:    telemetry.NewGaugeVec("applied_timestamp_seconds", "Stream time of the last event applied by this node", labels),
+		publishedSeq: telemetry.NewGaugeVec("published_seq", "Last stream sequence published by this node", labels),
+		publishedAt:  telemetry.NewGaugeVec("published_timestamp_seconds", "Time of the last event published by this node", labels),
+	}
+}
+
+func (p *shardProgress) get(shard uint64) *shardActivity {
+	a, ok := p.activity[shard]
+	if !ok {
+		a = &shardActivity{}
+		p.activity[shard] = a
+	}
+
+	return a
+}
+
+func (p *shardProgress) applied(shard uint64, seq uint64, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.get(shard)
+	a.appliedSeq = seq
+	a.appliedAt = at
+
+	label := strconv.FormatUint(shard, 10)
+	p.appliedSeq.WithLabelValues(label).Set(float64(seq))
+	p.appliedAt.WithLabelValues(label).Set(float64(at.Unix()))
+}
+
+// resumed records the sequence a listener resumes applying a shard after, e.g. the saved
+// watermark at startup, the time of that event isn't known
+func (p *shardProgress) resumed(shard uint64, seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.get(shard).appliedSeq = seq
+	p.appliedSeq.WithLabelValues(strconv.FormatUint(shard, 10)).Set(float64(seq))
+}
+
+func (p *shardProgress) published(shard uint64, seq uint64, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.get(shard)
+	a.publishedSeq = seq
+	a.publishedAt = at
+
+	label := strconv.FormatUint(shard, 10)
+	p.publishedSeq.WithLabelValues(label).Set(float64(seq))
+	p.publishedAt.WithLabelValues(label).Set(float64(at.Unix()))
+}
+
+// snapshot returns a copy of the activity on a shard
+func (p *shardProgress) snapshot(shard uint64) shardActivity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if a, ok := p.activity[shard]; ok {
+		return *a
+	}
+
+	return shardActivity{}
+}
+
+// latest returns the newest applied and published times across shards
+func (p *shardProgress) latest() (time.Time, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	applied, published := time.Time{}, time.Time{}
+	for _, a := range p.activity {
+		if a.appliedAt.After(applied) {
+			applied = a.appliedAt
+		}
+
+		if a.publishedAt.After(published) {
+			published = a.publishedAt
+		}
+	}
+
+	return applied, published
+}
+
+// setLag records the lag of a shard against the last sequence of its stream
+func (p *shardProgress) setLag(shard uint64, lastSeq uint64, lag uint64) {
+	label := strconv.FormatUint(shard, 10)
+	p.lastSeq.WithLabelValues(label).Set(float64(lastSeq))
+	p.lag.WithLabelValues(label).Set(float64(lag))
+}
+
 // IsConnected checks if the NATS connection is alive
 func (r *Replicator) IsConnected() bool {
 	if r.client == nil {
 		return false
 	}
-	
+
 	return r.client.Status() == nats.CONNECTED
 }
 
-// GetLastReplicatedEventTime returns an approximate time of the last replicated event
-// This is a simplified implementation that could be enhanced with actual tracking
+// IsRestoring returns true while an online snapshot restore is in progress
+func (r *Replicator) IsRestoring() bool {
+	return r.restoring.Load()
+}
+
+// GetLastReplicatedEventTime returns the stream time of the newest event applied by this
+// node on any shard, zero when nothing was applied since startup
 func (r *Replicator) GetLastReplicatedEventTime() time.Time {
-	// Check if we have any stream information
-	if len(r.streamMap) == 0 {
-		return time.Time{}
-	}
-	
-	// For simplicity, we'll check just the first shard
-	js, ok := r.streamMap[1]
-	if !ok {
-		return time.Time{}
-	}
-	
-	// Get the stream info to find the last sequence
-	info, err := js.StreamInfo(streamName(1, r.compressionEnabled))
-	if err != nil {
-		log.Debug().Err(err).Msg("Failed to get stream info for last replicated event time")
-		return time.Time{}
-	}
-	
-	// If there are no messages, return zero time
-	if info.State.LastSeq == 0 {
-		return time.Time{}
-	}
-	
-	// Try to get the last message's timestamp
-	// Note: This is not exact, as it's just checking one shard
-	msg, err := js.GetMsg(streamName(1, r.compressionEnabled), info.State.LastSeq)
-	if err != nil {
-		log.Debug().Err(err).Msg("Failed to get last message for timestamp")
-		return time.Time{}
-	}
-	
-	return msg.Time
-}
-
-// GetLastPublishedEventTime returns the time of the last published event
-// This is similar to GetLastReplicatedEventTime but for outgoing messages
+	applied, _ := r.progress.latest()
+	return applied
+}
+
+// GetLastPublishedEventTime returns the time of the newest event published by this node on
+// any shard, zero when nothing was published since startup
 func (r *Replicator) GetLastPublishedEventTime() time.Time {
-	// For the initial implementation, we'll use the same logic as GetLastReplicatedEventTime
-	// In a more detailed implementation, we would track separate timestamps for publishing vs. replicating
-	return r.GetLastReplicatedEventTime()
+	_, published := r.progress.latest()
+	return published
+}
+
+// GetShardStatus returns the progress of this node on every shard. Lag is the number of
+// entries in the stream after the last sequence applied by the listener of the shard.
+func (r *Replicator) GetShardStatus() []health.ShardStatus {
+	shards := make([]uint64, 0, len(r.streamMap))
+	for shard := range r.streamMap {
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i] < shards[j]
+	})
+
+	statuses := make([]health.ShardStatus, 0, len(shards))
+	for _, shard := range shards {
+		strName := streamName(shard, r.compressionEnabled)
+		activity := r.progress.snapshot(shard)
+		status := health.ShardStatus{
+			Shard:        shard,
+			Stream:       strName,
+			AppliedSeq:   activity.appliedSeq,
+			AppliedAt:    activity.appliedAt,
+			PublishedSeq: activity.publishedSeq,
+			PublishedAt:  activity.publishedAt,
+		}
+
+		info, err := r.streamMap[shard].StreamInfo(strName)
+		if err != nil {
+			log.Debug().Err(err).Str("stream", strName).Msg("Failed to get stream info for replication lag")
+			statuses = append(statuses, status)
+			continue
+		}
+
+		status.LastSeq = info.State.LastSeq
+		if status.LastSeq > status.AppliedSeq {
+			status.Lag = status.LastSeq - status.AppliedSeq
+		}
+
+		r.progress.setLag(shard, status.LastSeq, status.Lag)
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// RefreshLagMetrics updates replication lag gauges from the current stream state, and the
+// age of the last snapshot saved by this node
+func (r *Replicator) RefreshLagMetrics() {
+	r.GetShardStatus()
+
+	if last := r.LastSaveSnapshotTime(); !last.IsZero() {
+		r.metrics.snapshotAge.Set(time.Since(last).Seconds())
+	}
 }
@@ -0,0 +1,68 @@
+package logstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamInfoJS reports a fixed stream state, other JetStream calls are not implemented
+type streamInfoJS struct {
+	nats.JetStreamContext
+	firstSeq uint64
+	lastSeq  uint64
+	err      error
+}
+
+func (s *streamInfoJS) StreamInfo(string, ...nats.JSOpt) (*nats.StreamInfo, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &nats.StreamInfo{State: nats.StreamState{FirstSeq: s.firstSeq, LastSeq: s.lastSeq}}, nil
+}
+
+func TestReplicator_GetShardStatus(t *testing.T) {
+	r := &Replicator{
+		streamMap: map[uint64]nats.JetStreamContext{
+			1: &streamInfoJS{lastSeq: 100},
+			2: &streamInfoJS{lastSeq: 40},
+			3: &streamInfoJS{err: errors.New("stream unavailable")},
+		},
+		progress: newShardProgress(),
+	}
+
+	applied := time.Date(2024, 1, 15, 2, 0, 0, 0, time.UTC)
+	published := applied.Add(time.Minute)
+	r.progress.applied(1, 90, applied)
+	r.progress.resumed(2, 50)
+	r.progress.published(2, 50, published)
+
+	statuses := r.GetShardStatus()
+	require.Len(t, statuses, 3)
+
+	assert.Equal(t, uint64(1), statuses[0].Shard)
+	assert.Equal(t, uint64(100), statuses[0].LastSeq)
+	assert.Equal(t, uint64(90), statuses[0].AppliedSeq)
+	assert.Equal(t, uint64(10), statuses[0].Lag)
+	assert.Equal(t, applied, statuses[0].AppliedAt)
+
+	// Watermark ahead of the last known stream sequence doesn't underflow, a listener resuming
+	// from the saved watermark hasn't applied an event yet
+	assert.Equal(t, uint64(50), statuses[1].AppliedSeq)
+	assert.True(t, statuses[1].AppliedAt.IsZero())
+	assert.Equal(t, uint64(50), statuses[1].PublishedSeq)
+	assert.Zero(t, statuses[1].Lag)
+
+	// Shards without stream info keep local progress
+	assert.Equal(t, uint64(3), statuses[2].Shard)
+	assert.Zero(t, statuses[2].LastSeq)
+	assert.Zero(t, statuses[2].Lag)
+
+	assert.Equal(t, applied, r.GetLastReplicatedEventTime())
+	assert.Equal(t, published, r.GetLastPublishedEventTime())
+}
@@ -8,72 +8,131 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ListenWithDB listens for replication events with schema validation support
 func (r *Replicator) ListenWithDB(shardID uint64, streamDB *db.SqliteStreamDB, callback func(event *db.ChangeLogEvent) error) error {
 	js := r.streamMap[shardID]
+	strName := streamName(shardID, r.compressionEnabled)
 
 	sub, err := js.SubscribeSync(subjectName(shardID))
 	if err != nil {
 		return err
 	}
-	defer sub.Unsubscribe()
+	defer func() {
+		sub.Unsubscribe()
+	}()
 
-	savedSeq := r.repState.get(streamName(shardID, r.compressionEnabled))
+	resubscribes := r.resubscribes.Load()
+	savedSeq := r.repState.get(strName)
+	r.progress.resumed(shardID, savedSeq)
 	for sub.IsValid() {
 		msg, err := sub.NextMsg(5 * time.Second)
-		if errors.Is(err, nats.ErrTimeout) {
-			continue
-		}
-
-		if err != nil {
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
 			return err
 		}
 
-		meta, err := msg.Metadata()
-		if err != nil {
-			return err
+		// Hold the message while replication is paused by an operator
+		r.replicationGate.wait()
+
+		r.applyLock.RLock()
+		if resubscribes != r.resubscribes.Load() {
+			r.applyLock.RUnlock()
+
+			// An online restore or skip moved the applied sequence, replay events from there
+			sub.Unsubscribe()
+			resubscribes = r.resubscribes.Load()
+			savedSeq = r.progress.snapshot(shardID).appliedSeq
+			sub, err = js.SubscribeSync(subjectName(shardID), nats.StartSequence(savedSeq+1))
+			if err != nil {
+				return err
+			}
+
+			log.Info().Str("stream", strName).Uint64("seq", savedSeq).Msg("Resubscribed after applied sequence")
+			continue
 		}
 
-		if meta.Sequence.Stream <= savedSeq {
+		if msg == nil {
+			r.applyLock.RUnlock()
 			continue
 		}
 
-		err = r.invokeListenerWithSchemaValidation(streamDB, callback, msg)
+		savedSeq, err = r.applyMessage(shardID, streamDB, callback, msg, savedSeq)
+		r.applyLock.RUnlock()
 		if err != nil {
-			msg.Nak()
 			if errors.Is(err, context.Canceled) {
 				return nil
 			}
 
-			log.Error().Err(err).Msg("Replication failed, terminating...")
 			return err
 		}
+	}
 
-		savedSeq, err = r.repState.save(meta.Stream, meta.Sequence.Stream)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		err = msg.Ack()
-		if err != nil {
-			return err
+// applyMessage applies a message after savedSeq and acknowledges it, returning the new saved sequence
+func (r *Replicator) applyMessage(shardID uint64, streamDB *db.SqliteStreamDB, callback func(event *db.ChangeLogEvent) error, msg *nats.Msg, savedSeq uint64) (uint64, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return savedSeq, err
+	}
+
+	if meta.Sequence.Stream <= savedSeq {
+		return savedSeq, nil
+	}
+
+	// Continue the trace of the publishing node
+	ctx, span := telemetry.StartSpan(telemetry.ExtractHeader(context.Background(), msg.Header), "stream.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", msg.Subject),
+			attribute.Int64("harmonylite.shard", int64(shardID)),
+			attribute.Int64("harmonylite.stream.sequence", int64(meta.Sequence.Stream)),
+			attribute.Int64("harmonylite.stream.wait_ms", time.Since(meta.Timestamp).Milliseconds()),
+		))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	r.metrics.received(shardID, meta)
+	start := time.Now()
+	event, err := r.invokeListenerWithSchemaValidation(ctx, streamDB, callback, msg)
+	if err != nil {
+		msg.Nak()
+		r.metrics.nak(nakApplyError)
+		if !errors.Is(err, context.Canceled) {
+			log.Error().Err(err).Msg("Replication failed, terminating...")
 		}
+
+		return savedSeq, err
 	}
 
-	return nil
+	if event != nil {
+		r.metrics.applied(shardID, start, event)
+	}
+
+	savedSeq, err = r.repState.save(meta.Stream, meta.Sequence.Stream)
+	if err != nil {
+		return savedSeq, err
+	}
+
+	r.progress.applied(shardID, savedSeq, meta.Timestamp)
+	return savedSeq, msg.Ack()
 }
 
-// invokeListenerWithSchemaValidation unpacks the event, validates schema, and invokes the callback
-func (r *Replicator) invokeListenerWithSchemaValidation(streamDB *db.SqliteStreamDB, callback func(event *db.ChangeLogEvent) error, msg *nats.Msg) error {
+// invokeListenerWithSchemaValidation unpacks the event, validates schema, and invokes the callback.
+// It returns the applied event, nil when the event was NAK'd after a schema mismatch.
+func (r *Replicator) invokeListenerWithSchemaValidation(ctx context.Context, streamDB *db.SqliteStreamDB, callback func(event *db.ChangeLogEvent) error, msg *nats.Msg) (*db.ChangeLogEvent, error) {
 	var err error
 	payload := msg.Data
 
 	if r.compressionEnabled {
 		payload, err = payloadDecompress(msg.Data)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -81,19 +140,20 @@ func (r *Replicator) invokeListenerWithSchemaValidation(streamDB *db.SqliteStrea
 	ev := &ReplicationEvent[db.ChangeLogEvent]{}
 	err = ev.Unmarshal(payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Validate schema hash
-	shouldRetry, err := r.ValidateAndReplicateWithSchema(&ev.Payload, streamDB, msg)
+	shouldRetry, err := r.ValidateAndReplicateWithSchema(ctx, &ev.Payload, streamDB, msg)
 	if shouldRetry {
 		// Schema mismatch - message was NAK'd, will be redelivered
-		return nil
+		trace.SpanFromContext(ctx).AddEvent("schema mismatch, redelivery delayed")
+		return nil, nil
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Call the user callback (for any additional processing)
-	return callback(&ev.Payload)
+	return &ev.Payload, callback(&ev.Payload)
 }
@@ -0,0 +1,95 @@
+package logstream
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/telemetry"
+)
+
+// NAK reasons, the only values of the reason label
+const (
+	nakSchemaMismatch = "schema_mismatch"
+	nakApplyError     = "apply_error"
+)
+
+// Snapshot operations, the only values of the operation label
+const (
+	snapshotSave    = "save"
+	snapshotRestore = "restore"
+)
+
+// latencyBuckets cover a round trip to NATS or a write to the database, in seconds
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// delayBuckets cover the time from a change being logged to it being applied on another
+// node, which includes publish intervals and replication pauses, in seconds
+var delayBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600}
+
+// snapshotBuckets cover saving or restoring a snapshot, in seconds
+var snapshotBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// replicatorMetrics are the latency and retry metrics of the replication pipeline. Labels are
+// limited to shard IDs and fixed sets of values to bound cardinality.
+type replicatorMetrics struct {
+	publishLatency   telemetry.HistogramVec
+	applyLatency     telemetry.HistogramVec
+	replicationDelay telemetry.HistogramVec
+	redeliveries     telemetry.CounterVec
+	naks             telemetry.CounterVec
+	snapshotDuration telemetry.HistogramVec
+	snapshotAge      telemetry.Gauge
+}
+
+func newReplicatorMetrics() *replicatorMetrics {
+	shard := []string{"shard"}
+	return &replicatorMetrics{
+		publishLatency: telemetry.NewHistogramVec("publish_latency_seconds",
+			"Time to publish an event and receive the stream acknowledgement", latencyBuckets, shard),
+		applyLatency: telemetry.NewHistogramVec("apply_latency_seconds",
+			"Time to apply a received event to the database", latencyBuckets, shard),
+		replicationDelay: telemetry.NewHistogramVec("replication_delay_seconds",
+			"Time from a change being logged on the publishing node to it being applied on this node", delayBuckets, shard),
+		redeliveries: telemetry.NewCounterVec("redeliveries_total",
+			"Stream messages received again after a NAK or an acknowledgement timeout", shard),
+		naks: telemetry.NewCounterVec("naks_total",
+			"Stream messages NAK'd by this node for redelivery", []string{"reason"}),
+		snapshotDuration: telemetry.NewHistogramVec("snapshot_duration_seconds",
+			"Time to save or restore a snapshot", snapshotBuckets, []string{"operation"}),
+		snapshotAge: telemetry.NewGauge("snapshot_age_seconds",
+			"Time since this node last saved a snapshot"),
+	}
+}
+
+// received records a message about to be applied, counting it when it was delivered before
+func (m *replicatorMetrics) received(shard uint64, meta *nats.MsgMetadata) {
+	if meta.NumDelivered > 1 {
+		m.redeliveries.WithLabelValues(strconv.FormatUint(shard, 10)).Inc()
+	}
+}
+
+// applied records the time taken to apply event since start, and since it was logged
+func (m *replicatorMetrics) applied(shard uint64, start time.Time, event *db.ChangeLogEvent) {
+	label := strconv.FormatUint(shard, 10)
+	m.applyLatency.WithLabelValues(label).Observe(time.Since(start).Seconds())
+
+	// Events published by older nodes carry no creation time
+	if event.CreatedAt > 0 {
+		delay := time.Since(time.UnixMilli(event.CreatedAt))
+		m.replicationDelay.WithLabelValues(label).Observe(max(delay, 0).Seconds())
+	}
+}
+
+func (m *replicatorMetrics) published(shard uint64, start time.Time) {
+	m.publishLatency.WithLabelValues(strconv.FormatUint(shard, 10)).Observe(time.Since(start).Seconds())
+}
+
+func (m *replicatorMetrics) nak(reason string) {
+	m.naks.WithLabelValues(reason).Inc()
+}
+
+func (m *replicatorMetrics) snapshotTook(operation string, start time.Time) {
+	m.snapshotDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
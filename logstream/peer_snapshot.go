@@ -0,0 +1,584 @@
+package logstream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/snapshot"
+)
+
+var ErrNoPeerSnapshot = errors.New("no peer available to serve a snapshot")
+var ErrPeerBusy = errors.New("peer busy serving other snapshots")
+var ErrPeerPlaintext = errors.New("peer snapshots need snapshot.encryption, or snapshot.peer.allow_plaintext to transfer them unencrypted")
+
+// PeerStatusWait is how long replies from peers are collected before picking one to transfer from
+var PeerStatusWait = 2 * time.Second
+
+const peerErrorHeader = "Harmonylite-Error"
+const maxPeerTransfers = 2
+const peerBackupTimeoutFactor = 10
+const maxPeerChunkRetries = 3
+
+// PeerSnapshotStatus is returned by peers willing to serve a snapshot
+type PeerSnapshotStatus struct {
+	NodeId     uint64            `json:"node_id"`
+	SchemaHash string            `json:"schema_hash"`
+	Sequences  map[string]uint64 `json:"sequences"`
+}
+
+// PeerSnapshotOffer describes a snapshot captured by a peer, ready to be transferred in chunks.
+// Encrypted snapshots are sealed with the snapshot encryption keys, Size is the sealed size.
+type PeerSnapshotOffer struct {
+	TransferID string             `json:"transfer_id"`
+	Size       int64              `json:"size"`
+	ChunkSize  int                `json:"chunk_size"`
+	Encrypted  bool               `json:"encrypted,omitempty"`
+	Manifest   *snapshot.Manifest `json:"manifest,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// PeerChunkRequest asks a peer for the chunk of a transfer starting at Offset
+type PeerChunkRequest struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+}
+
+// snapshotSource captures snapshots served to peers
+type snapshotSource interface {
+	BackupTo(bkFilePath string) error
+	GetSchemaHash() string
+}
+
+type peerTransfer struct {
+	dir   string
+	path  string
+	timer *time.Timer
+}
+
+type peerSnapshotServer struct {
+	mu        sync.Mutex
+	transfers map[string]*peerTransfer
+	source    snapshotSource
+	repState  *replicationState
+	cipher    *snapshot.Cipher
+	nodeID    uint64
+	chunkSize int
+}
+
+// ServePeerSnapshots lets lagging or new nodes fetch a fresh snapshot of source from this node.
+// Snapshots are captured on demand and transferred in chunks over NATS request/reply, any
+// client on the subjects can request one so they are encrypted with the snapshot keys.
+func (r *Replicator) ServePeerSnapshots(source snapshotSource) error {
+	cipher, err := peerCipher()
+	if err != nil {
+		return err
+	}
+
+	// Chunks must fit in a single message along with headers
+	chunkSize := cfg.Config.Snapshot.Peer.ChunkSize
+	if limit := int(r.client.MaxPayload()) - 1024; chunkSize < 1 || chunkSize > limit {
+		chunkSize = limit
+	}
+
+	s := &peerSnapshotServer{
+		transfers: map[string]*peerTransfer{},
+		source:    source,
+		repState:  r.repState,
+		cipher:    cipher,
+		nodeID:    r.nodeID,
+		chunkSize: chunkSize,
+	}
+
+	handlers := map[string]nats.MsgHandler{
+		peerSubject("status"):              s.handleStatus,
+		peerNodeSubject(r.nodeID, "begin"): s.handleBegin,
+		peerNodeSubject(r.nodeID, "chunk"): s.handleChunk,
+		peerNodeSubject(r.nodeID, "end"):   s.handleEnd,
+	}
+
+	for subject, handler := range handlers {
+		if _, err := r.client.Subscribe(subject, handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *peerSnapshotServer) handleStatus(msg *nats.Msg) {
+	payload, err := json.Marshal(&PeerSnapshotStatus{
+		NodeId:     s.nodeID,
+		SchemaHash: s.source.GetSchemaHash(),
+		Sequences:  s.repState.all(),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode peer snapshot status")
+		return
+	}
+
+	if err := msg.Respond(payload); err != nil {
+		log.Warn().Err(err).Msg("Unable to respond to peer snapshot status request")
+	}
+}
+
+func (s *peerSnapshotServer) handleBegin(msg *nats.Msg) {
+	offer, err := s.begin()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to capture snapshot for peer")
+		offer = &PeerSnapshotOffer{Error: err.Error()}
+	}
+
+	payload, err := json.Marshal(offer)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode peer snapshot offer")
+		return
+	}
+
+	if err := msg.Respond(payload); err != nil {
+		log.Warn().Err(err).Msg("Unable to respond to peer snapshot request")
+	}
+}
+
+func (s *peerSnapshotServer) begin() (*PeerSnapshotOffer, error) {
+	s.mu.Lock()
+	busy := len(s.transfers) >= maxPeerTransfers
+	s.mu.Unlock()
+	if busy {
+		return nil, ErrPeerBusy
+	}
+
+	dir, err := os.MkdirTemp(os.TempDir(), "harmonylite-peer-snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Sequences are what the listeners applied before the backup starts, events published by
+	// this node don't move them, so the snapshot contains at least every event they cover
+	now := time.Now().UTC()
+	manifest := &snapshot.Manifest{
+		ID:         fmt.Sprintf("peer-%d-%d", s.nodeID, now.UnixNano()),
+		NodeID:     s.nodeID,
+		SchemaHash: s.source.GetSchemaHash(),
+		CreatedAt:  now,
+		Sequences:  s.repState.all(),
+	}
+
+	p := filepath.Join(dir, "snapshot.db")
+	err = s.source.BackupTo(p)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	size, digest, err := hashFile(p)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	manifest.SHA256 = digest
+
+	if s.cipher != nil {
+		p, size, err = s.seal(p)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	t := &peerTransfer{dir: dir, path: p}
+	s.mu.Lock()
+	s.transfers[manifest.ID] = t
+	t.timer = time.AfterFunc(peerTransferTTL(), func() {
+		log.Warn().Str("transfer_id", manifest.ID).Msg("Peer snapshot transfer expired")
+		s.remove(manifest.ID)
+	})
+	s.mu.Unlock()
+
+	log.Info().
+		Str("transfer_id", manifest.ID).
+		Int64("size", size).
+		Msg("Snapshot captured for peer")
+
+	return &PeerSnapshotOffer{
+		TransferID: manifest.ID,
+		Size:       size,
+		ChunkSize:  s.chunkSize,
+		Encrypted:  s.cipher != nil,
+		Manifest:   manifest,
+	}, nil
+}
+
+// seal encrypts the snapshot at p, returning the path and size of the encrypted copy
+func (s *peerSnapshotServer) seal(p string) (string, int64, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	sealed := p + ".enc"
+	dst, err := os.Create(sealed)
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+
+	if err := s.cipher.Encrypt(dst, src); err != nil {
+		return "", 0, err
+	}
+
+	info, err := dst.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+
+	return sealed, info.Size(), os.Remove(p)
+}
+
+func (s *peerSnapshotServer) handleChunk(msg *nats.Msg) {
+	data, err := s.chunk(msg.Data)
+	res := nats.NewMsg(msg.Reply)
+	if err != nil {
+		res.Header.Set(peerErrorHeader, err.Error())
+	} else {
+		res.Data = data
+	}
+
+	if err := msg.RespondMsg(res); err != nil {
+		log.Warn().Err(err).Msg("Unable to respond to peer snapshot chunk request")
+	}
+}
+
+func (s *peerSnapshotServer) chunk(payload []byte) ([]byte, error) {
+	req := &PeerChunkRequest{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		return nil, fmt.Errorf("invalid chunk request: %w", err)
+	}
+
+	s.mu.Lock()
+	t, ok := s.transfers[req.TransferID]
+	if ok {
+		t.timer.Reset(peerTransferTTL())
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transfer %s", req.TransferID)
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, s.chunkSize)
+	n, err := f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func (s *peerSnapshotServer) handleEnd(msg *nats.Msg) {
+	s.remove(string(msg.Data))
+}
+
+func (s *peerSnapshotServer) remove(id string) {
+	s.mu.Lock()
+	t, ok := s.transfers[id]
+	delete(s.transfers, id)
+	s.mu.Unlock()
+
+	if ok {
+		t.timer.Stop()
+		if err := os.RemoveAll(t.dir); err != nil {
+			log.Warn().Err(err).Str("path", t.dir).Msg("Unable to cleanup peer snapshot")
+		}
+	}
+}
+
+// RestoreFromPeer replaces the database with a snapshot fetched from the most up to date peer
+// and sets the replication watermark from it. Returns ErrNoPeerSnapshot when no peer can serve one.
+func (r *Replicator) RestoreFromPeer() error {
+	return r.restoreFromPeer(false)
+}
+
+func (r *Replicator) restoreFromPeer(bootstrap bool) error {
+	dir, err := os.MkdirTemp(os.TempDir(), "harmonylite-peer-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cipher, err := peerCipher()
+	if err != nil {
+		return err
+	}
+
+	statuses, err := r.peerStatuses()
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(dir, "snapshot.db")
+	for _, status := range statuses {
+		manifest, err := r.fetchPeerSnapshot(status.NodeId, p, cipher)
+		if err != nil {
+			log.Warn().Err(err).Uint64("peer", status.NodeId).Msg("Unable to fetch snapshot from peer")
+			continue
+		}
+
+		// Another peer might have applied more of the stream
+		if err := r.checkSnapshotWatermark(manifest); err != nil {
+			log.Warn().Err(err).Uint64("peer", status.NodeId).Msg("Peer snapshot is too old")
+			continue
+		}
+
+		if bootstrap {
+			err = r.snapshot.BootstrapFile(p, manifest)
+		} else {
+			err = r.snapshot.RestoreFile(p, manifest)
+		}
+		if err != nil {
+			return err
+		}
+
+		return r.applySnapshotWatermark(manifest)
+	}
+
+	return ErrNoPeerSnapshot
+}
+
+// peerStatuses collects statuses of peers serving snapshots, most up to date first
+func (r *Replicator) peerStatuses() ([]*PeerSnapshotStatus, error) {
+	inbox := nats.NewInbox()
+	sub, err := r.client.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	err = r.client.PublishRequest(peerSubject("status"), inbox, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*PeerSnapshotStatus, 0)
+	deadline := time.Now().Add(PeerStatusWait)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err == nats.ErrTimeout || err == nats.ErrNoResponders {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		status := &PeerSnapshotStatus{}
+		if err := json.Unmarshal(msg.Data, status); err != nil {
+			log.Warn().Err(err).Msg("Ignoring invalid peer snapshot status")
+			continue
+		}
+
+		if status.NodeId != r.nodeID {
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return sumSequences(statuses[i].Sequences) > sumSequences(statuses[j].Sequences)
+	})
+
+	return statuses, nil
+}
+
+// fetchPeerSnapshot asks nodeID to capture a snapshot and downloads it to p, decrypting it
+// with cipher unless transfers are allowed in plaintext
+func (r *Replicator) fetchPeerSnapshot(nodeID uint64, p string, cipher *snapshot.Cipher) (*snapshot.Manifest, error) {
+	timeout := time.Duration(cfg.Config.Snapshot.Peer.Timeout) * time.Millisecond
+	log.Info().Uint64("peer", nodeID).Msg("Requesting snapshot from peer")
+	msg, err := r.client.Request(peerNodeSubject(nodeID, "begin"), nil, timeout*peerBackupTimeoutFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	offer := &PeerSnapshotOffer{}
+	if err := json.Unmarshal(msg.Data, offer); err != nil {
+		return nil, err
+	}
+
+	if offer.Error != "" {
+		return nil, fmt.Errorf("%s", offer.Error)
+	}
+
+	if offer.Manifest == nil || offer.ChunkSize < 1 {
+		return nil, fmt.Errorf("invalid snapshot offer from peer %d", nodeID)
+	}
+	defer r.client.Publish(peerNodeSubject(nodeID, "end"), []byte(offer.TransferID))
+
+	if offer.Encrypted && cipher == nil {
+		return nil, fmt.Errorf("peer %d sends encrypted snapshots, configure snapshot.encryption with its keys", nodeID)
+	}
+
+	if !offer.Encrypted && cipher != nil {
+		return nil, fmt.Errorf("peer %d sends unencrypted snapshots: %w", nodeID, ErrPeerPlaintext)
+	}
+
+	download := p
+	if offer.Encrypted {
+		download = p + ".enc"
+		defer os.Remove(download)
+	}
+
+	f, err := os.Create(download)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	for offset := int64(0); offset < offer.Size; {
+		data, err := r.fetchPeerChunk(nodeID, &PeerChunkRequest{TransferID: offer.TransferID, Offset: offset}, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%w: transfer ended at %d of %d bytes", snapshot.ErrCorruptSnapshot, offset, offer.Size)
+		}
+
+		if _, err := f.Write(data); err != nil {
+			return nil, err
+		}
+
+		offset += int64(len(data))
+	}
+
+	log.Info().
+		Uint64("peer", nodeID).
+		Int64("size", offer.Size).
+		Str("transfer_id", offer.TransferID).
+		Msg("Snapshot downloaded from peer")
+
+	if offer.Encrypted {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return offer.Manifest, decryptFile(cipher, p, f)
+	}
+
+	return offer.Manifest, f.Sync()
+}
+
+func decryptFile(cipher *snapshot.Cipher, p string, src io.Reader) error {
+	dst, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := cipher.Decrypt(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
+
+func (r *Replicator) fetchPeerChunk(nodeID uint64, req *PeerChunkRequest, timeout time.Duration) ([]byte, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		msg, err := r.client.Request(peerNodeSubject(nodeID, "chunk"), payload, timeout)
+		if err == nil {
+			if e := msg.Header.Get(peerErrorHeader); e != "" {
+				return nil, fmt.Errorf("%s", e)
+			}
+
+			return msg.Data, nil
+		}
+
+		if attempt >= maxPeerChunkRetries {
+			return nil, err
+		}
+
+		log.Warn().Err(err).Int64("offset", req.Offset).Int("attempt", attempt).Msg("Retrying snapshot chunk")
+	}
+}
+
+func hashFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sumSequences(sequences map[string]uint64) uint64 {
+	sum := uint64(0)
+	for _, seq := range sequences {
+		sum += seq
+	}
+
+	return sum
+}
+
+// peerCipher returns the cipher protecting peer snapshots, nil when they are transferred in
+// plaintext which is only allowed with snapshot.peer.allow_plaintext
+func peerCipher() (*snapshot.Cipher, error) {
+	if cfg.Config.Snapshot.Encryption.Enable {
+		return snapshot.NewCipher()
+	}
+
+	if !cfg.Config.Snapshot.Peer.AllowPlaintext {
+		return nil, ErrPeerPlaintext
+	}
+
+	return nil, nil
+}
+
+func peerTransferTTL() time.Duration {
+	return time.Duration(cfg.Config.Snapshot.Peer.Timeout) * time.Millisecond * peerBackupTimeoutFactor
+}
+
+func peerSubject(op string) string {
+	return fmt.Sprintf("%s-snapshot-peer.%s", cfg.Config.NATS.SubjectPrefix, op)
+}
+
+func peerNodeSubject(nodeID uint64, op string) string {
+	return peerSubject(strconv.FormatUint(nodeID, 10) + "." + op)
+}
+
+func ignoreNoPeerSnapshot(err error) error {
+	if err == ErrNoPeerSnapshot {
+		log.Warn().Err(err).Msg("System will now continue without restoring snapshot")
+		return nil
+	}
+
+	return err
+}
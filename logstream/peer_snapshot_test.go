@@ -0,0 +1,196 @@
+package logstream
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/snapshot"
+)
+
+// openPeerTestDB creates a database with an items table holding rows entries
+func openPeerTestDB(t *testing.T, name string, rows int) *db.SqliteStreamDB {
+	p := filepath.Join(t.TempDir(), name)
+	raw, err := sql.Open("sqlite3", p)
+	require.NoError(t, err)
+	_, err = raw.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+	for i := 0; i < rows; i++ {
+		_, err = raw.Exec("INSERT INTO items (name) VALUES (?)", fmt.Sprintf("item-%d", i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, raw.Close())
+
+	streamDB, err := db.OpenStreamDB(p)
+	require.NoError(t, err)
+	return streamDB
+}
+
+func newPeerTestReplicator(t *testing.T, nc *nats.Conn, nodeID uint64, snap snapshot.NatsSnapshot) *Replicator {
+	original := cfg.Config.SeqMapPath
+	defer func() {
+		cfg.Config.SeqMapPath = original
+	}()
+	cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+
+	repState := &replicationState{}
+	require.NoError(t, repState.init())
+	t.Cleanup(func() {
+		repState.fl.Close()
+	})
+
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	_, err = js.AddStream(makeShardStreamConfig(1, 1, false))
+	if err != nil {
+		require.ErrorIs(t, err, nats.ErrStreamNameAlreadyInUse)
+	}
+
+	return &Replicator{
+		client:    nc,
+		nodeID:    nodeID,
+		repState:  repState,
+		snapshot:  snap,
+		streamMap: map[uint64]nats.JetStreamContext{1: js},
+		progress:  newShardProgress(),
+	}
+}
+
+func TestReplicator_RestoreFromPeer(t *testing.T) {
+	originalWait := PeerStatusWait
+	originalPeer := cfg.Config.Snapshot.Peer
+	defer func() {
+		PeerStatusWait = originalWait
+		cfg.Config.Snapshot.Peer = originalPeer
+	}()
+	PeerStatusWait = 200 * time.Millisecond
+	cfg.Config.Snapshot.Peer.ChunkSize = 1024
+	cfg.Config.Snapshot.Peer.AllowPlaintext = true
+
+	t.Run("transfers snapshot in chunks", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		source := openPeerTestDB(t, "source.db", 50)
+		server := newPeerTestReplicator(t, nc, 1, nil)
+		_, err := server.repState.save(streamName(1, false), 42)
+		require.NoError(t, err)
+		require.NoError(t, server.ServePeerSnapshots(source))
+
+		target := openPeerTestDB(t, "target.db", 0)
+		client := newPeerTestReplicator(t, nc, 2, snapshot.NewNatsDBSnapshot(target, nil))
+		require.NoError(t, client.RestoreFromPeer())
+
+		raw, err := sql.Open("sqlite3", target.GetPath())
+		require.NoError(t, err)
+		defer raw.Close()
+		count := 0
+		require.NoError(t, raw.QueryRow("SELECT COUNT(*) FROM items").Scan(&count))
+		assert.Equal(t, 50, count)
+		assert.Equal(t, uint64(42), client.repState.get(streamName(1, false)))
+		assert.Equal(t, uint64(42), client.progress.snapshot(1).appliedSeq)
+	})
+
+	t.Run("picks the most up to date peer", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		behind := newPeerTestReplicator(t, nc, 1, nil)
+		_, err := behind.repState.save(streamName(1, false), 10)
+		require.NoError(t, err)
+		require.NoError(t, behind.ServePeerSnapshots(openPeerTestDB(t, "behind.db", 1)))
+
+		ahead := newPeerTestReplicator(t, nc, 3, nil)
+		_, err = ahead.repState.save(streamName(1, false), 20)
+		require.NoError(t, err)
+		require.NoError(t, ahead.ServePeerSnapshots(openPeerTestDB(t, "ahead.db", 2)))
+
+		client := newPeerTestReplicator(t, nc, 2, nil)
+		statuses, err := client.peerStatuses()
+		require.NoError(t, err)
+		require.Len(t, statuses, 2)
+		assert.Equal(t, uint64(3), statuses[0].NodeId)
+		assert.Equal(t, uint64(1), statuses[1].NodeId)
+	})
+
+	t.Run("encrypted with snapshot keys", func(t *testing.T) {
+		originalEncryption := cfg.Config.Snapshot.Encryption
+		defer func() {
+			cfg.Config.Snapshot.Encryption = originalEncryption
+			cfg.Config.Snapshot.Peer.AllowPlaintext = true
+		}()
+
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		t.Setenv("TEST_PEER_SNAPSHOT_KEYS", base64.StdEncoding.EncodeToString(key))
+		cfg.Config.Snapshot.Encryption = cfg.SnapshotEncryptionConfiguration{Enable: true, KeyEnv: "TEST_PEER_SNAPSHOT_KEYS"}
+		cfg.Config.Snapshot.Peer.AllowPlaintext = false
+
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		server := newPeerTestReplicator(t, nc, 1, nil)
+		require.NoError(t, server.ServePeerSnapshots(openPeerTestDB(t, "source.db", 20)))
+
+		// Chunks requested by any NATS client are sealed
+		msg, err := nc.Request(peerNodeSubject(1, "begin"), nil, 5*time.Second)
+		require.NoError(t, err)
+		offer := &PeerSnapshotOffer{}
+		require.NoError(t, json.Unmarshal(msg.Data, offer))
+		assert.True(t, offer.Encrypted)
+		chunk, err := server.fetchPeerChunk(1, &PeerChunkRequest{TransferID: offer.TransferID}, 5*time.Second)
+		require.NoError(t, err)
+		assert.NotContains(t, string(chunk), "SQLite format 3")
+		require.NoError(t, nc.Publish(peerNodeSubject(1, "end"), []byte(offer.TransferID)))
+
+		target := openPeerTestDB(t, "target.db", 0)
+		client := newPeerTestReplicator(t, nc, 2, snapshot.NewNatsDBSnapshot(target, nil))
+		require.NoError(t, client.RestoreFromPeer())
+
+		raw, err := sql.Open("sqlite3", target.GetPath())
+		require.NoError(t, err)
+		defer raw.Close()
+		count := 0
+		require.NoError(t, raw.QueryRow("SELECT COUNT(*) FROM items").Scan(&count))
+		assert.Equal(t, 20, count)
+	})
+
+	t.Run("plaintext needs opt-in", func(t *testing.T) {
+		defer func() {
+			cfg.Config.Snapshot.Peer.AllowPlaintext = true
+		}()
+		cfg.Config.Snapshot.Peer.AllowPlaintext = false
+
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		r := newPeerTestReplicator(t, nc, 1, nil)
+		assert.ErrorIs(t, r.ServePeerSnapshots(openPeerTestDB(t, "source.db", 1)), ErrPeerPlaintext)
+		assert.ErrorIs(t, r.RestoreFromPeer(), ErrPeerPlaintext)
+	})
+
+	t.Run("no peers", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		target := openPeerTestDB(t, "target.db", 0)
+		client := newPeerTestReplicator(t, nc, 2, snapshot.NewNatsDBSnapshot(target, nil))
+		assert.ErrorIs(t, client.RestoreFromPeer(), ErrNoPeerSnapshot)
+	})
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/wongfei2009/harmonylite/core"
+	"github.com/wongfei2009/harmonylite/db"
 )
 
 // MockEvent implements the core.ReplicableEvent interface for testing
@@ -507,3 +508,33 @@ func TestMarshalPerformance(t *testing.T) {
 			iterations, elapsed, float64(elapsed.Microseconds())/float64(iterations))
 	})
 }
+
+func TestReplicationEvent_ChangeLogEventCreatedAt(t *testing.T) {
+	createdAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	event := ReplicationEvent[db.ChangeLogEvent]{
+		FromNodeId: 1,
+		Payload: db.ChangeLogEvent{
+			Id:        1,
+			Type:      "insert",
+			TableName: "users",
+			// Time values take the wrapping path of the payload
+			Row:       map[string]any{"id": int64(1), "updated_at": createdAt},
+			CreatedAt: createdAt.UnixMilli(),
+		},
+	}
+
+	data, err := event.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var unmarshaled ReplicationEvent[db.ChangeLogEvent]
+	err = unmarshaled.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if unmarshaled.Payload.CreatedAt != createdAt.UnixMilli() {
+		t.Errorf("Expected CreatedAt %d, got %d", createdAt.UnixMilli(), unmarshaled.Payload.CreatedAt)
+	}
+}
@@ -81,3 +81,65 @@ func (r *replicationState) get(streamName string) uint64 {
 
 	return 0
 }
+
+// all returns a copy of every saved stream sequence
+func (r *replicationState) all() map[string]uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	seq := make(map[string]uint64, len(r.seq))
+	for name, s := range r.seq {
+		seq[name] = s
+	}
+
+	return seq
+}
+
+// reset overwrites the saved sequence of each given stream, even when it moves backwards
+func (r *replicationState) reset(seq map[string]uint64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.fl == nil {
+		return ErrNotInitialized
+	}
+
+	for name, s := range seq {
+		r.seq[name] = s
+	}
+
+	if err := r.fl.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := r.fl.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	defer r.fl.Sync()
+
+	return cbor.NewEncoder(r.fl).Encode(r.seq)
+}
+
+// ResetReplicationState overwrites the persisted sequence of each given stream, for
+// databases restored while HarmonyLite isn't running
+func ResetReplicationState(seq map[string]uint64) error {
+	r := &replicationState{}
+	if err := r.init(); err != nil {
+		return err
+	}
+	defer r.fl.Close()
+
+	return r.reset(seq)
+}
+
+// LoadReplicationState returns the persisted sequence of every stream, for inspecting the
+// watermark while HarmonyLite isn't running
+func LoadReplicationState() (map[string]uint64, error) {
+	r := &replicationState{}
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+	defer r.fl.Close()
+
+	return r.all(), nil
+}
@@ -302,3 +302,66 @@ func TestReplicationState_Get(t *testing.T) {
 		assert.Equal(t, uint64(0), state.get("nonexistent"))
 	})
 }
+
+func TestReplicationState_Reset(t *testing.T) {
+	// Backup original path
+	originalPath := cfg.Config.SeqMapPath
+	defer func() {
+		cfg.Config.SeqMapPath = originalPath
+	}()
+
+	t.Run("ResetWithUninitializedState", func(t *testing.T) {
+		state := &replicationState{
+			seq:  make(map[string]uint64),
+			lock: &sync.RWMutex{},
+		}
+
+		err := state.reset(map[string]uint64{"stream1": 10})
+		assert.Equal(t, ErrNotInitialized, err)
+	})
+
+	t.Run("ResetMovesSequenceBackwards", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "replication-state-test-reset")
+		assert.NoError(t, err)
+		defer os.RemoveAll(tempDir)
+
+		cfg.Config.SeqMapPath = filepath.Join(tempDir, "seq-map.cbor")
+
+		state := &replicationState{}
+		err = state.init()
+		assert.NoError(t, err)
+
+		_, err = state.save("stream1", 100)
+		assert.NoError(t, err)
+		_, err = state.save("stream2", 200)
+		assert.NoError(t, err)
+
+		err = state.reset(map[string]uint64{"stream1": 5})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(5), state.get("stream1"))
+		assert.Equal(t, uint64(200), state.get("stream2"))
+		state.fl.Close()
+
+		// Verify the lowered sequence was persisted
+		newState := &replicationState{}
+		err = newState.init()
+		assert.NoError(t, err)
+		defer newState.fl.Close()
+
+		assert.Equal(t, uint64(5), newState.get("stream1"))
+		assert.Equal(t, uint64(200), newState.get("stream2"))
+	})
+	t.Run("ResetReplicationStateOffline", func(t *testing.T) {
+		cfg.Config.SeqMapPath = filepath.Join(t.TempDir(), "seq-map.cbor")
+
+		err := ResetReplicationState(map[string]uint64{"stream1": 42})
+		assert.NoError(t, err)
+
+		state := &replicationState{}
+		err = state.init()
+		assert.NoError(t, err)
+		defer state.fl.Close()
+
+		assert.Equal(t, uint64(42), state.get("stream1"))
+	})
+}
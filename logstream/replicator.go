@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wongfei2009/harmonylite/stream"
@@ -15,18 +16,28 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/wongfei2009/harmonylite/cfg"
 	"github.com/wongfei2009/harmonylite/snapshot"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const maxReplicateRetries = 7
-const SnapshotShardID = uint64(1)
 
 var SnapshotLeaseTTL = 10 * time.Second
 
+var ErrNoSnapshotStorage = errors.New("snapshot storage not configured")
+var ErrOfflineRestore = errors.New("online restore requires snapshot.restore_mode = \"online\"")
+var ErrRestoreInProgress = errors.New("restore already in progress")
+var ErrSnapshotTooOld = errors.New("snapshot is older than the retained stream")
+
 type Replicator struct {
 	nodeID             uint64
 	shards             uint64
 	compressionEnabled bool
-	lastSnapshot       time.Time
+
+	// Time and replication state of the last snapshot saved by this node
+	snapshotMu   sync.Mutex
+	lastSnapshot time.Time
+	snapshotSeqs map[string]uint64
 
 	client         *nats.Conn
 	repState       *replicationState
@@ -35,6 +46,10 @@ type Replicator struct {
 	streamMap      map[uint64]nats.JetStreamContext
 	snapshotLeader *SnapshotLeader
 
+	// Sequences and times last applied and published by this node per shard
+	progress *shardProgress
+	metrics  *replicatorMetrics
+
 	// Schema mismatch tracking
 	schemaMismatchAt     time.Time
 	lastRecomputeAt      time.Time
@@ -43,6 +58,25 @@ type Replicator struct {
 
 	// Schema registry for cluster-wide visibility
 	schemaRegistry *SchemaRegistry
+
+	// Hashes accepted through the schema compatibility window, cached per local hash
+	compatMu        sync.Mutex
+	compatLocalHash string
+	compatHashes    map[string]struct{}
+
+	// Held by listeners while applying events, exclusively by online restores and head skips.
+	// Listeners resubscribe from the saved watermark when the resubscribe count changes.
+	applyLock    sync.RWMutex
+	resubscribes atomic.Uint64
+	restoring    atomic.Bool
+
+	// Replication paused on this node by an operator
+	replicationGate pauseGate
+
+	// Cluster-wide publishing pause (e.g. during coordinated migrations) and local pause
+	publishPaused   atomic.Bool
+	publishHeld     atomic.Bool
+	onPublishResume func()
 }
 
 func NewReplicator(
@@ -61,7 +95,7 @@ func NewReplicator(
 	streamMap := map[uint64]nats.JetStreamContext{}
 	for i := uint64(0); i < shards; i++ {
 		shard := i + 1
-		js, err := nc.JetStream()
+		js, err := nc.JetStream(stream.JetStreamOptions()...)
 		if err != nil {
 			return nil, err
 		}
@@ -163,11 +197,10 @@ func NewReplicator(
 		schemaRegistry = nil
 	}
 
-	return &Replicator{
+	r := &Replicator{
 		client:             nc,
 		nodeID:             nodeID,
 		compressionEnabled: compress,
-		lastSnapshot:       time.Time{},
 
 		shards:               shards,
 		streamMap:            streamMap,
@@ -175,12 +208,23 @@ func NewReplicator(
 		repState:             repState,
 		metaStore:            metaStore,
 		snapshotLeader:       snapshotLeader,
+		progress:             newShardProgress(),
+		metrics:              newReplicatorMetrics(),
 		schemaMismatchMetric: schemaMismatchMetric,
 		schemaRegistry:       schemaRegistry,
-	}, nil
+	}
+
+	if cfg.Config.Publish {
+		err = metaStore.WatchPublishPause(r.setPublishPaused)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
 }
 
-func (r *Replicator) Publish(hash uint64, payload []byte) error {
+func (r *Replicator) Publish(ctx context.Context, hash uint64, payload []byte) (err error) {
 	shardID := (hash % r.shards) + 1
 	js, ok := r.streamMap[shardID]
 	if !ok {
@@ -198,28 +242,75 @@ func (r *Replicator) Publish(hash uint64, payload []byte) error {
 		payload = compPayload
 	}
 
-	ack, err := js.Publish(subjectName(shardID), payload)
+	ctx, span := telemetry.StartSpan(ctx, "stream.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subjectName(shardID)),
+			attribute.Int64("harmonylite.shard", int64(shardID)),
+		))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	msg := nats.NewMsg(subjectName(shardID))
+	msg.Data = payload
+	telemetry.InjectHeader(ctx, msg.Header)
+
+	start := time.Now()
+	ack, err := js.PublishMsg(msg)
 	if err != nil {
 		return err
 	}
 
-	if cfg.Config.Snapshot.Enable {
-		seq, err := r.repState.save(ack.Stream, ack.Sequence)
-		if err != nil {
-			return err
-		}
+	r.metrics.published(shardID, start)
+
+	span.SetAttributes(attribute.Int64("harmonylite.stream.sequence", int64(ack.Sequence)))
+
+	// The watermark only moves as listeners apply events. Events of other nodes before this
+	// one may not be applied yet, a snapshot must not claim them.
+	r.progress.published(shardID, ack.Sequence, time.Now())
+	return nil
+}
+
+// IsPublishPaused returns true if publishing is paused cluster-wide or on this node
+func (r *Replicator) IsPublishPaused() bool {
+	return r.publishPaused.Load() || r.publishHeld.Load()
+}
+
+// OnPublishResumed registers a callback invoked when publishing pauses are lifted
+func (r *Replicator) OnPublishResumed(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onPublishResume = fn
+}
 
-		snapshotEntries := uint64(cfg.Config.ReplicationLog.MaxEntries) / r.shards
-		if snapshotEntries != 0 && seq%snapshotEntries == 0 && shardID == SnapshotShardID {
-			log.Debug().
-				Uint64("seq", seq).
-				Str("stream", ack.Stream).
-				Msg("Initiating save snapshot")
-			go r.SaveSnapshot()
+func (r *Replicator) setPublishPaused(paused bool, info *publishPauseInfo) {
+	wasPaused := r.publishPaused.Swap(paused)
+	if paused == wasPaused {
+		return
+	}
+
+	if paused {
+		evt := log.Warn()
+		if info != nil {
+			evt = evt.Uint64("by_node", info.NodeID).Str("reason", info.Reason)
 		}
+		evt.Msg("Publishing paused cluster-wide")
+		return
 	}
 
-	return nil
+	log.Info().Msg("Publishing resumed cluster-wide")
+	if !r.publishHeld.Load() {
+		r.notifyPublishResumed()
+	}
+}
+
+func (r *Replicator) notifyPublishResumed() {
+	r.mu.RLock()
+	fn := r.onPublishResume
+	r.mu.RUnlock()
+	if fn != nil {
+		go fn()
+	}
 }
 
 func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error) error {
@@ -232,6 +323,7 @@ func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error)
 	defer sub.Unsubscribe()
 
 	savedSeq := r.repState.get(streamName(shardID, r.compressionEnabled))
+	r.progress.resumed(shardID, savedSeq)
 	for sub.IsValid() {
 		msg, err := sub.NextMsg(5 * time.Second)
 		if errors.Is(err, nats.ErrTimeout) {
@@ -267,6 +359,7 @@ func (r *Replicator) Listen(shardID uint64, callback func(payload []byte) error)
 			return err
 		}
 
+		r.progress.applied(shardID, savedSeq, meta.Timestamp)
 		err = msg.Ack()
 		if err != nil {
 			return err
@@ -290,17 +383,191 @@ func (r *Replicator) RestoreSnapshot() error {
 
 		savedSeq := r.repState.get(strName)
 		if savedSeq < info.State.FirstSeq {
-			return r.snapshot.RestoreSnapshot()
+			return r.restoreLatest()
 		}
 	}
 
 	return nil
 }
 
+// RestoreOnline replaces the live database with the latest snapshot from a peer or storage
+// while applications keep using it, requires snapshot.restore_mode = "online". Applying
+// replicated events is paused meanwhile, listeners then resume from the snapshot watermark.
+func (r *Replicator) RestoreOnline() error {
+	if cfg.Config.Snapshot.RestoreMode != cfg.OnlineRestore {
+		return ErrOfflineRestore
+	}
+
+	if r.snapshot == nil {
+		return ErrNoSnapshotStorage
+	}
+
+	if !r.restoring.CompareAndSwap(false, true) {
+		return ErrRestoreInProgress
+	}
+	defer r.restoring.Store(false)
+
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	log.Info().Msg("Restoring snapshot online, replication paused")
+	err := r.restoreLatest()
+	if err != nil {
+		return err
+	}
+
+	r.resubscribes.Add(1)
+	log.Info().Msg("Online restore complete, resuming replication from snapshot watermark")
+	return nil
+}
+
+// restoreLatest restores the latest snapshot from a peer (when enabled) or storage and sets
+// the replication watermark from it
+func (r *Replicator) restoreLatest() (err error) {
+	defer func(start time.Time) {
+		if err == nil {
+			r.metrics.snapshotTook(snapshotRestore, start)
+		}
+	}(time.Now())
+
+	if cfg.Config.Snapshot.Peer.Enable {
+		err := r.RestoreFromPeer()
+		if err != ErrNoPeerSnapshot || !cfg.Config.Snapshot.Enable {
+			return ignoreNoPeerSnapshot(err)
+		}
+
+		log.Info().Msg("No peer available, restoring snapshot from storage")
+	}
+
+	manifest, err := r.snapshot.RestoreSnapshot(r.checkSnapshotWatermark)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		return nil
+	}
+
+	return r.applySnapshotWatermark(manifest)
+}
+
+// Bootstrap populates a newly created database from a peer (when enabled) or the latest
+// snapshot in storage, and sets the replication watermark from its manifest. Snapshots
+// without a manifest reset the watermark to the start of each stream so every retained
+// event is replayed on top.
+func (r *Replicator) Bootstrap() (err error) {
+	if r.snapshot == nil {
+		return ErrNoSnapshotStorage
+	}
+
+	defer func(start time.Time) {
+		if err == nil {
+			r.metrics.snapshotTook(snapshotRestore, start)
+		}
+	}(time.Now())
+
+	if cfg.Config.Snapshot.Peer.Enable {
+		err := r.restoreFromPeer(true)
+		if err != ErrNoPeerSnapshot {
+			return err
+		}
+
+		if !cfg.Config.Snapshot.Enable {
+			return err
+		}
+
+		log.Info().Msg("No peer available, bootstrapping from snapshot storage")
+	}
+
+	manifest, err := r.snapshot.BootstrapSnapshot(r.checkSnapshotWatermark)
+	if err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		return r.applySnapshotWatermark(manifest)
+	}
+
+	watermark := map[string]uint64{}
+	for shardID, js := range r.streamMap {
+		strName := streamName(shardID, r.compressionEnabled)
+		info, err := js.StreamInfo(strName)
+		if err != nil {
+			return err
+		}
+
+		seq := uint64(0)
+		if info.State.FirstSeq > 0 {
+			seq = info.State.FirstSeq - 1
+		}
+		watermark[strName] = seq
+	}
+
+	return r.resetWatermark(watermark)
+}
+
+// checkSnapshotWatermark fails when a stream no longer retains the events following the
+// sequences included in a snapshot, restoring it would silently skip them
+func (r *Replicator) checkSnapshotWatermark(manifest *snapshot.Manifest) error {
+	for shardID, js := range r.streamMap {
+		strName := streamName(shardID, r.compressionEnabled)
+		info, err := js.StreamInfo(strName)
+		if err != nil {
+			return err
+		}
+
+		seq := manifest.Sequences[strName]
+		if seq+1 < info.State.FirstSeq {
+			return fmt.Errorf("%w: snapshot %s includes %s up to %d, the stream starts at %d",
+				ErrSnapshotTooOld, manifest.ID, strName, seq, info.State.FirstSeq)
+		}
+	}
+
+	return nil
+}
+
+// applySnapshotWatermark replaces the replication state of every stream with the sequences
+// included in a restored snapshot
+func (r *Replicator) applySnapshotWatermark(manifest *snapshot.Manifest) error {
+	watermark := map[string]uint64{}
+	for shardID := range r.streamMap {
+		strName := streamName(shardID, r.compressionEnabled)
+		watermark[strName] = manifest.Sequences[strName]
+	}
+
+	log.Info().Interface("sequences", watermark).Msg("Replication watermark set from snapshot")
+	return r.resetWatermark(watermark)
+}
+
+// resetWatermark replaces the replication state along with the sequences listeners resume
+// applying after once they resubscribe
+func (r *Replicator) resetWatermark(watermark map[string]uint64) error {
+	err := r.repState.reset(watermark)
+	if err != nil {
+		return err
+	}
+
+	for shardID := range r.streamMap {
+		r.progress.resumed(shardID, watermark[streamName(shardID, r.compressionEnabled)])
+	}
+
+	return nil
+}
+
 func (r *Replicator) LastSaveSnapshotTime() time.Time {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
 	return r.lastSnapshot
 }
 
+// lastSnapshotState returns the time and stream sequences of the last snapshot saved by
+// this node, the time is zero when it has not saved one yet
+func (r *Replicator) lastSnapshotState() (time.Time, map[string]uint64) {
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+	return r.lastSnapshot, r.snapshotSeqs
+}
+
 func (r *Replicator) SaveSnapshot() {
 	// Check if this node is the snapshot leader
 	if r.snapshotLeader != nil && !r.snapshotLeader.IsLeader() {
@@ -330,7 +597,9 @@ func (r *Replicator) ForceSaveSnapshot() {
 		return
 	}
 
-	err := r.snapshot.SaveSnapshot()
+	seqs := r.repState.all()
+	start := time.Now()
+	err := r.snapshot.SaveSnapshot(seqs)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -338,19 +607,25 @@ func (r *Replicator) ForceSaveSnapshot() {
 		return
 	}
 
+	r.metrics.snapshotTook(snapshotSave, start)
+
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
 	r.lastSnapshot = time.Now()
+	r.snapshotSeqs = seqs
 }
 
 func (r *Replicator) ReloadCertificates() error {
-	if cfg.Config.NATS.CAFile != "" {
-		err := nats.RootCAs(cfg.Config.NATS.CAFile)(&r.client.Opts)
+	conf := cfg.Current().NATS
+	if conf.CAFile != "" {
+		err := nats.RootCAs(conf.CAFile)(&r.client.Opts)
 		if err != nil {
 			return err
 		}
 	}
 
-	if cfg.Config.NATS.CertFile != "" && cfg.Config.NATS.KeyFile != "" {
-		err := nats.ClientCert(cfg.Config.NATS.CertFile, cfg.Config.NATS.KeyFile)(&r.client.Opts)
+	if conf.CertFile != "" && conf.KeyFile != "" {
+		err := nats.ClientCert(conf.CertFile, conf.KeyFile)(&r.client.Opts)
 		if err != nil {
 			return err
 		}
@@ -497,11 +772,29 @@ func payloadDecompress(payload []byte) ([]byte, error) {
 }
 
 // PublishSchemaState publishes the current node's schema state to the registry
+// and records the schema in the cluster schema history if it is new
 func (r *Replicator) PublishSchemaState(schemaHash, previousHash string) error {
 	if r.schemaRegistry == nil {
 		return fmt.Errorf("schema registry not initialized")
 	}
-	return r.schemaRegistry.PublishSchemaState(schemaHash, previousHash)
+
+	if err := r.schemaRegistry.PublishSchemaState(schemaHash, previousHash); err != nil {
+		return err
+	}
+
+	if _, err := r.schemaRegistry.RecordSchemaVersion(schemaHash, previousHash, ""); err != nil {
+		log.Warn().Err(err).Msg("Failed to record schema version in cluster history")
+	}
+
+	return nil
+}
+
+// GetSchemaHistory returns the ordered schema version history of the cluster
+func (r *Replicator) GetSchemaHistory() (*SchemaHistory, error) {
+	if r.schemaRegistry == nil {
+		return nil, fmt.Errorf("schema registry not initialized")
+	}
+	return r.schemaRegistry.GetSchemaHistory()
 }
 
 // GetClusterSchemaState retrieves schema state for all nodes in the cluster
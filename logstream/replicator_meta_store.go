@@ -8,8 +8,15 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/stream"
 )
 
+const publishPausedKey = "publish-paused"
+
+// PublishPauseTTL is how long a cluster-wide publishing pause lasts unless its holder renews
+// it, nodes resume publishing on their own once it lapses
+var PublishPauseTTL = 30 * time.Second
+
 type replicatorMetaStore struct {
 	nats.KeyValue
 }
@@ -19,8 +26,14 @@ type replicatorLockInfo struct {
 	Timestamp int64
 }
 
+type publishPauseInfo struct {
+	NodeID    uint64
+	Reason    string
+	Timestamp int64
+}
+
 func newReplicatorMetaStore(name string, nc *nats.Conn) (*replicatorMetaStore, error) {
-	jsx, err := nc.JetStream()
+	jsx, err := nc.JetStream(stream.JetStreamOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -117,6 +130,145 @@ func (m *replicatorMetaStore) ContextRefreshingLease(
 	return locked, err
 }
 
+// PausePublishing sets the cluster-wide flag asking all nodes to hold publishing, nodes
+// ignore it once it is older than PublishPauseTTL
+func (m *replicatorMetaStore) PausePublishing(reason string) error {
+	payload, err := cbor.Marshal(&publishPauseInfo{
+		NodeID:    cfg.Config.NodeID,
+		Reason:    reason,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Put(publishPausedKey, payload)
+	return err
+}
+
+// HoldPublishPause pauses publishing cluster-wide and renews the pause until the returned
+// release function is called, which lifts it. A holder that dies stops renewing and the
+// pause lapses after PublishPauseTTL.
+func (m *replicatorMetaStore) HoldPublishPause(reason string) (func() error, error) {
+	if err := m.PausePublishing(reason); err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		refresh := time.NewTicker(PublishPauseTTL / 3)
+		defer refresh.Stop()
+		for {
+			select {
+			case <-refresh.C:
+				if err := m.PausePublishing(reason); err != nil {
+					log.Warn().Err(err).Msg("Unable to renew cluster-wide publishing pause")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		<-done
+		return m.ResumePublishing()
+	}, nil
+}
+
+// ResumePublishing clears the cluster-wide publishing pause flag
+func (m *replicatorMetaStore) ResumePublishing() error {
+	err := m.Delete(publishPausedKey)
+	if err == nats.ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// WatchPublishPause invokes onChange every time the cluster-wide publishing pause flag changes,
+// and with paused false when a pause isn't renewed within PublishPauseTTL
+func (m *replicatorMetaStore) WatchPublishPause(onChange func(paused bool, info *publishPauseInfo)) error {
+	watcher, err := m.Watch(publishPausedKey)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer watcher.Stop()
+		expiry := time.NewTimer(PublishPauseTTL)
+		expiry.Stop()
+		var current *publishPauseInfo
+		for {
+			select {
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					expiry.Stop()
+					return
+				}
+
+				// nil marks the end of initial values
+				if entry == nil {
+					continue
+				}
+
+				expiry.Stop()
+				if entry.Operation() != nats.KeyValuePut {
+					current = nil
+					onChange(false, nil)
+					continue
+				}
+
+				info := &publishPauseInfo{}
+				if err := cbor.Unmarshal(entry.Value(), info); err != nil {
+					log.Warn().Err(err).Msg("Unable to decode publish pause info")
+				}
+
+				remaining := publishPauseRemaining(info)
+				if remaining <= 0 {
+					current = nil
+					logLapsedPublishPause(info)
+					onChange(false, info)
+					continue
+				}
+
+				current = info
+				expiry.Reset(remaining)
+				onChange(true, info)
+			case <-expiry.C:
+				if current != nil {
+					logLapsedPublishPause(current)
+					onChange(false, current)
+					current = nil
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// publishPauseRemaining returns how long a pause lasts unless renewed, counted from now for
+// pauses without a timestamp
+func publishPauseRemaining(info *publishPauseInfo) time.Duration {
+	if info.Timestamp == 0 {
+		return PublishPauseTTL
+	}
+
+	return time.Until(time.UnixMilli(info.Timestamp).Add(PublishPauseTTL))
+}
+
+func logLapsedPublishPause(info *publishPauseInfo) {
+	log.Warn().
+		Uint64("by_node", info.NodeID).
+		Str("reason", info.Reason).
+		Dur("ttl", PublishPauseTTL).
+		Msg("Cluster-wide publishing pause was not renewed, ignoring it")
+}
+
 func (r *replicatorLockInfo) Serialize() ([]byte, error) {
 	return cbor.Marshal(r)
 }
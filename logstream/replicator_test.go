@@ -0,0 +1,73 @@
+package logstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/snapshot"
+)
+
+func TestReplicator_RestoreOnline(t *testing.T) {
+	original := cfg.Config.Snapshot.RestoreMode
+	defer func() {
+		cfg.Config.Snapshot.RestoreMode = original
+	}()
+
+	t.Run("requires online restore mode", func(t *testing.T) {
+		cfg.Config.Snapshot.RestoreMode = cfg.OfflineRestore
+		r := &Replicator{snapshot: snapshot.NewNatsDBSnapshot(nil, nil)}
+		assert.ErrorIs(t, r.RestoreOnline(), ErrOfflineRestore)
+	})
+
+	t.Run("requires snapshot storage", func(t *testing.T) {
+		cfg.Config.Snapshot.RestoreMode = cfg.OnlineRestore
+		r := &Replicator{}
+		assert.ErrorIs(t, r.RestoreOnline(), ErrNoSnapshotStorage)
+	})
+
+	t.Run("one restore at a time", func(t *testing.T) {
+		cfg.Config.Snapshot.RestoreMode = cfg.OnlineRestore
+		r := &Replicator{snapshot: snapshot.NewNatsDBSnapshot(nil, nil)}
+		r.restoring.Store(true)
+		assert.ErrorIs(t, r.RestoreOnline(), ErrRestoreInProgress)
+		assert.Zero(t, r.resubscribes.Load())
+	})
+}
+
+func TestReplicator_Publish(t *testing.T) {
+	ns, nc := startTestNatsServer(t)
+	defer ns.Shutdown()
+	defer nc.Close()
+
+	// Publishing never claims events of other nodes that are not applied yet
+	r := newPeerTestReplicator(t, nc, 1, nil)
+	r.shards = 1
+	r.metrics = newReplicatorMetrics()
+	require.NoError(t, r.Publish(context.Background(), 0, []byte("event")))
+
+	assert.Equal(t, uint64(1), r.progress.snapshot(1).publishedSeq)
+	assert.Zero(t, r.repState.get(streamName(1, false)))
+}
+
+func TestReplicator_CheckSnapshotWatermark(t *testing.T) {
+	r := &Replicator{
+		streamMap: map[uint64]nats.JetStreamContext{
+			1: &streamInfoJS{firstSeq: 1, lastSeq: 10},
+			2: &streamInfoJS{firstSeq: 20, lastSeq: 30},
+		},
+	}
+
+	manifest := &snapshot.Manifest{ID: "1", Sequences: map[string]uint64{
+		streamName(1, false): 5,
+		streamName(2, false): 19,
+	}}
+	assert.NoError(t, r.checkSnapshotWatermark(manifest))
+
+	// Events 18 and 19 of shard 2 are gone
+	manifest.Sequences[streamName(2, false)] = 17
+	assert.ErrorIs(t, r.checkSnapshotWatermark(manifest), ErrSnapshotTooOld)
+}
@@ -0,0 +1,288 @@
+package logstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+)
+
+const (
+	migrationUpMarker   = "-- +migrate up"
+	migrationDownMarker = "-- +migrate down"
+
+	defaultMigrationTimeout = 30 * time.Second
+	defaultMigrationSettle  = 5 * time.Second
+)
+
+// Migration is a DDL change rolled out across the cluster.
+// Down is optional and only used to roll back nodes when the rollout fails.
+type Migration struct {
+	Name string
+	Up   string
+	Down string
+}
+
+// MigrationOptions controls how a migration is rolled out
+type MigrationOptions struct {
+	Timeout time.Duration // Per node timeout for applying the migration
+	Settle  time.Duration // Time to wait after pausing publishing for in-flight events
+}
+
+// MigrationRequest is sent to each node to apply DDL statements
+type MigrationRequest struct {
+	Name       string `json:"name"`
+	Statements string `json:"statements"`
+}
+
+// MigrationResponse is returned by a node after applying a MigrationRequest
+type MigrationResponse struct {
+	NodeId       uint64 `json:"node_id"`
+	SchemaHash   string `json:"schema_hash,omitempty"`
+	PreviousHash string `json:"previous_hash,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// MigrationReport summarizes a cluster-wide migration rollout
+type MigrationReport struct {
+	Name       string                        `json:"name"`
+	FromHash   string                        `json:"from_hash"`
+	ToHash     string                        `json:"to_hash,omitempty"`
+	Applied    []uint64                      `json:"applied"`
+	RolledBack []uint64                      `json:"rolled_back,omitempty"`
+	Responses  map[uint64]*MigrationResponse `json:"responses"`
+}
+
+// LoadMigration reads a migration file. Sections can be split with "-- +migrate Up" and
+// "-- +migrate Down" markers; without markers the whole file is treated as the up migration.
+func LoadMigration(path string) (*Migration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migration{Name: filepath.Base(path)}
+	var up, down strings.Builder
+	target := &up
+	for _, line := range strings.Split(string(data), "\n") {
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case migrationUpMarker:
+			target = &up
+			continue
+		case migrationDownMarker:
+			target = &down
+			continue
+		}
+
+		target.WriteString(line)
+		target.WriteString("\n")
+	}
+
+	m.Up = strings.TrimSpace(up.String())
+	m.Down = strings.TrimSpace(down.String())
+	if m.Up == "" {
+		return nil, fmt.Errorf("migration %s has no statements", m.Name)
+	}
+
+	return m, nil
+}
+
+// ServeMigrations answers migration requests from the coordinator by applying DDL locally
+func (r *Replicator) ServeMigrations(streamDB *db.SqliteStreamDB) error {
+	_, err := r.client.Subscribe(migrationSubject(r.nodeID), func(msg *nats.Msg) {
+		req := &MigrationRequest{}
+		res := &MigrationResponse{NodeId: r.nodeID}
+		if err := json.Unmarshal(msg.Data, req); err != nil {
+			res.Error = fmt.Sprintf("invalid migration request: %v", err)
+		} else {
+			log.Info().Str("migration", req.Name).Msg("Applying migration requested by coordinator")
+			hash, err := streamDB.ApplyMigration(req.Statements)
+			if err != nil {
+				log.Error().Err(err).Str("migration", req.Name).Msg("Unable to apply migration")
+				res.Error = err.Error()
+			} else {
+				res.SchemaHash = hash
+				res.PreviousHash = streamDB.GetPreviousHash()
+				if r.schemaRegistry != nil {
+					if err := r.schemaRegistry.PublishSchemaState(res.SchemaHash, res.PreviousHash); err != nil {
+						log.Warn().Err(err).Msg("Failed to publish schema state after migration")
+					}
+				}
+			}
+		}
+
+		payload, err := json.Marshal(res)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to encode migration response")
+			return
+		}
+
+		if err := msg.Respond(payload); err != nil {
+			log.Error().Err(err).Msg("Unable to respond to migration request")
+		}
+	})
+
+	return err
+}
+
+// RunMigration rolls out m across every node in the schema registry. Publishing is paused
+// cluster-wide for the duration, nodes are migrated one by one and the resulting hashes must
+// converge. On failure, nodes already migrated are rolled back with m.Down when available.
+func (r *Replicator) RunMigration(m *Migration, opts MigrationOptions) (*MigrationReport, error) {
+	if r.schemaRegistry == nil {
+		return nil, fmt.Errorf("schema registry not initialized")
+	}
+
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultMigrationTimeout
+	}
+
+	if opts.Settle == 0 {
+		opts.Settle = defaultMigrationSettle
+	}
+
+	states, err := r.schemaRegistry.GetClusterSchemaState()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(states) == 0 {
+		return nil, fmt.Errorf("no nodes found in schema registry")
+	}
+
+	report := &MigrationReport{
+		Name:      m.Name,
+		Applied:   []uint64{},
+		Responses: map[uint64]*MigrationResponse{},
+	}
+
+	nodeIDs := make([]uint64, 0, len(states))
+	for nodeID, state := range states {
+		if report.FromHash == "" {
+			report.FromHash = state.SchemaHash
+		}
+
+		if state.SchemaHash != report.FromHash {
+			return nil, fmt.Errorf("cluster schema is not consistent (node %d has %s, expected %s)",
+				nodeID, truncateHash(state.SchemaHash), truncateHash(report.FromHash))
+		}
+
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i] < nodeIDs[j] })
+
+	release, err := r.metaStore.HoldPublishPause("migration " + m.Name)
+	if err != nil {
+		return nil, fmt.Errorf("pausing publishing: %w", err)
+	}
+	defer func() {
+		if err := release(); err != nil {
+			log.Error().
+				Err(err).
+				Dur("ttl", PublishPauseTTL).
+				Msg("Unable to resume publishing, the pause lapses after its TTL or run 'harmonylite schema migrate -resume'")
+		}
+	}()
+
+	log.Info().
+		Str("migration", m.Name).
+		Int("nodes", len(nodeIDs)).
+		Dur("settle", opts.Settle).
+		Msg("Publishing paused cluster-wide, waiting for in-flight events")
+	time.Sleep(opts.Settle)
+
+	for _, nodeID := range nodeIDs {
+		res, err := r.requestMigration(nodeID, m.Name, m.Up, opts.Timeout)
+		report.Responses[nodeID] = res
+		if err != nil {
+			r.rollbackMigration(m, report, opts)
+			return report, fmt.Errorf("node %d failed to apply migration: %w", nodeID, err)
+		}
+
+		report.Applied = append(report.Applied, nodeID)
+		log.Info().
+			Uint64("node_id", nodeID).
+			Str("schema_hash", truncateHash(res.SchemaHash)).
+			Msg("Migration applied on node")
+
+		if report.ToHash == "" {
+			report.ToHash = res.SchemaHash
+		} else if res.SchemaHash != report.ToHash {
+			r.rollbackMigration(m, report, opts)
+			return report, fmt.Errorf("schema hashes did not converge (node %d has %s, expected %s)",
+				nodeID, truncateHash(res.SchemaHash), truncateHash(report.ToHash))
+		}
+	}
+
+	if _, err := r.schemaRegistry.RecordSchemaVersion(report.ToHash, report.FromHash, m.Name); err != nil {
+		log.Warn().Err(err).Msg("Migration applied but could not be recorded in schema history")
+	}
+
+	return report, nil
+}
+
+// ResumeClusterPublishing lifts a cluster-wide publishing pause, e.g. one left behind by an
+// interrupted migration
+func (r *Replicator) ResumeClusterPublishing() error {
+	return r.metaStore.ResumePublishing()
+}
+
+// rollbackMigration reverts nodes already migrated, in reverse order
+func (r *Replicator) rollbackMigration(m *Migration, report *MigrationReport, opts MigrationOptions) {
+	if len(report.Applied) == 0 {
+		return
+	}
+
+	if m.Down == "" {
+		log.Error().
+			Interface("nodes", report.Applied).
+			Msg("Migration has no down section, migrated nodes must be rolled back manually")
+		return
+	}
+
+	for i := len(report.Applied) - 1; i >= 0; i-- {
+		nodeID := report.Applied[i]
+		_, err := r.requestMigration(nodeID, m.Name+" (rollback)", m.Down, opts.Timeout)
+		if err != nil {
+			log.Error().Err(err).Uint64("node_id", nodeID).Msg("Unable to roll back migration on node")
+			continue
+		}
+
+		report.RolledBack = append(report.RolledBack, nodeID)
+	}
+}
+
+func (r *Replicator) requestMigration(nodeID uint64, name, statements string, timeout time.Duration) (*MigrationResponse, error) {
+	payload, err := json.Marshal(&MigrationRequest{Name: name, Statements: statements})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := r.client.Request(migrationSubject(nodeID), payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MigrationResponse{}
+	if err := json.Unmarshal(msg.Data, res); err != nil {
+		return nil, err
+	}
+
+	if res.Error != "" {
+		return res, fmt.Errorf("%s", res.Error)
+	}
+
+	return res, nil
+}
+
+func migrationSubject(nodeID uint64) string {
+	return fmt.Sprintf("%s-migrate.%d", cfg.Config.NATS.SubjectPrefix, nodeID)
+}
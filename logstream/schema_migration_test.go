@@ -0,0 +1,209 @@
+package logstream
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigration(t *testing.T) {
+	t.Run("up and down sections", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "002_add_email.sql")
+		content := "-- +migrate Up\nALTER TABLE users ADD COLUMN email TEXT;\n\n-- +migrate Down\nALTER TABLE users DROP COLUMN email;\n"
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+
+		m, err := LoadMigration(p)
+		require.NoError(t, err)
+		assert.Equal(t, "002_add_email.sql", m.Name)
+		assert.Equal(t, "ALTER TABLE users ADD COLUMN email TEXT;", m.Up)
+		assert.Equal(t, "ALTER TABLE users DROP COLUMN email;", m.Down)
+	})
+
+	t.Run("without markers", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "003.sql")
+		require.NoError(t, os.WriteFile(p, []byte("CREATE TABLE t (id INTEGER PRIMARY KEY);\n"), 0644))
+
+		m, err := LoadMigration(p)
+		require.NoError(t, err)
+		assert.Equal(t, "CREATE TABLE t (id INTEGER PRIMARY KEY);", m.Up)
+		assert.Empty(t, m.Down)
+	})
+
+	t.Run("empty migration", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "004.sql")
+		require.NoError(t, os.WriteFile(p, []byte("-- +migrate Down\nDROP TABLE t;\n"), 0644))
+
+		_, err := LoadMigration(p)
+		assert.Error(t, err)
+	})
+}
+
+// fakeMigrationNode answers migration requests for nodeID with the given hash (or error)
+func fakeMigrationNode(t *testing.T, nc *nats.Conn, nodeID uint64, hash, errMsg string, received *[]string, mu *sync.Mutex) {
+	_, err := nc.Subscribe(migrationSubject(nodeID), func(msg *nats.Msg) {
+		req := &MigrationRequest{}
+		require.NoError(t, json.Unmarshal(msg.Data, req))
+		mu.Lock()
+		*received = append(*received, req.Statements)
+		mu.Unlock()
+
+		res := &MigrationResponse{NodeId: nodeID, SchemaHash: hash}
+		if errMsg != "" && req.Statements != "DOWN" {
+			res = &MigrationResponse{NodeId: nodeID, Error: errMsg}
+		}
+
+		payload, _ := json.Marshal(res)
+		msg.Respond(payload)
+	})
+	require.NoError(t, err)
+}
+
+func newMigrationTestReplicator(t *testing.T, nc *nats.Conn) *Replicator {
+	metaStore, err := newReplicatorMetaStore("migration-test", nc)
+	require.NoError(t, err)
+
+	registry, err := NewSchemaRegistry(nc, 99)
+	require.NoError(t, err)
+
+	return &Replicator{client: nc, nodeID: 99, metaStore: metaStore, schemaRegistry: registry}
+}
+
+func TestReplicator_RunMigration(t *testing.T) {
+	opts := MigrationOptions{Timeout: 2 * time.Second, Settle: time.Millisecond}
+	migration := &Migration{Name: "002_add_email.sql", Up: "UP", Down: "DOWN"}
+
+	t.Run("converges and records history", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		r := newMigrationTestReplicator(t, nc)
+		mu := &sync.Mutex{}
+		received := []string{}
+		for _, id := range []uint64{1, 2} {
+			reg, err := NewSchemaRegistry(nc, id)
+			require.NoError(t, err)
+			require.NoError(t, reg.PublishSchemaState("old-hash", ""))
+			fakeMigrationNode(t, nc, id, "new-hash", "", &received, mu)
+		}
+
+		report, err := r.RunMigration(migration, opts)
+		require.NoError(t, err)
+		assert.Equal(t, "old-hash", report.FromHash)
+		assert.Equal(t, "new-hash", report.ToHash)
+		assert.Equal(t, []uint64{1, 2}, report.Applied)
+		assert.Equal(t, []string{"UP", "UP"}, received)
+
+		history, err := r.GetSchemaHistory()
+		require.NoError(t, err)
+		v := history.Find("new-hash")
+		require.NotNil(t, v)
+		assert.Equal(t, "002_add_email.sql", v.Migration)
+
+		// Publishing pause flag is cleared afterwards
+		_, err = r.metaStore.Get(publishPausedKey)
+		assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+	})
+
+	t.Run("rolls back on node failure", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		r := newMigrationTestReplicator(t, nc)
+		mu := &sync.Mutex{}
+		received := []string{}
+		for _, id := range []uint64{1, 2} {
+			reg, err := NewSchemaRegistry(nc, id)
+			require.NoError(t, err)
+			require.NoError(t, reg.PublishSchemaState("old-hash", ""))
+		}
+		fakeMigrationNode(t, nc, 1, "new-hash", "", &received, mu)
+		fakeMigrationNode(t, nc, 2, "", "no such table", &received, mu)
+
+		report, err := r.RunMigration(migration, opts)
+		require.Error(t, err)
+		assert.Equal(t, []uint64{1}, report.Applied)
+		assert.Equal(t, []uint64{1}, report.RolledBack)
+		assert.Equal(t, []string{"UP", "UP", "DOWN"}, received)
+	})
+
+	t.Run("refuses inconsistent cluster", func(t *testing.T) {
+		ns, nc := startTestNatsServer(t)
+		defer ns.Shutdown()
+		defer nc.Close()
+
+		r := newMigrationTestReplicator(t, nc)
+		for id, hash := range map[uint64]string{1: "hash-a", 2: "hash-b"} {
+			reg, err := NewSchemaRegistry(nc, id)
+			require.NoError(t, err)
+			require.NoError(t, reg.PublishSchemaState(hash, ""))
+		}
+
+		_, err := r.RunMigration(migration, opts)
+		assert.ErrorContains(t, err, "not consistent")
+	})
+}
+
+func TestReplicatorMetaStore_PublishPause(t *testing.T) {
+	original := PublishPauseTTL
+	t.Cleanup(func() { PublishPauseTTL = original })
+	PublishPauseTTL = 300 * time.Millisecond
+
+	ns, nc := startTestNatsServer(t)
+	defer ns.Shutdown()
+	defer nc.Close()
+
+	metaStore, err := newReplicatorMetaStore("pause-test", nc)
+	require.NoError(t, err)
+
+	changes := make(chan bool, 16)
+	require.NoError(t, metaStore.WatchPublishPause(func(paused bool, _ *publishPauseInfo) {
+		changes <- paused
+	}))
+
+	next := func() bool {
+		select {
+		case paused := <-changes:
+			return paused
+		case <-time.After(2 * time.Second):
+			t.Fatal("no publish pause change")
+			return false
+		}
+	}
+
+	t.Run("lapses when not renewed", func(t *testing.T) {
+		require.NoError(t, metaStore.PausePublishing("test"))
+		assert.True(t, next())
+		assert.False(t, next())
+	})
+
+	t.Run("held while renewed", func(t *testing.T) {
+		release, err := metaStore.HoldPublishPause("test")
+		require.NoError(t, err)
+
+		deadline := time.After(3 * PublishPauseTTL)
+		for held := true; held; {
+			select {
+			case paused := <-changes:
+				require.True(t, paused)
+			case <-deadline:
+				held = false
+			}
+		}
+
+		// Renewals may still be queued ahead of the release
+		require.NoError(t, release())
+		for next() {
+		}
+		_, err = metaStore.Get(publishPausedKey)
+		assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+	})
+}
@@ -3,14 +3,29 @@ package logstream
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/stream"
 	"github.com/wongfei2009/harmonylite/version"
 )
 
 const SchemaRegistryBucket = "harmonylite-schema-registry"
+const SchemaHistoryBucket = "harmonylite-schema-history"
+
+// SchemaStateRefreshInterval is how often nodes refresh their registry entry (entries expire after 5 minutes)
+const SchemaStateRefreshInterval = time.Minute
+
+const schemaHistoryKey = "history"
+const maxSchemaHistoryUpdateRetries = 5
+
+// MaxSchemaHistoryVersions is the number of versions kept in the cluster schema history,
+// raised to 10 times schema.compatibility_window when that is larger. Older versions are
+// dropped as new ones are recorded.
+var MaxSchemaHistoryVersions = 100
 
 // NodeSchemaState represents the schema state of a single node in the cluster
 type NodeSchemaState struct {
@@ -21,6 +36,21 @@ type NodeSchemaState struct {
 	UpdatedAt          time.Time `json:"updated_at"`
 }
 
+// SchemaVersion represents a single schema version observed in the cluster
+type SchemaVersion struct {
+	Version      uint64    `json:"version"`
+	SchemaHash   string    `json:"schema_hash"`
+	PreviousHash string    `json:"previous_hash,omitempty"`
+	Migration    string    `json:"migration,omitempty"` // Migration that produced this version (if known)
+	NodeId       uint64    `json:"node_id"`             // Node that first recorded this version
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SchemaHistory is the ordered (oldest first) list of schema versions of the cluster
+type SchemaHistory struct {
+	Versions []SchemaVersion `json:"versions"`
+}
+
 // SchemaMismatch represents a schema inconsistency between nodes
 type SchemaMismatch struct {
 	NodeId       uint64 `json:"node_id"`
@@ -38,14 +68,15 @@ type SchemaConsistencyReport struct {
 
 // SchemaRegistry provides cluster-wide schema state visibility via NATS KV
 type SchemaRegistry struct {
-	nodeID uint64
-	kv     nats.KeyValue
+	nodeID  uint64
+	kv      nats.KeyValue
+	history nats.KeyValue
 }
 
 // NewSchemaRegistry creates a new schema registry using the provided NATS connection
 // It creates the KV bucket if it doesn't exist
 func NewSchemaRegistry(nc *nats.Conn, nodeID uint64) (*SchemaRegistry, error) {
-	js, err := nc.JetStream()
+	js, err := nc.JetStream(stream.JetStreamOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("creating jetstream context: %w", err)
 	}
@@ -65,9 +96,25 @@ func NewSchemaRegistry(nc *nats.Conn, nodeID uint64) (*SchemaRegistry, error) {
 		return nil, fmt.Errorf("getting/creating schema registry bucket: %w", err)
 	}
 
+	// History lives in its own bucket since registry entries expire
+	history, err := js.KeyValue(SchemaHistoryBucket)
+	if err == nats.ErrBucketNotFound {
+		log.Debug().Str("bucket", SchemaHistoryBucket).Msg("Creating schema history bucket")
+		history, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      SchemaHistoryBucket,
+			Description: "HarmonyLite ordered history of cluster schema versions",
+			Storage:     nats.FileStorage,
+			Replicas:    cfg.Config.ReplicationLog.Replicas,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting/creating schema history bucket: %w", err)
+	}
+
 	return &SchemaRegistry{
-		nodeID: nodeID,
-		kv:     kv,
+		nodeID:  nodeID,
+		kv:      kv,
+		history: history,
 	}, nil
 }
 
@@ -189,3 +236,144 @@ func (sr *SchemaRegistry) GetNodeSchemaState(nodeID uint64) (*NodeSchemaState, e
 
 	return &state, nil
 }
+
+// GetSchemaHistory returns the ordered schema history of the cluster
+func (sr *SchemaRegistry) GetSchemaHistory() (*SchemaHistory, error) {
+	history, _, err := sr.loadSchemaHistory()
+	return history, err
+}
+
+// RecordSchemaVersion appends schemaHash to the cluster schema history unless it is already known.
+// migration optionally names the migration that produced the schema.
+func (sr *SchemaRegistry) RecordSchemaVersion(schemaHash, previousHash, migration string) (*SchemaVersion, error) {
+	if schemaHash == "" {
+		return nil, fmt.Errorf("empty schema hash")
+	}
+
+	for attempt := 0; attempt < maxSchemaHistoryUpdateRetries; attempt++ {
+		history, revision, err := sr.loadSchemaHistory()
+		if err != nil {
+			return nil, err
+		}
+
+		version := history.Find(schemaHash)
+		if version != nil && (migration == "" || version.Migration != "") {
+			return version, nil
+		}
+
+		if version != nil {
+			// Known version recorded before the migration name was available
+			version.Migration = migration
+		} else {
+			next := uint64(1)
+			if n := len(history.Versions); n > 0 {
+				next = history.Versions[n-1].Version + 1
+			}
+
+			history.Versions = append(history.Versions, SchemaVersion{
+				Version:      next,
+				SchemaHash:   schemaHash,
+				PreviousHash: previousHash,
+				Migration:    migration,
+				NodeId:       sr.nodeID,
+				CreatedAt:    time.Now(),
+			})
+			history.trim(schemaHistoryLimit())
+			version = &history.Versions[len(history.Versions)-1]
+		}
+
+		data, err := json.Marshal(history)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling schema history: %w", err)
+		}
+
+		// Optimistic concurrency, another node might be recording at the same time
+		if revision == 0 {
+			_, err = sr.history.Create(schemaHistoryKey, data)
+		} else {
+			_, err = sr.history.Update(schemaHistoryKey, data, revision)
+		}
+
+		if err == nil {
+			log.Info().
+				Uint64("version", version.Version).
+				Str("schema_hash", truncateHash(schemaHash)).
+				Str("migration", migration).
+				Msg("Recorded schema version in cluster history")
+			return version, nil
+		}
+
+		log.Debug().Err(err).Int("attempt", attempt+1).Msg("Schema history changed concurrently, retrying")
+	}
+
+	return nil, fmt.Errorf("unable to record schema version after %d attempts", maxSchemaHistoryUpdateRetries)
+}
+
+// loadSchemaHistory returns the stored history and its KV revision (0 if not present)
+func (sr *SchemaRegistry) loadSchemaHistory() (*SchemaHistory, uint64, error) {
+	history := &SchemaHistory{Versions: []SchemaVersion{}}
+	entry, err := sr.history.Get(schemaHistoryKey)
+	if err == nats.ErrKeyNotFound {
+		return history, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("getting schema history: %w", err)
+	}
+
+	if err := json.Unmarshal(entry.Value(), history); err != nil {
+		return nil, 0, fmt.Errorf("unmarshaling schema history: %w", err)
+	}
+
+	return history, entry.Revision(), nil
+}
+
+// schemaHistoryLimit returns the number of versions kept in the cluster schema history
+func schemaHistoryLimit() int {
+	return max(MaxSchemaHistoryVersions, 10*cfg.Config.Schema.CompatibilityWindow)
+}
+
+// trim drops the oldest versions beyond limit
+func (h *SchemaHistory) trim(limit int) {
+	if limit > 0 && len(h.Versions) > limit {
+		h.Versions = slices.Delete(h.Versions, 0, len(h.Versions)-limit)
+	}
+}
+
+// Find returns the version entry for schemaHash or nil if unknown
+func (h *SchemaHistory) Find(schemaHash string) *SchemaVersion {
+	for i := range h.Versions {
+		if h.Versions[i].SchemaHash == schemaHash {
+			return &h.Versions[i]
+		}
+	}
+
+	return nil
+}
+
+// CompatibleHashes returns the hashes of up to window versions preceding localHash.
+// Events produced with any of these hashes can be applied on a node running localHash.
+func (h *SchemaHistory) CompatibleHashes(localHash string, window int) []string {
+	idx := -1
+	for i := range h.Versions {
+		if h.Versions[i].SchemaHash == localHash {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 || window < 1 {
+		return nil
+	}
+
+	start := idx - window
+	if start < 0 {
+		start = 0
+	}
+
+	hashes := make([]string, 0, idx-start)
+	for i := idx - 1; i >= start; i-- {
+		hashes = append(hashes, h.Versions[i].SchemaHash)
+	}
+
+	return hashes
+}
@@ -1,6 +1,7 @@
 package logstream
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
 )
 
 // startTestNatsServer starts an embedded NATS server for testing
@@ -202,3 +204,91 @@ func TestSchemaRegistry_PreviousHash(t *testing.T) {
 	assert.Equal(t, currentHash, state.SchemaHash)
 	assert.Equal(t, previousHash, state.PreviousHash)
 }
+
+func TestSchemaRegistry_RecordSchemaVersion(t *testing.T) {
+	ns, nc := startTestNatsServer(t)
+	defer ns.Shutdown()
+	defer nc.Close()
+
+	registry1, err := NewSchemaRegistry(nc, 1)
+	require.NoError(t, err)
+
+	registry2, err := NewSchemaRegistry(nc, 2)
+	require.NoError(t, err)
+
+	// Empty history initially
+	history, err := registry1.GetSchemaHistory()
+	require.NoError(t, err)
+	assert.Empty(t, history.Versions)
+
+	v1, err := registry1.RecordSchemaVersion("hash-1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), v1.Version)
+
+	v2, err := registry2.RecordSchemaVersion("hash-2", "hash-1", "001_add_email.sql")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), v2.Version)
+
+	// Recording a known hash is a no-op
+	again, err := registry1.RecordSchemaVersion("hash-1", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), again.Version)
+
+	history, err = registry2.GetSchemaHistory()
+	require.NoError(t, err)
+	require.Len(t, history.Versions, 2)
+	assert.Equal(t, "hash-1", history.Versions[0].SchemaHash)
+	assert.Equal(t, uint64(1), history.Versions[0].NodeId)
+	assert.Equal(t, "hash-2", history.Versions[1].SchemaHash)
+	assert.Equal(t, "hash-1", history.Versions[1].PreviousHash)
+	assert.Equal(t, "001_add_email.sql", history.Versions[1].Migration)
+	assert.Equal(t, uint64(2), history.Versions[1].NodeId)
+}
+
+func TestSchemaRegistry_HistoryLimit(t *testing.T) {
+	ns, nc := startTestNatsServer(t)
+	defer ns.Shutdown()
+	defer nc.Close()
+
+	originalMax, originalWindow := MaxSchemaHistoryVersions, cfg.Config.Schema.CompatibilityWindow
+	t.Cleanup(func() {
+		MaxSchemaHistoryVersions, cfg.Config.Schema.CompatibilityWindow = originalMax, originalWindow
+	})
+	MaxSchemaHistoryVersions = 3
+	cfg.Config.Schema.CompatibilityWindow = 0
+
+	registry, err := NewSchemaRegistry(nc, 1)
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err := registry.RecordSchemaVersion(fmt.Sprintf("hash-%d", i), "", "")
+		require.NoError(t, err)
+	}
+
+	history, err := registry.GetSchemaHistory()
+	require.NoError(t, err)
+	require.Len(t, history.Versions, 3)
+	assert.Equal(t, "hash-3", history.Versions[0].SchemaHash)
+	assert.Equal(t, uint64(3), history.Versions[0].Version)
+	assert.Equal(t, uint64(5), history.Versions[2].Version)
+
+	// The window raises the limit so compatible versions are never dropped
+	cfg.Config.Schema.CompatibilityWindow = 1
+	assert.Equal(t, 10, schemaHistoryLimit())
+}
+
+func TestSchemaHistory_CompatibleHashes(t *testing.T) {
+	history := &SchemaHistory{Versions: []SchemaVersion{
+		{Version: 1, SchemaHash: "h1"},
+		{Version: 2, SchemaHash: "h2"},
+		{Version: 3, SchemaHash: "h3"},
+		{Version: 4, SchemaHash: "h4"},
+	}}
+
+	assert.Equal(t, []string{"h3"}, history.CompatibleHashes("h4", 1))
+	assert.Equal(t, []string{"h3", "h2"}, history.CompatibleHashes("h4", 2))
+	assert.Equal(t, []string{"h3", "h2", "h1"}, history.CompatibleHashes("h4", 10))
+	assert.Empty(t, history.CompatibleHashes("h1", 3))
+	assert.Empty(t, history.CompatibleHashes("h4", 0))
+	assert.Nil(t, history.CompatibleHashes("unknown", 3))
+}
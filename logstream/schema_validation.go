@@ -2,10 +2,12 @@ package logstream
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
 	"github.com/wongfei2009/harmonylite/db"
 )
 
@@ -17,28 +19,27 @@ const (
 // ValidateAndReplicateWithSchema validates schema hash and replicates if valid
 // Returns true if replication should be retried (schema mismatch), false otherwise
 func (r *Replicator) ValidateAndReplicateWithSchema(
+	ctx context.Context,
 	event *db.ChangeLogEvent,
 	streamDB *db.SqliteStreamDB,
 	msg *nats.Msg,
 ) (bool, error) {
 	// Fast path: hash comparison only (O(1))
 	if event.SchemaHash != "" {
-		localHash := streamDB.GetSchemaHash()
-		prevHash := streamDB.GetPreviousHash()
-
-		// Accept if matches current OR previous schema (for rolling upgrades)
-		if event.SchemaHash != localHash && event.SchemaHash != prevHash {
-			return r.handleSchemaMismatch(event, streamDB, msg, localHash)
+		// Accept if matches current schema or one within the compatibility window (for rolling upgrades)
+		if !r.isSchemaCompatible(event.SchemaHash, streamDB, false) {
+			return r.handleSchemaMismatch(ctx, event, streamDB, msg, streamDB.GetSchemaHash())
 		}
 	}
 
 	// Hashes match (or no hash in event) - apply directly
 	r.resetMismatchState()
-	return false, streamDB.Replicate(event)
+	return false, streamDB.Replicate(ctx, event)
 }
 
 // handleSchemaMismatch handles schema mismatch by NAKing the message and optionally recomputing
 func (r *Replicator) handleSchemaMismatch(
+	ctx context.Context,
 	event *db.ChangeLogEvent,
 	streamDB *db.SqliteStreamDB,
 	msg *nats.Msg,
@@ -55,16 +56,14 @@ func (r *Replicator) handleSchemaMismatch(
 		r.lastRecomputeAt = now
 		r.schemaMismatchMetric.Set(1)
 
-		ctx := context.Background()
 		newHash, err := streamDB.GetSchemaCache().Recompute(ctx)
 		if err == nil {
-			prevHash := streamDB.GetPreviousHash()
-			// Check if event matches current or previous hash after recompute
-			if event.SchemaHash == newHash || event.SchemaHash == prevHash {
+			// Check if event is compatible with the recomputed hash, refreshing cluster history
+			if r.isSchemaCompatible(event.SchemaHash, streamDB, true) {
 				// Schema matches after recompute (e.g., DDL applied before startup)
 				log.Info().Msg("Schema matches after initial recompute, applying event")
 				r.resetMismatchStateLocked()
-				return false, streamDB.Replicate(event)
+				return false, streamDB.Replicate(ctx, event)
 			}
 		}
 
@@ -79,24 +78,30 @@ func (r *Replicator) handleSchemaMismatch(
 
 		// Check for stream gap before recomputing schema
 		if r.checkStreamGap() {
-			log.Fatal().
+			if cfg.Config.Snapshot.RestoreMode != cfg.OnlineRestore {
+				log.Fatal().
+					Dur("paused_for", now.Sub(r.schemaMismatchAt)).
+					Msg("Stream gap detected during schema mismatch pause, exiting for snapshot restore")
+				// Process exits here. On restart, RestoreSnapshot() will run.
+			}
+
+			log.Warn().
 				Dur("paused_for", now.Sub(r.schemaMismatchAt)).
-				Msg("Stream gap detected during schema mismatch pause, exiting for snapshot restore")
-			// Process exits here. On restart, RestoreSnapshot() will run.
+				Msg("Stream gap detected during schema mismatch pause, restoring snapshot online")
+			// Runs once this listener releases the apply lock
+			go r.restoreAfterGap()
 		}
 
-		ctx := context.Background()
 		newHash, err := streamDB.GetSchemaCache().Recompute(ctx)
 		if err == nil {
-			prevHash := streamDB.GetPreviousHash()
-			// Check if event matches current or previous hash after recompute
-			if event.SchemaHash == newHash || event.SchemaHash == prevHash {
+			// Check if event is compatible with the recomputed hash, refreshing cluster history
+			if r.isSchemaCompatible(event.SchemaHash, streamDB, true) {
 				// Schema now matches after local DDL was applied
 				log.Info().
 					Dur("paused_for", now.Sub(r.schemaMismatchAt)).
 					Msg("Schema now matches after recompute, resuming replication")
 				r.resetMismatchStateLocked()
-				return false, streamDB.Replicate(event)
+				return false, streamDB.Replicate(ctx, event)
 			}
 		}
 
@@ -109,9 +114,60 @@ func (r *Replicator) handleSchemaMismatch(
 
 	// Still mismatched - NAK and wait
 	msg.NakWithDelay(schemaNakDelay)
+	r.metrics.nak(nakSchemaMismatch)
 	return true, nil
 }
 
+// isSchemaCompatible returns true if events produced with eventHash can be applied locally.
+// Besides the local and previous hash, any of the schema.compatibility_window versions
+// preceding the local hash in the cluster schema history are accepted.
+// When refresh is true the cluster history is reloaded from the registry.
+func (r *Replicator) isSchemaCompatible(eventHash string, streamDB *db.SqliteStreamDB, refresh bool) bool {
+	localHash := streamDB.GetSchemaHash()
+	if eventHash == localHash {
+		return true
+	}
+
+	window := cfg.Config.Schema.CompatibilityWindow
+	if window < 1 {
+		return false
+	}
+
+	if eventHash == streamDB.GetPreviousHash() {
+		return true
+	}
+
+	_, ok := r.compatibleHashes(localHash, window, refresh)[eventHash]
+	return ok
+}
+
+// compatibleHashes returns the cached set of hashes accepted for localHash,
+// loading it from the schema history when the local hash changed or refresh is requested
+func (r *Replicator) compatibleHashes(localHash string, window int, refresh bool) map[string]struct{} {
+	r.compatMu.Lock()
+	defer r.compatMu.Unlock()
+
+	if !refresh && r.compatHashes != nil && r.compatLocalHash == localHash {
+		return r.compatHashes
+	}
+
+	hashes := map[string]struct{}{}
+	if r.schemaRegistry != nil {
+		history, err := r.schemaRegistry.GetSchemaHistory()
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to load schema history, using previous hash only")
+		} else {
+			for _, h := range history.CompatibleHashes(localHash, window) {
+				hashes[h] = struct{}{}
+			}
+		}
+	}
+
+	r.compatLocalHash = localHash
+	r.compatHashes = hashes
+	return hashes
+}
+
 // checkStreamGap returns true if any stream has truncated messages we need
 func (r *Replicator) checkStreamGap() bool {
 	for shardID, js := range r.streamMap {
@@ -134,6 +190,14 @@ func (r *Replicator) checkStreamGap() bool {
 	return false
 }
 
+// restoreAfterGap restores the latest snapshot online after events were truncated from the stream
+func (r *Replicator) restoreAfterGap() {
+	err := r.RestoreOnline()
+	if err != nil && !errors.Is(err, ErrRestoreInProgress) {
+		log.Error().Err(err).Msg("Unable to restore snapshot online after stream gap")
+	}
+}
+
 // resetMismatchState resets schema mismatch tracking (thread-safe)
 func (r *Replicator) resetMismatchState() {
 	r.mu.Lock()
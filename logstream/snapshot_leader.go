@@ -7,6 +7,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/telemetry"
 )
 
 const (
@@ -23,9 +24,10 @@ type SnapshotLeader struct {
 	ttl       time.Duration
 	heartbeat time.Duration
 
-	isLeader atomic.Bool
-	stopCh   chan struct{}
-	wg       sync.WaitGroup
+	isLeader     atomic.Bool
+	leaderMetric telemetry.Gauge
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
 }
 
 // NewSnapshotLeader creates a new SnapshotLeader instance.
@@ -41,11 +43,12 @@ func NewSnapshotLeader(nodeID uint64, metaStore *replicatorMetaStore, ttl time.D
 	}
 
 	return &SnapshotLeader{
-		nodeID:    nodeID,
-		metaStore: metaStore,
-		ttl:       ttl,
-		heartbeat: heartbeat,
-		stopCh:    make(chan struct{}),
+		nodeID:       nodeID,
+		metaStore:    metaStore,
+		ttl:          ttl,
+		heartbeat:    heartbeat,
+		leaderMetric: telemetry.NewGauge("snapshot_leader", "This node uploads snapshots (1=leader, 0=follower)"),
+		stopCh:       make(chan struct{}),
 	}
 }
 
@@ -69,7 +72,7 @@ func (s *SnapshotLeader) Stop() {
 
 	if s.isLeader.Load() {
 		log.Info().Uint64("node_id", s.nodeID).Msg("Releasing snapshot leadership on shutdown")
-		s.isLeader.Store(false)
+		s.setLeader(false)
 	}
 
 	log.Info().Uint64("node_id", s.nodeID).Msg("Snapshot leader election stopped")
@@ -80,6 +83,16 @@ func (s *SnapshotLeader) IsLeader() bool {
 	return s.isLeader.Load()
 }
 
+// setLeader records whether this node holds the leader lease
+func (s *SnapshotLeader) setLeader(leader bool) {
+	s.isLeader.Store(leader)
+	if leader {
+		s.leaderMetric.Set(1)
+	} else {
+		s.leaderMetric.Set(0)
+	}
+}
+
 // electionLoop continuously attempts to acquire or maintain leadership.
 func (s *SnapshotLeader) electionLoop() {
 	defer s.wg.Done()
@@ -119,7 +132,7 @@ func (s *SnapshotLeader) tryAcquireLeadership() {
 
 		// If we were the leader and got an error, we may have lost leadership
 		if wasLeader {
-			s.isLeader.Store(false)
+			s.setLeader(false)
 			log.Warn().Uint64("node_id", s.nodeID).Msg("Lost snapshot leadership due to error")
 		}
 		return
@@ -129,12 +142,12 @@ func (s *SnapshotLeader) tryAcquireLeadership() {
 		if !wasLeader {
 			log.Info().Uint64("node_id", s.nodeID).Msg("Became snapshot leader")
 		}
-		s.isLeader.Store(true)
+		s.setLeader(true)
 	} else {
 		if wasLeader {
 			log.Info().Uint64("node_id", s.nodeID).Msg("Lost snapshot leadership")
 		}
-		s.isLeader.Store(false)
+		s.setLeader(false)
 	}
 }
 
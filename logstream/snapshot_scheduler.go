@@ -0,0 +1,215 @@
+package logstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/utils"
+)
+
+const defaultScheduleCheckInterval = 5 * time.Second
+
+// Snapshot triggers, logged with every scheduled snapshot
+const (
+	snapshotTriggerCron     = "cron"
+	snapshotTriggerInterval = "interval"
+	snapshotTriggerEntries  = "entries"
+	snapshotTriggerBytes    = "bytes"
+)
+
+// changeVolume is what was replicated across all shards since the last snapshot
+type changeVolume struct {
+	entries uint64
+	bytes   uint64
+}
+
+// SnapshotScheduler saves snapshots on the snapshot leader at cron times, after the
+// snapshot interval, or once enough entries or bytes were replicated across all shards
+// since the last snapshot.
+type SnapshotScheduler struct {
+	replicator *Replicator
+	cron       *utils.CronSchedule
+	interval   time.Duration
+	maxEntries uint64
+	maxBytes   uint64
+	check      time.Duration
+
+	// Baseline until this node saves its first snapshot
+	started     time.Time
+	startedSeqs map[string]uint64
+	nextCron    time.Time
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewSnapshotScheduler creates a scheduler from the snapshot configuration, failing on
+// invalid cron expressions
+func NewSnapshotScheduler(r *Replicator) (*SnapshotScheduler, error) {
+	current := cfg.Current()
+	conf := current.Snapshot.Schedule
+	s := &SnapshotScheduler{
+		replicator: r,
+		interval:   time.Duration(current.Snapshot.Interval) * time.Millisecond,
+		check:      time.Duration(conf.CheckInterval) * time.Millisecond,
+		stopCh:     make(chan struct{}),
+	}
+
+	if conf.Cron != "" {
+		c, err := utils.ParseCron(conf.Cron)
+		if err != nil {
+			return nil, err
+		}
+
+		s.cron = c
+	}
+
+	if conf.MaxEntries == 0 {
+		s.maxEntries = uint64(max(cfg.Config.ReplicationLog.MaxEntries, 0))
+	} else if conf.MaxEntries > 0 {
+		s.maxEntries = uint64(conf.MaxEntries)
+	}
+
+	if conf.MaxBytes > 0 {
+		s.maxBytes = uint64(conf.MaxBytes)
+	}
+
+	if s.check == 0 {
+		s.check = defaultScheduleCheckInterval
+	}
+
+	return s, nil
+}
+
+// Start begins checking the schedule, snapshots are only saved while this node is the
+// snapshot leader
+func (s *SnapshotScheduler) Start() {
+	s.started = time.Now()
+	s.startedSeqs = s.replicator.repState.all()
+	if s.cron != nil {
+		s.nextCron = s.cron.Next(s.started)
+	}
+
+	s.wg.Add(1)
+	go s.scheduleLoop()
+	log.Info().
+		Str("cron", cfg.Current().Snapshot.Schedule.Cron).
+		Dur("interval", s.interval).
+		Uint64("max_entries", s.maxEntries).
+		Uint64("max_bytes", s.maxBytes).
+		Msg("Snapshot scheduler started")
+}
+
+// Stop waits for the scheduler to finish a snapshot in progress
+func (s *SnapshotScheduler) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+func (s *SnapshotScheduler) scheduleLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case now := <-ticker.C:
+			s.tick(now)
+		}
+	}
+}
+
+func (s *SnapshotScheduler) tick(now time.Time) {
+	cronDue := s.cronDue(now)
+	if !s.replicator.IsSnapshotLeader() {
+		return
+	}
+
+	last, seqs := s.replicator.lastSnapshotState()
+	if last.IsZero() {
+		last, seqs = s.started, s.startedSeqs
+	}
+
+	volume := changeVolume{}
+	if s.maxEntries != 0 || s.maxBytes != 0 {
+		var err error
+		volume, err = s.replicator.changeVolumeSince(seqs, s.maxBytes != 0)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to measure replicated changes for snapshot schedule")
+		}
+	}
+
+	trigger := s.trigger(now, last, cronDue, volume)
+	if trigger == "" {
+		return
+	}
+
+	log.Info().
+		Str("trigger", trigger).
+		Time("last_snapshot", last).
+		Uint64("entries", volume.entries).
+		Uint64("bytes", volume.bytes).
+		Msg("Triggering scheduled snapshot save")
+	s.replicator.SaveSnapshot()
+}
+
+// cronDue tells if a cron time passed, and moves on to the next one
+func (s *SnapshotScheduler) cronDue(now time.Time) bool {
+	if s.cron == nil || s.nextCron.IsZero() || now.Before(s.nextCron) {
+		return false
+	}
+
+	s.nextCron = s.cron.Next(now)
+	return true
+}
+
+// trigger returns why a snapshot is due, or an empty string when it is not
+func (s *SnapshotScheduler) trigger(now, last time.Time, cronDue bool, volume changeVolume) string {
+	switch {
+	case cronDue:
+		return snapshotTriggerCron
+	case s.interval > 0 && now.Sub(last) >= s.interval:
+		return snapshotTriggerInterval
+	case s.maxEntries > 0 && volume.entries >= s.maxEntries:
+		return snapshotTriggerEntries
+	case s.maxBytes > 0 && volume.bytes >= s.maxBytes:
+		return snapshotTriggerBytes
+	}
+
+	return ""
+}
+
+// changeVolumeSince sums up the entries replicated on every shard after the given
+// sequences. Bytes are estimated from the average message size of each stream.
+func (r *Replicator) changeVolumeSince(seqs map[string]uint64, withBytes bool) (changeVolume, error) {
+	volume := changeVolume{}
+	current := r.repState.all()
+	for shard, js := range r.streamMap {
+		strName := streamName(shard, r.compressionEnabled)
+		entries := uint64(0)
+		if seq := current[strName]; seq > seqs[strName] {
+			entries = seq - seqs[strName]
+		}
+
+		volume.entries += entries
+		if !withBytes || entries == 0 {
+			continue
+		}
+
+		info, err := js.StreamInfo(strName)
+		if err != nil {
+			return volume, err
+		}
+
+		if info.State.Msgs > 0 {
+			volume.bytes += entries * (info.State.Bytes / info.State.Msgs)
+		}
+	}
+
+	return volume, nil
+}
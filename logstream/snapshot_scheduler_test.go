@@ -0,0 +1,99 @@
+package logstream
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func TestNewSnapshotScheduler(t *testing.T) {
+	original := cfg.Config.Snapshot
+	defer func() {
+		cfg.Config.Snapshot = original
+	}()
+
+	t.Run("defaults to replication log size", func(t *testing.T) {
+		cfg.Config.Snapshot.Schedule = cfg.SnapshotScheduleConfiguration{}
+		s, err := NewSnapshotScheduler(&Replicator{})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(cfg.Config.ReplicationLog.MaxEntries), s.maxEntries)
+		assert.Zero(t, s.maxBytes)
+		assert.Nil(t, s.cron)
+		assert.Equal(t, defaultScheduleCheckInterval, s.check)
+	})
+
+	t.Run("negative entries disable the threshold", func(t *testing.T) {
+		cfg.Config.Snapshot.Schedule = cfg.SnapshotScheduleConfiguration{MaxEntries: -1, MaxBytes: 1 << 20, Cron: "0 3 * * *"}
+		s, err := NewSnapshotScheduler(&Replicator{})
+		require.NoError(t, err)
+		assert.Zero(t, s.maxEntries)
+		assert.Equal(t, uint64(1<<20), s.maxBytes)
+		assert.NotNil(t, s.cron)
+	})
+
+	t.Run("invalid cron", func(t *testing.T) {
+		cfg.Config.Snapshot.Schedule = cfg.SnapshotScheduleConfiguration{Cron: "0 25 * * *"}
+		_, err := NewSnapshotScheduler(&Replicator{})
+		assert.Error(t, err)
+	})
+}
+
+func TestSnapshotScheduler_Trigger(t *testing.T) {
+	now := time.Now()
+	s := &SnapshotScheduler{interval: time.Hour, maxEntries: 100, maxBytes: 1000}
+
+	assert.Empty(t, s.trigger(now, now.Add(-time.Minute), false, changeVolume{entries: 99, bytes: 999}))
+	assert.Equal(t, snapshotTriggerCron, s.trigger(now, now, true, changeVolume{}))
+	assert.Equal(t, snapshotTriggerInterval, s.trigger(now, now.Add(-time.Hour), false, changeVolume{}))
+	assert.Equal(t, snapshotTriggerEntries, s.trigger(now, now, false, changeVolume{entries: 100}))
+	assert.Equal(t, snapshotTriggerBytes, s.trigger(now, now, false, changeVolume{bytes: 1000}))
+
+	disabled := &SnapshotScheduler{}
+	assert.Empty(t, disabled.trigger(now, time.Time{}, false, changeVolume{entries: 1 << 40, bytes: 1 << 40}))
+}
+
+func TestSnapshotScheduler_CronDue(t *testing.T) {
+	original := cfg.Config.Snapshot.Schedule
+	defer func() {
+		cfg.Config.Snapshot.Schedule = original
+	}()
+
+	cfg.Config.Snapshot.Schedule = cfg.SnapshotScheduleConfiguration{Cron: "CRON_TZ=UTC 0 3 * * *"}
+	s, err := NewSnapshotScheduler(&Replicator{})
+	require.NoError(t, err)
+
+	start := time.Date(2024, 1, 15, 2, 0, 0, 0, time.UTC)
+	s.nextCron = s.cron.Next(start)
+	assert.False(t, s.cronDue(start.Add(59*time.Minute)))
+	assert.True(t, s.cronDue(start.Add(time.Hour+3*time.Second)))
+	assert.False(t, s.cronDue(start.Add(time.Hour+8*time.Second)), "fires once per cron time")
+	assert.Equal(t, time.Date(2024, 1, 16, 3, 0, 0, 0, time.UTC), s.nextCron.UTC())
+}
+
+func TestReplicator_ChangeVolumeSince(t *testing.T) {
+	r := &Replicator{
+		repState: &replicationState{
+			seq: map[string]uint64{
+				streamName(1, false): 150,
+				streamName(2, false): 40,
+				streamName(3, false): 10,
+			},
+			lock: &sync.RWMutex{},
+		},
+		streamMap: map[uint64]nats.JetStreamContext{1: nil, 2: nil, 3: nil},
+	}
+
+	// Writes on every shard count, not only the first one
+	volume, err := r.changeVolumeSince(map[string]uint64{
+		streamName(1, false): 100,
+		streamName(3, false): 20,
+	}, false)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(90), volume.entries)
+	assert.Zero(t, volume.bytes)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/health"
+	"github.com/wongfei2009/harmonylite/logstream"
+	"github.com/wongfei2009/harmonylite/telemetry"
+)
+
+// nodeReloader applies configuration reloads to the running components of a node
+type nodeReloader struct {
+	replicator    *logstream.Replicator
+	streamDB      *db.SqliteStreamDB
+	healthChecker *health.HealthChecker
+	healthServer  *health.HealthServer
+	scheduler     *logstream.SnapshotScheduler
+	cleanupTicker *time.Ticker
+}
+
+// reload re-reads the configuration file and applies the settings that can change while
+// running, the others are reported and keep their value until the next restart
+func (n *nodeReloader) reload() {
+	log.Info().Str("path", *cfg.ConfigPathFlag).Msg("Reloading configuration")
+	res, err := cfg.Reload(*cfg.ConfigPathFlag)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to reload configuration, keeping the running one")
+		return
+	}
+
+	if res.Changed("logging") {
+		setupLogging(os.Stdout)
+	}
+
+	if res.Changed("cleanup_interval") && n.cleanupTicker != nil {
+		n.cleanupTicker.Reset(cleanupInterval())
+	}
+
+	if n.scheduler != nil && (res.Changed("snapshot.interval") || res.Changed("snapshot.schedule")) {
+		n.restartScheduler()
+	}
+
+	// The server holds the configuration it was started with
+	if n.healthServer != nil && res.Changed("health_check") {
+		n.restartHealthServer()
+	}
+
+	if res.Changed("include_tables") {
+		n.refreshWatchedTables()
+	}
+
+	if res.Changed("prometheus.bind") {
+		if err := telemetry.RestartServer(); err != nil {
+			log.Error().Err(err).Msg("Unable to restart metrics server")
+		}
+	}
+
+	// Certificates are re-read even when their paths didn't change, so rotated files are used
+	// on the next reconnect
+	if err := n.replicator.ReloadCertificates(); err != nil {
+		log.Error().Err(err).Msg("Unable to reload NATS certificates")
+	}
+
+	log.Info().Strs("applied", res.Applied).Msg("Configuration reloaded")
+	if len(res.Restart) > 0 {
+		log.Warn().Strs("keys", res.Restart).Msg("Configuration changes need a restart to take effect")
+	}
+}
+
+func (n *nodeReloader) restartScheduler() {
+	scheduler, err := logstream.NewSnapshotScheduler(n.replicator)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid snapshot schedule, keeping the running one")
+		return
+	}
+
+	n.scheduler.Stop()
+	n.scheduler = scheduler
+	n.scheduler.Start()
+}
+
+// refreshWatchedTables starts and stops watching tables after include_tables changed, and
+// publishes the new schema hash
+func (n *nodeReloader) refreshWatchedTables() {
+	hash := ""
+	err := n.replicator.HoldApplying(func() (err error) {
+		hash, err = n.streamDB.RefreshWatchedTables()
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to update watched tables")
+		return
+	}
+
+	log.Info().Strs("tables", n.streamDB.GetSchemaTables()).Msg("Watched tables updated")
+	if err := n.replicator.PublishSchemaState(hash, n.streamDB.GetPreviousHash()); err != nil {
+		log.Warn().Err(err).Msg("Failed to publish schema state to registry")
+	}
+}
+
+func (n *nodeReloader) restartHealthServer() {
+	if err := n.healthServer.Stop(); err != nil {
+		log.Warn().Err(err).Msg("Error stopping health check server")
+	}
+
+	n.healthServer = health.NewHealthServer(cfg.Current().HealthCheck, n.healthChecker)
+	if err := n.healthServer.Start(); err != nil {
+		log.Warn().Err(err).Msg("Failed to start health check server")
+	}
+}
+
+func cleanupInterval() time.Duration {
+	return time.Duration(cfg.Current().CleanupInterval) * time.Millisecond
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/logstream"
+	"github.com/wongfei2009/harmonylite/version"
+)
+
+const schemaUsage = `Usage: harmonylite schema <command> [options]
+
+Commands:
+  status [options]                   Show the local schema, or the cluster schema with -cluster
+  migrate [options] <migration.sql>  Apply a migration on every node in lockstep
+  migrate -resume                    Lift a publishing pause left by an interrupted migration`
+
+type localSchemaStatus struct {
+	NodeID             uint64   `json:"node_id"`
+	HarmonyLiteVersion string   `json:"harmonylite_version"`
+	SchemaHash         string   `json:"schema_hash"`
+	PreviousHash       string   `json:"previous_hash,omitempty"`
+	Tables             []string `json:"tables"`
+}
+
+type clusterSchemaStatus struct {
+	Nodes       map[uint64]*logstream.NodeSchemaState `json:"nodes"`
+	Consistency *logstream.SchemaConsistencyReport    `json:"consistency,omitempty"`
+	History     *logstream.SchemaHistory              `json:"history,omitempty"`
+}
+
+func runSchemaCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, schemaUsage)
+		return fmt.Errorf("schema command required")
+	}
+
+	switch args[0] {
+	case "status":
+		return schemaStatus(args[1:])
+	case "migrate":
+		return schemaMigrate(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, schemaUsage)
+	return fmt.Errorf("unknown schema command %q", args[0])
+}
+
+func schemaStatus(args []string) error {
+	fs := newFlagSet("schema status", "")
+	cluster := fs.Bool("cluster", false, "Show the schema of every node in the cluster")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if *cluster {
+		return clusterSchema(*output)
+	}
+
+	return localSchema(*output)
+}
+
+func localSchema(output string) error {
+	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
+	if err != nil {
+		return err
+	}
+
+	tables, err := db.GetAllDBTables(cfg.Config.DBPath)
+	if err != nil {
+		return fmt.Errorf("listing tables: %w", err)
+	}
+
+	status := localSchemaStatus{
+		NodeID:             cfg.Config.NodeID,
+		HarmonyLiteVersion: version.Get().Version,
+		SchemaHash:         streamDB.GetSchemaHash(),
+		PreviousHash:       streamDB.GetPreviousHash(),
+		Tables:             tables,
+	}
+
+	return printOutput(output, status, func() {
+		fmt.Println("Local Schema Status")
+		fmt.Println("===================")
+
+		if status.SchemaHash == "" {
+			fmt.Println("Schema hash: Not initialized")
+			return
+		}
+
+		fmt.Printf("Schema Hash: %s\n", status.SchemaHash)
+		fmt.Printf("Node ID: %d\n", status.NodeID)
+		fmt.Printf("HarmonyLite Version: %s\n", status.HarmonyLiteVersion)
+
+		fmt.Println("\nWatched Tables:")
+		for _, table := range status.Tables {
+			fmt.Printf("  - %s\n", table)
+		}
+	})
+}
+
+func clusterSchema(output string) error {
+	replicator, err := logstream.NewReplicator(nil)
+	if err != nil {
+		return err
+	}
+
+	states, err := replicator.GetClusterSchemaState()
+	if err != nil {
+		return fmt.Errorf("retrieving cluster schema state: %w", err)
+	}
+
+	status := clusterSchemaStatus{Nodes: states}
+	if len(states) > 0 {
+		status.Consistency, err = replicator.CheckClusterSchemaConsistency()
+		if err != nil {
+			return fmt.Errorf("checking consistency: %w", err)
+		}
+
+		if history, err := replicator.GetSchemaHistory(); err == nil && len(history.Versions) > 0 {
+			status.History = history
+		}
+	}
+
+	return printOutput(output, status, func() {
+		printClusterSchemaStatus(&status)
+	})
+}
+
+func printClusterSchemaStatus(status *clusterSchemaStatus) {
+	fmt.Println("Cluster Schema Status")
+	fmt.Println("=====================")
+
+	if len(status.Nodes) == 0 {
+		fmt.Println("No schema state information available from cluster")
+		return
+	}
+
+	fmt.Printf("Total Nodes: %d\n", len(status.Nodes))
+	if status.Consistency.Consistent {
+		fmt.Println("Consistent: Yes")
+	} else {
+		fmt.Println("Consistent: No")
+	}
+
+	nodeIDs := make([]uint64, 0, len(status.Nodes))
+	for nodeID := range status.Nodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool {
+		return nodeIDs[i] < nodeIDs[j]
+	})
+
+	// Group nodes by hash
+	hashes := make([]string, 0)
+	hashGroups := make(map[string][]uint64)
+	for _, nodeID := range nodeIDs {
+		hash := status.Nodes[nodeID].SchemaHash
+		if _, ok := hashGroups[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+		hashGroups[hash] = append(hashGroups[hash], nodeID)
+	}
+
+	fmt.Println("\nHash Groups:")
+	for _, hash := range hashes {
+		fmt.Printf("  %s: ", shortHash(hash))
+		for i, nodeID := range hashGroups[hash] {
+			if i > 0 {
+				fmt.Print(", ")
+			}
+			fmt.Printf("Node %d", nodeID)
+		}
+		fmt.Println()
+	}
+
+	// Show detailed node information
+	fmt.Println("\nNode Details:")
+	for _, nodeID := range nodeIDs {
+		state := status.Nodes[nodeID]
+		fmt.Printf("  Node %d:\n", nodeID)
+		fmt.Printf("    Schema Hash: %s\n", state.SchemaHash)
+		fmt.Printf("    HarmonyLite Version: %s\n", state.HarmonyLiteVersion)
+		fmt.Printf("    Updated At: %s\n", state.UpdatedAt.Format(time.RFC3339))
+	}
+
+	// Show ordered schema history
+	if status.History != nil {
+		fmt.Println("\nSchema History:")
+		for _, v := range status.History.Versions {
+			migration := v.Migration
+			if migration == "" {
+				migration = "-"
+			}
+			fmt.Printf("  v%d: %s (migration: %s, recorded by Node %d at %s)\n",
+				v.Version, shortHash(v.SchemaHash), migration, v.NodeId, v.CreatedAt.Format(time.RFC3339))
+		}
+	}
+
+	// Show mismatches if any
+	if !status.Consistency.Consistent {
+		fmt.Println("\nSchema Mismatches:")
+		for _, mismatch := range status.Consistency.Mismatches {
+			fmt.Printf("  Node %d: hash mismatch (expected: %s, actual: %s)\n",
+				mismatch.NodeId, shortHash(mismatch.ExpectedHash), shortHash(mismatch.ActualHash))
+		}
+	}
+}
+
+func schemaMigrate(args []string) error {
+	fs := newFlagSet("schema migrate", "<migration.sql>")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time to wait for each node to apply the migration")
+	settle := fs.Duration("settle", 5*time.Second, "Time to wait for in-flight events after pausing publishing")
+	resume := fs.Bool("resume", false, "Lift the cluster-wide publishing pause instead of running a migration")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if *resume {
+		replicator, err := logstream.NewReplicator(nil)
+		if err != nil {
+			return err
+		}
+
+		if err := replicator.ResumeClusterPublishing(); err != nil {
+			return err
+		}
+
+		fmt.Println("Publishing resumed cluster-wide")
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("migration file required")
+	}
+
+	migration, err := logstream.LoadMigration(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	replicator, err := logstream.NewReplicator(nil)
+	if err != nil {
+		return err
+	}
+
+	report, err := replicator.RunMigration(migration, logstream.MigrationOptions{
+		Timeout: *timeout,
+		Settle:  *settle,
+	})
+	if report != nil {
+		pErr := printOutput(*output, report, func() {
+			fmt.Printf("Migration: %s\n", report.Name)
+			fmt.Printf("From Hash: %s\n", report.FromHash)
+			fmt.Printf("To Hash: %s\n", report.ToHash)
+			fmt.Printf("Applied On: %v\n", report.Applied)
+			if len(report.RolledBack) > 0 {
+				fmt.Printf("Rolled Back On: %v\n", report.RolledBack)
+			}
+		})
+		if err == nil {
+			err = pErr
+		}
+	}
+
+	return err
+}
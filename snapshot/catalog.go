@@ -0,0 +1,176 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/db"
+)
+
+// LatestSnapshotID selects the newest snapshot in Catalog lookups
+const LatestSnapshotID = "latest"
+
+var ErrSnapshotInUse = errors.New("snapshot is the base of incremental snapshots")
+
+// Catalog lists and manages the snapshots of a storage, without a database
+type Catalog struct {
+	snapshots *NatsDBSnapshot
+}
+
+func NewCatalog(storage Storage) *Catalog {
+	return &Catalog{snapshots: NewNatsDBSnapshot(nil, storage)}
+}
+
+// List returns snapshot versions, newest first
+func (c *Catalog) List() ([]*IndexEntry, error) {
+	idx, err := c.snapshots.downloadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.Newest(), nil
+}
+
+// Inspect returns the index entry of a snapshot along with its manifest
+func (c *Catalog) Inspect(id string) (*IndexEntry, *Manifest, error) {
+	_, entry, err := c.find(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &Manifest{}
+	err = downloadJSON(c.snapshots.storage, entry.ManifestName(), manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("downloading manifest: %w", err)
+	}
+
+	return entry, manifest, nil
+}
+
+// Download saves a verified copy of a snapshot to p, which must not exist
+func (c *Catalog) Download(id, p string) (*Manifest, error) {
+	return c.withSnapshot(id, func(bkFilePath string) error {
+		return copyNewFile(p, bkFilePath)
+	})
+}
+
+// Restore replaces the database at p with a snapshot, the database is created when missing.
+// Nothing may be using the database meanwhile.
+func (c *Catalog) Restore(id, p string) (*Manifest, error) {
+	return c.withSnapshot(id, func(bkFilePath string) error {
+		return db.RestoreFrom(p, bkFilePath)
+	})
+}
+
+// Delete removes a snapshot from the index and storage. Bases of incremental snapshots
+// can only be deleted along with their increments.
+func (c *Catalog) Delete(id string) error {
+	idx, entry, err := c.find(id)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range idx.Snapshots {
+		if e.Base == entry.ID {
+			return fmt.Errorf("%w: %s is needed by %s", ErrSnapshotInUse, entry.ID, e.ID)
+		}
+	}
+
+	kept := make([]*IndexEntry, 0, len(idx.Snapshots))
+	for _, e := range idx.Snapshots {
+		if e.ID != entry.ID {
+			kept = append(kept, e)
+		}
+	}
+	idx.Snapshots = kept
+
+	err = uploadJSON(c.snapshots.storage, indexFileName, idx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range entry.ObjectNames() {
+		if err := c.snapshots.storage.Delete(name); err != nil {
+			log.Warn().Err(err).Str("name", name).Msg("Unable to delete snapshot object")
+		}
+	}
+
+	return nil
+}
+
+// withSnapshot downloads and verifies a snapshot into a temporary directory for use
+func (c *Catalog) withSnapshot(id string, use func(bkFilePath string) error) (*Manifest, error) {
+	idx, entry, err := c.find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpSnapshotPath, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupDir(tmpSnapshotPath)
+
+	bkFilePath, manifest, err := c.snapshots.downloadVersion(tmpSnapshotPath, idx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = use(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// find looks up a snapshot by ID, LatestSnapshotID (or an empty ID) selects the newest one
+func (c *Catalog) find(id string) (*Index, *IndexEntry, error) {
+	idx, err := c.snapshots.downloadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entry *IndexEntry
+	if id == "" || id == LatestSnapshotID {
+		if newest := idx.Newest(); len(newest) > 0 {
+			entry = newest[0]
+		}
+	} else {
+		entry = idx.Find(id)
+	}
+
+	if entry == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoSnapshotFound, id)
+	}
+
+	return idx, entry, nil
+}
+
+// copyNewFile copies src to a new file at dst
+func copyNewFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
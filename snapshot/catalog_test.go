@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func TestCatalog(t *testing.T) {
+	original := cfg.Config.Snapshot
+	defer func() {
+		cfg.Config.Snapshot = original
+	}()
+	cfg.Config.Snapshot.Incremental = cfg.SnapshotIncrementalConfiguration{Enable: true, FullEvery: 6}
+	cfg.Config.Snapshot.Retention = cfg.SnapshotRetentionConfiguration{KeepLast: 10}
+
+	storage := &fileStorage{dir: t.TempDir()}
+	source := openTestStreamDB(t, "source.db", 100, false)
+	snapshot := NewNatsDBSnapshot(source, storage)
+	require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 1}))
+	time.Sleep(2 * time.Millisecond)
+	execTestSQL(t, source.GetPath(), `INSERT INTO items (name) VALUES ('next')`)
+	require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 2}))
+
+	catalog := NewCatalog(storage)
+	entries, err := catalog.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	full, latest := entries[1], entries[0]
+	assert.Equal(t, full.ID, latest.Base)
+
+	t.Run("inspect", func(t *testing.T) {
+		entry, manifest, err := catalog.Inspect(LatestSnapshotID)
+		require.NoError(t, err)
+		assert.Equal(t, latest.ID, entry.ID)
+		assert.Equal(t, uint64(2), manifest.Sequences["stream"])
+		assert.Equal(t, entry.SHA256, manifest.SHA256)
+
+		_, _, err = catalog.Inspect("missing")
+		assert.ErrorIs(t, err, ErrNoSnapshotFound)
+	})
+
+	t.Run("download", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "snapshot.db")
+		manifest, err := catalog.Download(full.ID, p)
+		require.NoError(t, err)
+		assert.Equal(t, full.ID, manifest.ID)
+		assert.Equal(t, 100, countTestRows(t, p))
+
+		_, err = catalog.Download(full.ID, p)
+		assert.Error(t, err)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := catalog.Restore("", target.GetPath())
+		require.NoError(t, err)
+		assert.Equal(t, latest.ID, manifest.ID)
+		assert.Equal(t, 101, countTestRows(t, target.GetPath()))
+
+		p := filepath.Join(t.TempDir(), "new.db")
+		_, err = catalog.Restore(full.ID, p)
+		require.NoError(t, err)
+		assert.Equal(t, 100, countTestRows(t, p))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.ErrorIs(t, catalog.Delete(full.ID), ErrSnapshotInUse)
+
+		require.NoError(t, catalog.Delete(latest.ID))
+		require.NoError(t, catalog.Delete(full.ID))
+
+		entries, err := catalog.List()
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+		assert.ErrorIs(t, storage.Download(full.DataName(), io.Discard), ErrNoSnapshotFound)
+	})
+}
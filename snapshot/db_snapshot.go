@@ -1,23 +1,41 @@
 package snapshot
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
 	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/telemetry"
 )
 
 var ErrPendingSnapshot = errors.New("system busy capturing snapshot")
+var ErrNoValidSnapshot = errors.New("no valid snapshot found")
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
 
 const snapshotFileName = "snapshot.db"
 const tempDirPattern = "harmonylite-snapshot-*"
+const defaultCompressionLevel = 3
+
+// sizeMetric is created on first save, catalogs create snapshots too
+var sizeMetric = sync.OnceValue(func() telemetry.Gauge {
+	return telemetry.NewGauge("snapshot_size_bytes", "Database size of the last snapshot saved by this node, before compression")
+})
+
+// keyedStorage is implemented by storages encrypting objects
+type keyedStorage interface {
+	ActiveKeyID() string
+}
 
 type NatsDBSnapshot struct {
 	mutex   *sync.Mutex
@@ -33,7 +51,7 @@ func NewNatsDBSnapshot(d *db.SqliteStreamDB, snapshotStorage Storage) *NatsDBSna
 	}
 }
 
-func (n *NatsDBSnapshot) SaveSnapshot() error {
+func (n *NatsDBSnapshot) SaveSnapshot(sequences map[string]uint64) error {
 	locked := n.mutex.TryLock()
 	if !locked {
 		return ErrPendingSnapshot
@@ -46,46 +64,524 @@ func (n *NatsDBSnapshot) SaveSnapshot() error {
 	}
 	defer cleanupDir(tmpSnapshot)
 
+	// Sequences are captured by the caller before the backup starts, so the snapshot
+	// contains at least every event they cover
+	now := time.Now().UTC()
+	level := compressionLevel()
+	manifest := &Manifest{
+		ID:         newSnapshotID(now),
+		NodeID:     cfg.Config.NodeID,
+		SchemaHash: n.db.GetSchemaHash(),
+		CreatedAt:  now,
+		Compressed: level > 0,
+		Sequences:  sequences,
+	}
+
+	if ks, ok := n.storage.(keyedStorage); ok {
+		manifest.KeyID = ks.ActiveKeyID()
+	}
+
 	bkFilePath := path.Join(tmpSnapshot, snapshotFileName)
 	err = n.db.BackupTo(bkFilePath)
 	if err != nil {
 		return err
 	}
 
-	return n.storage.Upload(snapshotFileName, bkFilePath)
+	info, err := os.Stat(bkFilePath)
+	if err != nil {
+		return err
+	}
+
+	entry := &IndexEntry{ID: manifest.ID, CreatedAt: now, Size: info.Size()}
+	if incremental, _ := incrementalPolicy(); incremental {
+		err = n.uploadIncremental(entry, bkFilePath, level)
+	} else {
+		entry.SHA256, err = uploadFile(n.storage, entry.DataName(), bkFilePath, level)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	manifest.SHA256 = entry.SHA256
+	manifest.Size = entry.Size
+	manifest.Base = entry.Base
+	err = uploadJSON(n.storage, entry.ManifestName(), manifest)
+	if err != nil {
+		return err
+	}
+
+	err = n.updateIndex(entry)
+	if err != nil {
+		return err
+	}
+
+	sizeMetric().Set(float64(entry.Size))
+	return nil
 }
 
-func (n *NatsDBSnapshot) RestoreSnapshot() error {
+// uploadIncremental uploads only pages changed since the latest full snapshot, or a full
+// snapshot along with its page map when one is due
+func (n *NatsDBSnapshot) uploadIncremental(entry *IndexEntry, bkFilePath string, level int) error {
+	pages, digest, err := hashPages(bkFilePath)
+	if err != nil {
+		return err
+	}
+	entry.SHA256 = digest
+
+	base, basePages := n.incrementalBase(pages.pageSize)
+	if base != nil {
+		changed := pages.changedPages(basePages)
+		if float64(len(changed)) <= maxDeltaRatio*float64(pages.pageCount()) {
+			entry.Base = base.ID
+			log.Info().
+				Str("base", base.ID).
+				Int("changed_pages", len(changed)).
+				Int("total_pages", pages.pageCount()).
+				Msg("Uploading incremental snapshot")
+
+			return uploadStream(n.storage, entry.DataName(), func(w io.Writer) error {
+				return compressedWriter(w, level, func(w io.Writer) error {
+					return writeDelta(w, bkFilePath, pages, changed)
+				})
+			})
+		}
+
+		log.Info().Int("changed_pages", len(changed)).Msg("Too many pages changed, uploading full snapshot")
+	}
+
+	_, err = uploadFile(n.storage, entry.DataName(), bkFilePath, level)
+	if err != nil {
+		return err
+	}
+
+	data, err := pages.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = n.storage.Upload(entry.PagesName(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	entry.Pages = true
+	return nil
+}
+
+// incrementalBase returns the latest full snapshot to diff against along with its page map,
+// nil when there is none or a full snapshot is due
+func (n *NatsDBSnapshot) incrementalBase(pageSize int) (*IndexEntry, *pageMap) {
+	idx, err := n.downloadIndex()
+	if err != nil {
+		return nil, nil
+	}
+
+	_, fullEvery := incrementalPolicy()
+	deltas := 0
+	for _, e := range idx.Newest() {
+		if e.Base != "" {
+			deltas++
+			continue
+		}
+
+		if !e.Pages || deltas+1 >= fullEvery {
+			return nil, nil
+		}
+
+		buf := &bytes.Buffer{}
+		err := n.storage.Download(e.PagesName(), buf)
+		if err != nil {
+			log.Warn().Err(err).Str("id", e.ID).Msg("Unable to download snapshot page map, uploading full snapshot")
+			return nil, nil
+		}
+
+		m := &pageMap{}
+		if err := m.UnmarshalBinary(buf.Bytes()); err != nil || m.pageSize != pageSize {
+			return nil, nil
+		}
+
+		return e, m
+	}
+
+	return nil, nil
+}
+
+// updateIndex adds entry to the snapshot index and removes versions outside the retention policy.
+// Objects are only deleted once the index no longer references them.
+func (n *NatsDBSnapshot) updateIndex(entry *IndexEntry) error {
+	idx, err := n.downloadIndex()
+	if err == ErrNoSnapshotFound {
+		idx = &Index{}
+	} else if err != nil {
+		return err
+	}
+
+	idx.Add(entry)
+	keepLast, keepDaily := retentionPolicy()
+	removed := idx.ApplyRetention(keepLast, keepDaily, entry.CreatedAt)
+
+	err = uploadJSON(n.storage, indexFileName, idx)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range removed {
+		for _, name := range e.ObjectNames() {
+			if err := n.storage.Delete(name); err != nil {
+				log.Warn().Err(err).Str("name", name).Msg("Unable to delete expired snapshot")
+			}
+		}
+
+		log.Info().Str("id", e.ID).Msg("Expired snapshot removed")
+	}
+
+	return nil
+}
+
+// downloadIndex returns the snapshot index, rebuilt from the snapshot manifests when it is
+// missing. ErrNoSnapshotFound is only returned when no versioned snapshot exists at all.
+func (n *NatsDBSnapshot) downloadIndex() (*Index, error) {
+	idx := &Index{}
+	err := downloadJSON(n.storage, indexFileName, idx)
+	if err == ErrNoSnapshotFound {
+		return n.rebuildIndex()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot index: %w", err)
+	}
+
+	return idx, nil
+}
+
+// rebuildIndex lists the versioned snapshots in storage from their manifests, so versions
+// are still restored and expired once the index is lost
+func (n *NatsDBSnapshot) rebuildIndex() (*Index, error) {
+	names, err := n.storage.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshot objects: %w", err)
+	}
+
+	stored := map[string]bool{}
+	for _, name := range names {
+		stored[name] = true
+	}
+
+	idx := &Index{}
+	for _, name := range names {
+		id, ok := strings.CutPrefix(name, "snapshot-")
+		if id, ok = strings.CutSuffix(id, ".json"); !ok {
+			continue
+		}
+
+		// Skips the index and anything else not named after a snapshot ID
+		if _, err := time.Parse(snapshotIDFormat, id); err != nil {
+			continue
+		}
+
+		entry := &IndexEntry{ID: id}
+		manifest := &Manifest{}
+		if err := downloadJSON(n.storage, entry.ManifestName(), manifest); err != nil {
+			return nil, fmt.Errorf("reading snapshot manifest %s: %w", id, err)
+		}
+
+		entry.CreatedAt = manifest.CreatedAt
+		entry.SHA256 = manifest.SHA256
+		entry.Size = manifest.Size
+		entry.Base = manifest.Base
+		entry.Pages = stored[entry.PagesName()]
+		if !stored[entry.DataName()] {
+			continue
+		}
+
+		idx.Add(entry)
+	}
+
+	if len(idx.Snapshots) == 0 {
+		return nil, ErrNoSnapshotFound
+	}
+
+	log.Info().Int("snapshots", len(idx.Snapshots)).Msg("Snapshot index not found, listed snapshots from their manifests")
+	return idx, nil
+}
+
+func (n *NatsDBSnapshot) RestoreSnapshot(check ManifestCheck) (*Manifest, error) {
+	return n.restore(false, check)
+}
+
+// BootstrapSnapshot restores the latest snapshot into a newly created database,
+// unlike RestoreSnapshot it fails with ErrNoSnapshotFound when there is nothing to restore
+func (n *NatsDBSnapshot) BootstrapSnapshot(check ManifestCheck) (*Manifest, error) {
+	return n.restore(true, check)
+}
+
+// restore applies the newest snapshot passing verification, falling back to older versions.
+// Older versions aren't tried when check rejects a manifest, they would be rejected as well.
+func (n *NatsDBSnapshot) restore(required bool, check ManifestCheck) (*Manifest, error) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
 	tmpSnapshotPath, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer cleanupDir(tmpSnapshotPath)
 
-	bkFilePath := path.Join(tmpSnapshotPath, snapshotFileName)
-	err = n.storage.Download(bkFilePath, snapshotFileName)
+	idx, err := n.downloadIndex()
 	if err == ErrNoSnapshotFound {
+		return n.restoreLegacy(tmpSnapshotPath, required, check)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(idx.Snapshots) == 0 {
+		if required {
+			return nil, ErrNoSnapshotFound
+		}
+
+		log.Warn().Msg("Snapshot index is empty, system will now continue without restoring snapshot")
+		return nil, nil
+	}
+
+	var lastErr error
+	for _, entry := range idx.Newest() {
+		bkFilePath, manifest, err := n.downloadVersion(tmpSnapshotPath, idx, entry)
+		if err != nil {
+			log.Warn().Err(err).Str("id", entry.ID).Msg("Snapshot failed verification, falling back to older snapshot")
+			lastErr = err
+			continue
+		}
+
+		if check != nil {
+			if err := check(manifest); err != nil {
+				return nil, err
+			}
+		}
+
+		log.Info().Str("id", entry.ID).Str("path", bkFilePath).Msg("Downloaded snapshot, restoring...")
+		err = n.replaceDB(bkFilePath, required)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info().Str("id", entry.ID).Msg("Restore complete...")
+		return manifest, nil
+	}
+
+	return nil, fmt.Errorf("%w: %d snapshots failed verification, last error: %v", ErrNoValidSnapshot, len(idx.Snapshots), lastErr)
+}
+
+// downloadVersion downloads and verifies a snapshot version along with its manifest.
+// Incremental snapshots are reassembled from their base and delta.
+func (n *NatsDBSnapshot) downloadVersion(dir string, idx *Index, entry *IndexEntry) (string, *Manifest, error) {
+	var bkFilePath string
+	var err error
+	if entry.Base != "" {
+		bkFilePath, err = n.downloadIncremental(dir, idx, entry)
+	} else {
+		bkFilePath = path.Join(dir, entry.DataName())
+		err = downloadFile(n.storage, entry.DataName(), bkFilePath)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = verifySnapshot(bkFilePath, entry)
+	if err != nil {
+		return "", nil, err
+	}
+
+	manifest := &Manifest{}
+	err = downloadJSON(n.storage, entry.ManifestName(), manifest)
+	if err != nil {
+		return "", nil, fmt.Errorf("downloading manifest: %w", err)
+	}
+
+	return bkFilePath, manifest, nil
+}
+
+func (n *NatsDBSnapshot) downloadIncremental(dir string, idx *Index, entry *IndexEntry) (string, error) {
+	base := idx.Find(entry.Base)
+	if base == nil {
+		return "", fmt.Errorf("%w: base snapshot %s missing from index", ErrCorruptSnapshot, entry.Base)
+	}
+
+	bkFilePath := path.Join(dir, fmt.Sprintf("snapshot-%s.db", entry.ID))
+	err := downloadFile(n.storage, base.DataName(), bkFilePath)
+	if err != nil {
+		return "", fmt.Errorf("downloading base snapshot %s: %w", base.ID, err)
+	}
+
+	deltaPath := path.Join(dir, entry.DataName())
+	err = downloadFile(n.storage, entry.DataName(), deltaPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(deltaPath)
+
+	return bkFilePath, applyDelta(bkFilePath, deltaPath)
+}
+
+// restoreLegacy restores snapshots saved under fixed names, before snapshots were versioned
+func (n *NatsDBSnapshot) restoreLegacy(dir string, required bool, check ManifestCheck) (*Manifest, error) {
+	bkFilePath := path.Join(dir, snapshotFileName)
+	err := downloadFile(n.storage, snapshotFileName, bkFilePath)
+	if err == ErrNoSnapshotFound && !required {
 		log.Warn().Err(err).Msg("System will now continue without restoring snapshot")
-		return nil
+		return nil, nil
 	}
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = checkIntegrity(bkFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := n.downloadLegacyManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest != nil && check != nil {
+		if err := check(manifest); err != nil {
+			return nil, err
+		}
 	}
 
 	log.Info().Str("path", bkFilePath).Msg("Downloaded snapshot, restoring...")
-	err = db.RestoreFrom(n.db.GetPath(), bkFilePath)
+	err = n.replaceDB(bkFilePath, required)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Info().Str("path", bkFilePath).Msg("Restore complete...")
+	return manifest, nil
+}
+
+// downloadLegacyManifest fetches the fixed name manifest, returning nil when there is none
+func (n *NatsDBSnapshot) downloadLegacyManifest() (*Manifest, error) {
+	manifest := &Manifest{}
+	err := downloadJSON(n.storage, manifestFileName, manifest)
+	if err == ErrNoSnapshotFound {
+		log.Warn().Msg("Snapshot has no manifest, replication watermark is unknown")
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// RestoreFile replaces the database with the snapshot at p, after checking it against the
+// manifest checksum and running an integrity check
+func (n *NatsDBSnapshot) RestoreFile(p string, manifest *Manifest) error {
+	return n.restoreFile(p, manifest, false)
+}
+
+// BootstrapFile is RestoreFile for a newly created database
+func (n *NatsDBSnapshot) BootstrapFile(p string, manifest *Manifest) error {
+	return n.restoreFile(p, manifest, true)
+}
+
+func (n *NatsDBSnapshot) restoreFile(p string, manifest *Manifest, bootstrap bool) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if manifest.SHA256 != "" {
+		digest, err := fileHash(p)
+		if err != nil {
+			return err
+		}
+
+		if digest != manifest.SHA256 {
+			return fmt.Errorf("%w: sha256 mismatch (expected %s, got %s)", ErrCorruptSnapshot, manifest.SHA256, digest)
+		}
+	}
+
+	err := checkIntegrity(p)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("id", manifest.ID).Uint64("from_node", manifest.NodeID).Msg("Restoring snapshot...")
+	err = n.replaceDB(p, bootstrap)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("id", manifest.ID).Msg("Restore complete...")
 	return nil
 }
 
+// replaceDB replaces the database with a verified snapshot, online restores copy it into
+// the live database instead of replacing its files. Bootstraps always replace the files: the
+// database was just created and isn't used yet, and its page size may differ from the snapshot.
+func (n *NatsDBSnapshot) replaceDB(bkFilePath string, bootstrap bool) error {
+	if cfg.Config.Snapshot.RestoreMode == cfg.OnlineRestore && !bootstrap {
+		return n.db.RestoreOnline(bkFilePath)
+	}
+
+	return db.RestoreFrom(n.db.GetPath(), bkFilePath)
+}
+
+// verifySnapshot checks a downloaded snapshot against its index entry and runs an SQLite
+// integrity check, so a corrupt snapshot never replaces the database
+func verifySnapshot(p string, entry *IndexEntry) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	// Entries rebuilt from manifests written before sizes were recorded have no size
+	if entry.Size > 0 && info.Size() != entry.Size {
+		return fmt.Errorf("%w: size mismatch (expected %d bytes, got %d)", ErrCorruptSnapshot, entry.Size, info.Size())
+	}
+
+	if entry.SHA256 != "" {
+		digest, err := fileHash(p)
+		if err != nil {
+			return err
+		}
+
+		if digest != entry.SHA256 {
+			return fmt.Errorf("%w: sha256 mismatch (expected %s, got %s)", ErrCorruptSnapshot, entry.SHA256, digest)
+		}
+	}
+
+	return checkIntegrity(p)
+}
+
+func checkIntegrity(p string) error {
+	if err := db.IntegrityCheck(p); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	return nil
+}
+
+// compressionLevel returns the configured zstd level, 0 when compression is disabled
+func compressionLevel() int {
+	c := cfg.Config.Snapshot.Compression
+	if !c.Enable {
+		return 0
+	}
+
+	if c.Level < 1 {
+		return defaultCompressionLevel
+	}
+
+	return c.Level
+}
+
 func cleanupDir(p string) {
 	for i := 0; i < 5; i++ {
 		err := os.RemoveAll(p)
@@ -107,10 +603,10 @@ func fileHash(p string) (string, error) {
 	}
 	defer f.Close()
 
-	h := fnv.New64()
+	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", h.Sum64()), nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -3,6 +3,7 @@ package snapshot
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"sync"
@@ -39,16 +40,31 @@ type MockStorage struct {
 	mock.Mock
 }
 
-func (m *MockStorage) Upload(name, filePath string) error {
-	args := m.Called(name, filePath)
+func (m *MockStorage) Upload(name string, rd io.Reader) error {
+	args := m.Called(name, rd)
 	return args.Error(0)
 }
 
-func (m *MockStorage) Download(filePath, name string) error {
-	args := m.Called(filePath, name)
+func (m *MockStorage) Download(name string, w io.Writer) error {
+	args := m.Called(name, w)
 	return args.Error(0)
 }
 
+func (m *MockStorage) Delete(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockStorage) List() ([]string, error) {
+	args := m.Called()
+	return args.Get(0).([]string), args.Error(1)
+}
+
+// createBackupFile writes an empty backup at the path BackupTo is called with
+func createBackupFile(args mock.Arguments) {
+	_ = os.WriteFile(args.String(0), nil, 0644)
+}
+
 // Create a test version of NatsDBSnapshot that uses our interface
 type testNatsDBSnapshot struct {
 	mutex   *sync.Mutex
@@ -85,7 +101,13 @@ func (n *testNatsDBSnapshot) SaveSnapshot() error {
 		return err
 	}
 
-	return n.storage.Upload(snapshotFileName, bkFilePath)
+	f, err := os.Open(bkFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return n.storage.Upload(snapshotFileName, f)
 }
 
 // Copy of the RestoreSnapshot method but adapted for our test struct
@@ -101,7 +123,13 @@ func (n *testNatsDBSnapshot) RestoreSnapshot(restoreFromFn func(destPath, bkFile
 	defer cleanupDir(tmpSnapshotPath)
 
 	bkFilePath := path.Join(tmpSnapshotPath, snapshotFileName)
-	err = n.storage.Download(bkFilePath, snapshotFileName)
+	f, err := os.Create(bkFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = n.storage.Download(snapshotFileName, f)
 	if err == ErrNoSnapshotFound {
 		return nil
 	}
@@ -129,8 +157,8 @@ func TestNatsDBSnapshot_SaveSnapshot(t *testing.T) {
 		snapshot := newTestSnapshot(mockDB, mockStorage)
 
 		// Set expectations
-		mockDB.On("BackupTo", mock.AnythingOfType("string")).Return(nil)
-		mockStorage.On("Upload", snapshotFileName, mock.AnythingOfType("string")).Return(nil)
+		mockDB.On("BackupTo", mock.AnythingOfType("string")).Run(createBackupFile).Return(nil)
+		mockStorage.On("Upload", snapshotFileName, mock.Anything).Return(nil)
 
 		// Call the method
 		err := snapshot.SaveSnapshot()
@@ -202,8 +230,8 @@ func TestNatsDBSnapshot_SaveSnapshot(t *testing.T) {
 		expectedErr := errors.New("upload failed")
 
 		// Set expectations
-		mockDB.On("BackupTo", mock.AnythingOfType("string")).Return(nil)
-		mockStorage.On("Upload", snapshotFileName, mock.AnythingOfType("string")).Return(expectedErr)
+		mockDB.On("BackupTo", mock.AnythingOfType("string")).Run(createBackupFile).Return(nil)
+		mockStorage.On("Upload", snapshotFileName, mock.Anything).Return(expectedErr)
 
 		// Call the method
 		err := snapshot.SaveSnapshot()
@@ -228,7 +256,7 @@ func TestNatsDBSnapshot_RestoreSnapshot(t *testing.T) {
 		// Set up expectations
 		dbPath := "/path/to/db.sqlite"
 		mockDB.On("GetPath").Return(dbPath)
-		mockStorage.On("Download", mock.AnythingOfType("string"), snapshotFileName).Return(nil)
+		mockStorage.On("Download", snapshotFileName, mock.Anything).Return(nil)
 
 		// Mock restore function
 		restoreCalled := false
@@ -258,7 +286,7 @@ func TestNatsDBSnapshot_RestoreSnapshot(t *testing.T) {
 		snapshot := newTestSnapshot(mockDB, mockStorage)
 
 		// Set up expectations
-		mockStorage.On("Download", mock.AnythingOfType("string"), snapshotFileName).Return(ErrNoSnapshotFound)
+		mockStorage.On("Download", snapshotFileName, mock.Anything).Return(ErrNoSnapshotFound)
 
 		// Call the method
 		mockRestoreFrom := func(destPath, bkFilePath string) error {
@@ -286,7 +314,7 @@ func TestNatsDBSnapshot_RestoreSnapshot(t *testing.T) {
 		expectedErr := errors.New("download failed")
 
 		// Set up expectations
-		mockStorage.On("Download", mock.AnythingOfType("string"), snapshotFileName).Return(expectedErr)
+		mockStorage.On("Download", snapshotFileName, mock.Anything).Return(expectedErr)
 
 		// Call the method
 		mockRestoreFrom := func(destPath, bkFilePath string) error {
@@ -316,7 +344,7 @@ func TestNatsDBSnapshot_RestoreSnapshot(t *testing.T) {
 		// Set up expectations
 		dbPath := "/path/to/db.sqlite"
 		mockDB.On("GetPath").Return(dbPath)
-		mockStorage.On("Download", mock.AnythingOfType("string"), snapshotFileName).Return(nil)
+		mockStorage.On("Download", snapshotFileName, mock.Anything).Return(nil)
 
 		// Mock restore function that fails
 		mockRestoreFrom := func(destPath, bkFilePath string) error {
@@ -0,0 +1,361 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+var ErrNoEncryptionKey = errors.New("no snapshot encryption key configured")
+var ErrDecryptionFailed = errors.New("unable to decrypt snapshot with any configured key")
+var ErrNotEncrypted = errors.New("snapshot object is not encrypted, set snapshot.encryption.allow_plaintext to restore it")
+
+// Encrypted objects start with encryptionMagic, followed by the key ID length (1 byte), the key ID,
+// an 8 byte random nonce prefix and a sequence of chunks. Each chunk is stored as a 4 byte length
+// and the AES-256-GCM sealed plaintext; the nonce is the prefix plus the chunk counter, and the
+// header along with a final chunk flag is authenticated so truncation is detected.
+var encryptionMagic = []byte("HLENC1")
+
+const encryptionChunkSize = 64 * 1024
+const encryptionKeySize = 32
+
+type encryptionKey struct {
+	id  string
+	aed cipher.AEAD
+}
+
+// encryptedStorage transparently encrypts every object written to the wrapped Storage.
+// The first key encrypts, all keys are tried on decryption so keys can be rotated.
+type encryptedStorage struct {
+	inner          Storage
+	keys           []*encryptionKey
+	allowPlaintext bool
+}
+
+func newEncryptedStorage(inner Storage) (*encryptedStorage, error) {
+	keys, err := loadEncryptionKeys(cfg.Config.Snapshot.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedStorage{
+		inner:          inner,
+		keys:           keys,
+		allowPlaintext: cfg.Config.Snapshot.Encryption.AllowPlaintext,
+	}, nil
+}
+
+// ActiveKeyID returns the ID of the key used to encrypt new snapshots
+func (e *encryptedStorage) ActiveKeyID() string {
+	return e.keys[0].id
+}
+
+func (e *encryptedStorage) Upload(name string, rd io.Reader) error {
+	return uploadStream(e.inner, name, func(w io.Writer) error {
+		return encryptStream(w, rd, e.keys[0])
+	})
+}
+
+func (e *encryptedStorage) Download(name string, w io.Writer) error {
+	return downloadStream(e.inner, name, func(r io.Reader) error {
+		return decryptStream(w, r, e.keys, e.allowPlaintext)
+	})
+}
+
+func (e *encryptedStorage) Delete(name string) error {
+	return e.inner.Delete(name)
+}
+
+func (e *encryptedStorage) List() ([]string, error) {
+	return e.inner.List()
+}
+
+func encryptStream(dst io.Writer, src io.Reader, key *encryptionKey) error {
+	header := bytes.NewBuffer(nil)
+	header.Write(encryptionMagic)
+	header.WriteByte(byte(len(key.id)))
+	header.WriteString(key.id)
+
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header.Write(prefix)
+
+	if _, err := dst.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptionChunkSize)
+	next := make([]byte, encryptionChunkSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	lenBuf := make([]byte, 4)
+	for counter := uint32(0); ; counter++ {
+		// Read ahead to know if the current chunk is the final one
+		m, err := io.ReadFull(src, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		final := m == 0
+		sealed := key.aed.Seal(nil, chunkNonce(prefix, counter), buf[:n], chunkAD(header.Bytes(), final))
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(sealed)))
+		if _, err := dst.Write(lenBuf); err != nil {
+			return err
+		}
+
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+
+		buf, next, n = next, buf, m
+	}
+}
+
+// decryptStream decrypts src into dst. Objects without the encryption header are unauthenticated,
+// they are refused unless allowPlaintext is set and then copied as is.
+// The key is picked by authenticating the first chunk, preferring the key named in the header.
+func decryptStream(dst io.Writer, src io.Reader, keys []*encryptionKey, allowPlaintext bool) error {
+	rd := bufio.NewReaderSize(src, encryptionChunkSize)
+	magic, err := rd.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if !bytes.Equal(magic, encryptionMagic) {
+		if !allowPlaintext {
+			return ErrNotEncrypted
+		}
+
+		log.Warn().Msg("Snapshot object is not encrypted, reading it as plaintext")
+		_, err = io.Copy(dst, rd)
+		return err
+	}
+
+	fixed := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(rd, fixed); err != nil {
+		return err
+	}
+
+	keyID := make([]byte, fixed[len(fixed)-1])
+	if _, err := io.ReadFull(rd, keyID); err != nil {
+		return err
+	}
+
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(rd, prefix); err != nil {
+		return err
+	}
+
+	header := bytes.Join([][]byte{fixed, keyID, prefix}, nil)
+	candidates := make([]*encryptionKey, 0, len(keys))
+	for _, k := range keys {
+		if k.id == string(keyID) {
+			candidates = append([]*encryptionKey{k}, candidates...)
+		} else {
+			candidates = append(candidates, k)
+		}
+	}
+
+	var key *encryptionKey
+	for counter := uint32(0); ; counter++ {
+		sealed, final, err := readChunk(rd, counter)
+		if err != nil {
+			return err
+		}
+
+		nonce := chunkNonce(prefix, counter)
+		ad := chunkAD(header, final)
+		var plain []byte
+		if key == nil {
+			for _, k := range candidates {
+				if plain, err = k.aed.Open(nil, nonce, sealed, ad); err == nil {
+					key = k
+					break
+				}
+			}
+
+			if key == nil && candidates[0].id == string(keyID) {
+				return fmt.Errorf("%w: chunk %d failed authentication with key %q", ErrCorruptSnapshot, counter, string(keyID))
+			}
+
+			if key == nil {
+				return fmt.Errorf("%w (encrypted with key %q)", ErrDecryptionFailed, string(keyID))
+			}
+		} else if plain, err = key.aed.Open(nil, nonce, sealed, ad); err != nil {
+			return fmt.Errorf("%w: chunk %d: %v", ErrCorruptSnapshot, counter, err)
+		}
+
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// readChunk reads the next sealed chunk, final is set when no data follows it
+func readChunk(rd *bufio.Reader, counter uint32) ([]byte, bool, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(rd, lenBuf); err != nil {
+		return nil, false, fmt.Errorf("%w: reading chunk %d: %v", ErrCorruptSnapshot, counter, err)
+	}
+
+	size := binary.BigEndian.Uint32(lenBuf)
+	if size > encryptionChunkSize+64 {
+		return nil, false, fmt.Errorf("%w: chunk %d too large", ErrCorruptSnapshot, counter)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(rd, sealed); err != nil {
+		return nil, false, fmt.Errorf("%w: reading chunk %d: %v", ErrCorruptSnapshot, counter, err)
+	}
+
+	_, err := rd.Peek(1)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+
+	return sealed, err == io.EOF, nil
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+func chunkAD(header []byte, final bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if final {
+		ad[len(header)] = 1
+	}
+
+	return ad
+}
+
+// loadEncryptionKeys reads keys from the configured key file, or from the configured environment
+// variable. Keys are base64 encoded 32 byte values, one per line (or comma separated), optionally
+// prefixed with "<key id>:". The first key is used for encryption.
+func loadEncryptionKeys(c cfg.SnapshotEncryptionConfiguration) ([]*encryptionKey, error) {
+	var raw string
+	if c.KeyFile != "" {
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading snapshot key file: %w", err)
+		}
+		raw = string(data)
+	} else if c.KeyEnv != "" {
+		raw = os.Getenv(c.KeyEnv)
+	}
+
+	keys := make([]*encryptionKey, 0)
+	for _, line := range strings.FieldsFunc(raw, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := parseEncryptionKey(line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoEncryptionKey
+	}
+
+	return keys, nil
+}
+
+func parseEncryptionKey(s string) (*encryptionKey, error) {
+	id := ""
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		id, s = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot encryption key %q: %w", id, err)
+	}
+
+	if len(secret) != encryptionKeySize {
+		return nil, fmt.Errorf("invalid snapshot encryption key %q: expected %d bytes, got %d", id, encryptionKeySize, len(secret))
+	}
+
+	if id == "" {
+		sum := sha256.Sum256(secret)
+		id = hex.EncodeToString(sum[:4])
+	}
+
+	if len(id) > 255 {
+		return nil, fmt.Errorf("snapshot encryption key ID %q too long", id)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	aed, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptionKey{id: id, aed: aed}, nil
+}
+
+// Cipher encrypts snapshots transferred outside the storage, e.g. between peers, with the
+// configured snapshot encryption keys
+type Cipher struct {
+	keys []*encryptionKey
+}
+
+// NewCipher loads the keys configured in snapshot.encryption
+func NewCipher() (*Cipher, error) {
+	keys, err := loadEncryptionKeys(cfg.Config.Snapshot.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{keys: keys}, nil
+}
+
+// Encrypt seals src into dst with the first key
+func (c *Cipher) Encrypt(dst io.Writer, src io.Reader) error {
+	return encryptStream(dst, src, c.keys[0])
+}
+
+// Decrypt opens src into dst with any of the keys, plaintext is always refused
+func (c *Cipher) Decrypt(dst io.Writer, src io.Reader) error {
+	return decryptStream(dst, src, c.keys, false)
+}
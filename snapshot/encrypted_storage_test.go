@@ -0,0 +1,166 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func newTestKey(t *testing.T, id string) string {
+	secret := make([]byte, encryptionKeySize)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	if id == "" {
+		return base64.StdEncoding.EncodeToString(secret)
+	}
+
+	return id + ":" + base64.StdEncoding.EncodeToString(secret)
+}
+
+func newTestEncryptedStorage(t *testing.T, dir string, keys ...string) *encryptedStorage {
+	keyFile := filepath.Join(t.TempDir(), "snapshot.keys")
+	content := ""
+	for _, k := range keys {
+		content += k + "\n"
+	}
+	require.NoError(t, os.WriteFile(keyFile, []byte(content), 0600))
+
+	original := cfg.Config.Snapshot.Encryption
+	t.Cleanup(func() {
+		cfg.Config.Snapshot.Encryption = original
+	})
+	cfg.Config.Snapshot.Encryption = cfg.SnapshotEncryptionConfiguration{Enable: true, KeyFile: keyFile}
+
+	storage, err := newEncryptedStorage(&fileStorage{dir: dir})
+	require.NoError(t, err)
+	return storage
+}
+
+func TestEncryptedStorage_RoundTrip(t *testing.T) {
+	sizes := []int{0, 10, encryptionChunkSize, encryptionChunkSize*2 + 17}
+	for _, size := range sizes {
+		dir := t.TempDir()
+		storage := newTestEncryptedStorage(t, dir, newTestKey(t, "primary"))
+
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		require.NoError(t, storage.Upload("object", bytes.NewReader(plain)))
+
+		// Stored object is not plaintext
+		stored, err := os.ReadFile(filepath.Join(dir, "object"))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(stored, encryptionMagic))
+		if size > 0 {
+			assert.False(t, bytes.Contains(stored, plain))
+		}
+
+		restored := &bytes.Buffer{}
+		require.NoError(t, storage.Download("object", restored))
+		assert.True(t, bytes.Equal(plain, restored.Bytes()), "size %d", size)
+	}
+}
+
+func TestEncryptedStorage_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := newTestKey(t, "old")
+	newKey := newTestKey(t, "new")
+
+	require.NoError(t, newTestEncryptedStorage(t, dir, oldKey).Upload("object", strings.NewReader("customer data")))
+
+	// New key encrypts, old key still decrypts
+	rotated := newTestEncryptedStorage(t, dir, newKey, oldKey)
+	assert.Equal(t, "new", rotated.ActiveKeyID())
+	restored := &bytes.Buffer{}
+	require.NoError(t, rotated.Download("object", restored))
+	assert.Equal(t, "customer data", restored.String())
+
+	// Without the old key the object can't be read
+	err := newTestEncryptedStorage(t, dir, newKey).Download("object", io.Discard)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+}
+
+func TestEncryptedStorage_Tampering(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestEncryptedStorage(t, dir, newTestKey(t, ""))
+
+	plain := make([]byte, encryptionChunkSize*2)
+	require.NoError(t, storage.Upload("object", bytes.NewReader(plain)))
+
+	p := filepath.Join(dir, "object")
+	stored, err := os.ReadFile(p)
+	require.NoError(t, err)
+
+	// Dropping the final chunk is detected
+	chunk := 4 + encryptionChunkSize + 16
+	require.NoError(t, os.WriteFile(p, stored[:len(stored)-chunk], 0644))
+	err = storage.Download("object", io.Discard)
+	assert.ErrorIs(t, err, ErrCorruptSnapshot)
+
+	// Flipped byte in the last chunk is detected
+	stored[len(stored)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(p, stored, 0644))
+	err = storage.Download("object", io.Discard)
+	assert.ErrorIs(t, err, ErrCorruptSnapshot)
+}
+
+func TestEncryptedStorage_Plaintext(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, (&fileStorage{dir: dir}).Upload("object", strings.NewReader("swapped data")))
+
+	// Unauthenticated objects are refused by default
+	storage := newTestEncryptedStorage(t, dir, newTestKey(t, ""))
+	err := storage.Download("object", io.Discard)
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	// Migrating plaintext snapshots is opt-in
+	storage.allowPlaintext = true
+	restored := &bytes.Buffer{}
+	require.NoError(t, storage.Download("object", restored))
+	assert.Equal(t, "swapped data", restored.String())
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	t.Run("from environment", func(t *testing.T) {
+		t.Setenv("TEST_SNAPSHOT_KEYS", newTestKey(t, "a")+","+newTestKey(t, ""))
+		keys, err := loadEncryptionKeys(cfg.SnapshotEncryptionConfiguration{KeyEnv: "TEST_SNAPSHOT_KEYS"})
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		assert.Equal(t, "a", keys[0].id)
+		assert.Len(t, keys[1].id, 8)
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		_, err := loadEncryptionKeys(cfg.SnapshotEncryptionConfiguration{KeyEnv: "TEST_SNAPSHOT_KEYS_MISSING"})
+		assert.ErrorIs(t, err, ErrNoEncryptionKey)
+	})
+
+	t.Run("invalid key size", func(t *testing.T) {
+		t.Setenv("TEST_SNAPSHOT_KEYS", base64.StdEncoding.EncodeToString([]byte("short")))
+		_, err := loadEncryptionKeys(cfg.SnapshotEncryptionConfiguration{KeyEnv: "TEST_SNAPSHOT_KEYS"})
+		assert.ErrorContains(t, err, "expected 32 bytes")
+	})
+}
+
+func TestNatsDBSnapshot_EncryptedManifestKeyID(t *testing.T) {
+	storage := newTestEncryptedStorage(t, t.TempDir(), newTestKey(t, "k1"))
+	source := openTestStreamDB(t, "source.db", 3, false)
+	require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(nil))
+
+	target := openTestStreamDB(t, "target.db", 0, false)
+	manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", manifest.KeyID)
+	assert.Equal(t, 3, countTestRows(t, target.GetPath()))
+}
@@ -0,0 +1,141 @@
+package snapshot
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+const fileTempPattern = ".harmonylite-upload-*"
+
+// fileStorage keeps snapshot objects in a local directory, which may be a network mount.
+// Objects are written to a temporary file and renamed into place, so readers never
+// observe a partially written object, and the directory is synced so uploads survive a crash.
+type fileStorage struct {
+	dir string
+}
+
+func (f *fileStorage) Upload(name string, rd io.Reader) error {
+	err := os.MkdirAll(f.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, fileTempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bytes, err := io.Copy(tmp, rd)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(f.dir, name)
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return err
+	}
+
+	// The rename only survives a crash once the directory itself is synced
+	err = syncDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("file_name", name).
+		Str("file_path", dst).
+		Int64("bytes", bytes).
+		Msg("Snapshot saved to directory")
+
+	return nil
+}
+
+func (f *fileStorage) Download(name string, w io.Writer) error {
+	src, err := os.Open(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return ErrNoSnapshotFound
+	}
+
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(w, src)
+	return err
+}
+
+func (f *fileStorage) Delete(name string) error {
+	err := os.Remove(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (f *fileStorage) List() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// Skip uploads in progress
+		if e.IsDir() || strings.HasPrefix(e.Name(), strings.TrimSuffix(fileTempPattern, "*")) {
+			continue
+		}
+
+		names = append(names, e.Name())
+	}
+
+	return names, nil
+}
+
+// syncDir flushes directory entries to disk, file systems unable to sync a directory
+// (e.g. some network mounts) are skipped
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+
+	return err
+}
+
+func newFileStorage() (*fileStorage, error) {
+	dir := cfg.Config.Snapshot.File.Path
+	if dir == "" {
+		return nil, ErrRequiredParameterMissing
+	}
+
+	return &fileStorage{dir: dir}, nil
+}
@@ -0,0 +1,71 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestFileStorage(t *testing.T) {
+	t.Run("upload creates directory", func(t *testing.T) {
+		storage := &fileStorage{dir: filepath.Join(t.TempDir(), "nested", "snapshots")}
+		require.NoError(t, storage.Upload("object", strings.NewReader("content")))
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, storage.Download("object", buf))
+		assert.Equal(t, "content", buf.String())
+	})
+
+	t.Run("failed upload keeps previous object", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		require.NoError(t, storage.Upload("object", strings.NewReader("original")))
+
+		err := storage.Upload("object", io.MultiReader(strings.NewReader("partial"), failingReader{}))
+		assert.Error(t, err)
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, storage.Download("object", buf))
+		assert.Equal(t, "original", buf.String())
+
+		// No temporary files are left behind
+		files, err := os.ReadDir(storage.dir)
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("missing object", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		assert.ErrorIs(t, storage.Download("object", io.Discard), ErrNoSnapshotFound)
+		assert.NoError(t, storage.Delete("object"))
+	})
+
+	t.Run("sync directory", func(t *testing.T) {
+		assert.NoError(t, syncDir(t.TempDir()))
+		assert.ErrorIs(t, syncDir(filepath.Join(t.TempDir(), "missing")), os.ErrNotExist)
+	})
+
+	t.Run("path is required", func(t *testing.T) {
+		original := cfg.Config.Snapshot.File
+		defer func() {
+			cfg.Config.Snapshot.File = original
+		}()
+
+		cfg.Config.Snapshot.File.Path = ""
+		_, err := newFileStorage()
+		assert.ErrorIs(t, err, ErrRequiredParameterMissing)
+	})
+}
@@ -0,0 +1,245 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+// Page maps start with pageMapMagic and the page size (4 bytes), followed by a truncated
+// SHA-256 of every page of the snapshot database.
+var pageMapMagic = []byte("HLPAGES1")
+
+// Deltas start with deltaMagic, the page size (4 bytes) and the page count (8 bytes) of the
+// resulting database, followed by records made of a page number (8 bytes) and the page.
+// Records end with deltaEndMarker so truncated deltas are detected.
+var deltaMagic = []byte("HLDELTA1")
+
+const pageHashSize = 16
+const deltaEndMarker = math.MaxUint64
+
+// maxDeltaRatio is the share of changed pages above which a full snapshot is taken instead
+const maxDeltaRatio = 0.5
+
+var ErrInvalidPageMap = errors.New("invalid snapshot page map")
+
+// pageMap holds page hashes of a snapshot database
+type pageMap struct {
+	pageSize int
+	hashes   []byte
+}
+
+func (m *pageMap) pageCount() int {
+	return len(m.hashes) / pageHashSize
+}
+
+func (m *pageMap) page(i int) []byte {
+	return m.hashes[i*pageHashSize : (i+1)*pageHashSize]
+}
+
+// changedPages returns pages of m that differ from base, including pages base doesn't have
+func (m *pageMap) changedPages(base *pageMap) []int {
+	changed := make([]int, 0)
+	for i := 0; i < m.pageCount(); i++ {
+		if i >= base.pageCount() || !bytes.Equal(m.page(i), base.page(i)) {
+			changed = append(changed, i)
+		}
+	}
+
+	return changed
+}
+
+func (m *pageMap) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(pageMapMagic)+4+len(m.hashes)))
+	buf.Write(pageMapMagic)
+	binary.Write(buf, binary.BigEndian, uint32(m.pageSize))
+	buf.Write(m.hashes)
+	return buf.Bytes(), nil
+}
+
+func (m *pageMap) UnmarshalBinary(data []byte) error {
+	header := len(pageMapMagic) + 4
+	if len(data) < header || !bytes.Equal(data[:len(pageMapMagic)], pageMapMagic) {
+		return ErrInvalidPageMap
+	}
+
+	if (len(data)-header)%pageHashSize != 0 {
+		return ErrInvalidPageMap
+	}
+
+	m.pageSize = int(binary.BigEndian.Uint32(data[len(pageMapMagic):header]))
+	m.hashes = data[header:]
+	return nil
+}
+
+// hashPages computes the page map of the database at p along with the SHA-256 of the file
+func hashPages(p string) (*pageMap, string, error) {
+	pageSize, err := readPageSize(p)
+	if err != nil {
+		return nil, "", err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	m := &pageMap{pageSize: pageSize}
+	digest := sha256.New()
+	rd := bufio.NewReaderSize(io.TeeReader(f, digest), pageSize)
+	page := make([]byte, pageSize)
+	for {
+		_, err := io.ReadFull(rd, page)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, "", fmt.Errorf("reading pages of %s: %w", p, err)
+		}
+
+		sum := sha256.Sum256(page)
+		m.hashes = append(m.hashes, sum[:pageHashSize]...)
+	}
+
+	return m, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// readPageSize reads the page size from the SQLite database header
+func readPageSize(p string) (int, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 18)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("reading database header: %w", err)
+	}
+
+	size := int(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		size = 65536
+	}
+
+	if size < 512 || size&(size-1) != 0 {
+		return 0, fmt.Errorf("invalid page size %d", size)
+	}
+
+	return size, nil
+}
+
+// writeDelta writes the given pages of the database at p
+func writeDelta(dst io.Writer, p string, m *pageMap, pages []int) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(dst, 64*1024)
+	header := bytes.NewBuffer(nil)
+	header.Write(deltaMagic)
+	binary.Write(header, binary.BigEndian, uint32(m.pageSize))
+	binary.Write(header, binary.BigEndian, uint64(m.pageCount()))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	page := make([]byte, m.pageSize)
+	pgno := make([]byte, 8)
+	for _, i := range pages {
+		if _, err := f.ReadAt(page, int64(i)*int64(m.pageSize)); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint64(pgno, uint64(i))
+		if _, err := w.Write(pgno); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+
+	binary.BigEndian.PutUint64(pgno, deltaEndMarker)
+	if _, err := w.Write(pgno); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// applyDelta writes the pages of the delta at deltaPath over the base database at p
+func applyDelta(p, deltaPath string) error {
+	df, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	rd := bufio.NewReader(df)
+	header := make([]byte, len(deltaMagic)+12)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.Equal(header[:len(deltaMagic)], deltaMagic) {
+		return fmt.Errorf("%w: invalid delta header", ErrCorruptSnapshot)
+	}
+
+	pageSize := int64(binary.BigEndian.Uint32(header[len(deltaMagic):]))
+	pageCount := binary.BigEndian.Uint64(header[len(deltaMagic)+4:])
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	page := make([]byte, pageSize)
+	pgno := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rd, pgno); err != nil {
+			return fmt.Errorf("%w: truncated delta: %v", ErrCorruptSnapshot, err)
+		}
+
+		i := binary.BigEndian.Uint64(pgno)
+		if i == deltaEndMarker {
+			break
+		}
+
+		if i >= pageCount {
+			return fmt.Errorf("%w: delta page %d out of range", ErrCorruptSnapshot, i)
+		}
+
+		if _, err := io.ReadFull(rd, page); err != nil {
+			return fmt.Errorf("%w: truncated delta: %v", ErrCorruptSnapshot, err)
+		}
+
+		if _, err := f.WriteAt(page, int64(i)*pageSize); err != nil {
+			return err
+		}
+	}
+
+	err = f.Truncate(int64(pageCount) * pageSize)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// incrementalPolicy returns if incremental snapshots are enabled and how often a full one is taken
+func incrementalPolicy() (bool, int) {
+	c := cfg.Config.Snapshot.Incremental
+	return c.Enable, c.FullEvery
+}
@@ -0,0 +1,133 @@
+package snapshot
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func execTestSQL(t *testing.T, dbPath, query string) {
+	raw, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(query)
+	require.NoError(t, err)
+}
+
+func TestDelta_RoundTrip(t *testing.T) {
+	source := openTestStreamDB(t, "source.db", 2000, false)
+	base := filepath.Join(t.TempDir(), "base.db")
+	require.NoError(t, source.BackupTo(base))
+	basePages, _, err := hashPages(base)
+	require.NoError(t, err)
+
+	execTestSQL(t, source.GetPath(), `UPDATE items SET name = 'changed' WHERE id = 1000`)
+	execTestSQL(t, source.GetPath(), `INSERT INTO items (name) SELECT name FROM items`)
+	current := filepath.Join(t.TempDir(), "current.db")
+	require.NoError(t, source.BackupTo(current))
+	pages, digest, err := hashPages(current)
+	require.NoError(t, err)
+
+	changed := pages.changedPages(basePages)
+	assert.NotEmpty(t, changed)
+	assert.Less(t, len(changed), pages.pageCount())
+
+	deltaPath := filepath.Join(t.TempDir(), "delta")
+	f, err := os.Create(deltaPath)
+	require.NoError(t, err)
+	require.NoError(t, writeDelta(f, current, pages, changed))
+	require.NoError(t, f.Close())
+
+	require.NoError(t, applyDelta(base, deltaPath))
+	reassembled, err := fileHash(base)
+	require.NoError(t, err)
+	assert.Equal(t, digest, reassembled)
+
+	t.Run("truncated delta", func(t *testing.T) {
+		info, err := os.Stat(deltaPath)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(deltaPath, info.Size()-4))
+		assert.ErrorIs(t, applyDelta(base, deltaPath), ErrCorruptSnapshot)
+	})
+}
+
+func TestPageMap_Binary(t *testing.T) {
+	m := &pageMap{pageSize: 4096, hashes: make([]byte, pageHashSize*3)}
+	data, err := m.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := &pageMap{}
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, 4096, decoded.pageSize)
+	assert.Equal(t, 3, decoded.pageCount())
+
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data[:len(data)-1]), ErrInvalidPageMap)
+	assert.ErrorIs(t, decoded.UnmarshalBinary([]byte("garbage")), ErrInvalidPageMap)
+}
+
+func TestNatsDBSnapshot_Incremental(t *testing.T) {
+	original := cfg.Config.Snapshot
+	defer func() {
+		cfg.Config.Snapshot = original
+	}()
+	cfg.Config.Snapshot.Incremental = cfg.SnapshotIncrementalConfiguration{Enable: true, FullEvery: 3}
+	cfg.Config.Snapshot.Retention = cfg.SnapshotRetentionConfiguration{KeepLast: 10}
+
+	storage := &fileStorage{dir: t.TempDir()}
+	source := openTestStreamDB(t, "source.db", 2000, false)
+	snapshot := NewNatsDBSnapshot(source, storage)
+	for i := 0; i < 4; i++ {
+		execTestSQL(t, source.GetPath(), `INSERT INTO items (name) VALUES ('next')`)
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": uint64(i)}))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// Full, two increments against it, then a new full snapshot
+	idx := readTestIndex(t, storage)
+	require.Len(t, idx.Snapshots, 4)
+	full := idx.Snapshots[0]
+	assert.Empty(t, full.Base)
+	assert.True(t, full.Pages)
+	assert.Equal(t, full.ID, idx.Snapshots[1].Base)
+	assert.Equal(t, full.ID, idx.Snapshots[2].Base)
+	assert.Empty(t, idx.Snapshots[3].Base)
+
+	fullInfo, err := os.Stat(filepath.Join(storage.dir, full.DataName()))
+	require.NoError(t, err)
+	deltaInfo, err := os.Stat(filepath.Join(storage.dir, idx.Snapshots[2].DataName()))
+	require.NoError(t, err)
+	assert.Less(t, deltaInfo.Size(), fullInfo.Size())
+
+	t.Run("restore reassembles base and delta", func(t *testing.T) {
+		// Drop the latest full snapshot so the newest entry is incremental
+		latest := idx.Snapshots[3]
+		for _, name := range latest.ObjectNames() {
+			require.NoError(t, storage.Delete(name))
+		}
+		idx.Snapshots = idx.Snapshots[:3]
+		require.NoError(t, uploadJSON(storage, indexFileName, idx))
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), manifest.Sequences["stream"])
+		assert.Equal(t, full.ID, manifest.Base)
+		assert.Equal(t, 2003, countTestRows(t, target.GetPath()))
+	})
+
+	t.Run("retention keeps base of kept increments", func(t *testing.T) {
+		idx := readTestIndex(t, storage)
+		removed := idx.ApplyRetention(1, 0, time.Now())
+		require.Len(t, idx.Snapshots, 2)
+		assert.Equal(t, full.ID, idx.Snapshots[0].ID)
+		require.Len(t, removed, 1)
+		assert.Equal(t, full.ID, removed[0].Base)
+	})
+}
@@ -0,0 +1,145 @@
+package snapshot
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+const indexFileName = "snapshot-index.json"
+const snapshotIDFormat = "20060102T150405.000Z"
+
+// IndexEntry is a snapshot version listed in the index. Incremental snapshots name the full
+// snapshot they apply to in Base, Size and SHA256 always describe the complete database.
+type IndexEntry struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Base      string    `json:"base,omitempty"`
+	Pages     bool      `json:"pages,omitempty"`
+}
+
+// Index lists retained snapshot versions, oldest first
+type Index struct {
+	Snapshots []*IndexEntry `json:"snapshots"`
+}
+
+func newSnapshotID(t time.Time) string {
+	return t.UTC().Format(snapshotIDFormat)
+}
+
+// DataName is the storage object name of the snapshot database, or of the delta for
+// incremental snapshots
+func (e *IndexEntry) DataName() string {
+	if e.Base != "" {
+		return fmt.Sprintf("snapshot-%s.delta", e.ID)
+	}
+
+	return fmt.Sprintf("snapshot-%s.db", e.ID)
+}
+
+// PagesName is the storage object name of the page map of a full snapshot
+func (e *IndexEntry) PagesName() string {
+	return fmt.Sprintf("snapshot-%s.pages", e.ID)
+}
+
+// ObjectNames lists every storage object of the snapshot
+func (e *IndexEntry) ObjectNames() []string {
+	names := []string{e.DataName(), e.ManifestName()}
+	if e.Pages {
+		names = append(names, e.PagesName())
+	}
+
+	return names
+}
+
+// ManifestName is the storage object name of the snapshot manifest
+func (e *IndexEntry) ManifestName() string {
+	return fmt.Sprintf("snapshot-%s.json", e.ID)
+}
+
+// Add appends an entry keeping the index ordered by creation time, an entry with the same ID
+// is replaced
+func (idx *Index) Add(e *IndexEntry) {
+	idx.Snapshots = slices.DeleteFunc(idx.Snapshots, func(x *IndexEntry) bool {
+		return x.ID == e.ID
+	})
+	idx.Snapshots = append(idx.Snapshots, e)
+	sort.SliceStable(idx.Snapshots, func(i, j int) bool {
+		return idx.Snapshots[i].CreatedAt.Before(idx.Snapshots[j].CreatedAt)
+	})
+}
+
+// Find returns the entry with given ID or nil
+func (idx *Index) Find(id string) *IndexEntry {
+	for _, e := range idx.Snapshots {
+		if e.ID == id {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Newest returns entries ordered from newest to oldest
+func (idx *Index) Newest() []*IndexEntry {
+	ret := make([]*IndexEntry, 0, len(idx.Snapshots))
+	for i := len(idx.Snapshots) - 1; i >= 0; i-- {
+		ret = append(ret, idx.Snapshots[i])
+	}
+
+	return ret
+}
+
+// ApplyRetention drops entries outside the retention policy and returns them. The newest
+// keepLast snapshots are kept, along with the newest snapshot of each of the last keepDaily
+// days. The newest snapshot is always kept, along with the full snapshots that kept
+// incremental snapshots apply to.
+func (idx *Index) ApplyRetention(keepLast, keepDaily int, now time.Time) []*IndexEntry {
+	if keepLast < 1 {
+		keepLast = 1
+	}
+
+	keep := map[string]bool{}
+	days := map[string]bool{}
+	oldestDay := now.UTC().AddDate(0, 0, -keepDaily)
+	for i, e := range idx.Newest() {
+		if i < keepLast {
+			keep[e.ID] = true
+		}
+
+		day := e.CreatedAt.UTC().Format(time.DateOnly)
+		if keepDaily > 0 && !days[day] && e.CreatedAt.After(oldestDay) {
+			days[day] = true
+			keep[e.ID] = true
+		}
+	}
+
+	for _, e := range idx.Snapshots {
+		if keep[e.ID] && e.Base != "" {
+			keep[e.Base] = true
+		}
+	}
+
+	kept := make([]*IndexEntry, 0, len(keep))
+	removed := make([]*IndexEntry, 0)
+	for _, e := range idx.Snapshots {
+		if keep[e.ID] {
+			kept = append(kept, e)
+		} else {
+			removed = append(removed, e)
+		}
+	}
+
+	idx.Snapshots = kept
+	return removed
+}
+
+func retentionPolicy() (int, int) {
+	r := cfg.Config.Snapshot.Retention
+	return r.KeepLast, r.KeepDaily
+}
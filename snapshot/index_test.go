@@ -0,0 +1,222 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+)
+
+func testEntries(times ...time.Time) *Index {
+	idx := &Index{}
+	for _, t := range times {
+		idx.Add(&IndexEntry{ID: newSnapshotID(t), CreatedAt: t})
+	}
+
+	return idx
+}
+
+func entryIDs(entries []*IndexEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+
+	return ids
+}
+
+func TestIndex_ApplyRetention(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	day := 24 * time.Hour
+
+	t.Run("keep last", func(t *testing.T) {
+		idx := testEntries(now.Add(-3*hour), now.Add(-2*hour), now.Add(-hour), now)
+		removed := idx.ApplyRetention(2, 0, now)
+
+		assert.Equal(t, []string{newSnapshotID(now.Add(-3 * hour)), newSnapshotID(now.Add(-2 * hour))}, entryIDs(removed))
+		assert.Equal(t, []string{newSnapshotID(now.Add(-hour)), newSnapshotID(now)}, entryIDs(idx.Snapshots))
+	})
+
+	t.Run("keep daily", func(t *testing.T) {
+		idx := testEntries(
+			now.Add(-5*day),
+			now.Add(-2*day-hour),
+			now.Add(-2*day),
+			now.Add(-day),
+			now.Add(-hour),
+			now,
+		)
+		removed := idx.ApplyRetention(1, 3, now)
+
+		// Newest of each of the last 3 days is kept, along with the newest overall
+		assert.Equal(t, []string{
+			newSnapshotID(now.Add(-2 * day)),
+			newSnapshotID(now.Add(-day)),
+			newSnapshotID(now),
+		}, entryIDs(idx.Snapshots))
+		assert.Len(t, removed, 3)
+	})
+
+	t.Run("always keeps newest", func(t *testing.T) {
+		idx := testEntries(now.Add(-hour), now)
+		idx.ApplyRetention(0, 0, now)
+
+		assert.Equal(t, []string{newSnapshotID(now)}, entryIDs(idx.Snapshots))
+	})
+}
+
+func TestNatsDBSnapshot_Versions(t *testing.T) {
+	original := cfg.Config.Snapshot.Retention
+	defer func() {
+		cfg.Config.Snapshot.Retention = original
+	}()
+	cfg.Config.Snapshot.Retention = cfg.SnapshotRetentionConfiguration{KeepLast: 2}
+
+	t.Run("retention removes expired objects", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 1, false)
+		snapshot := NewNatsDBSnapshot(source, storage)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, snapshot.SaveSnapshot(nil))
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		idx := readTestIndex(t, storage)
+		require.Len(t, idx.Snapshots, 2)
+
+		files, err := os.ReadDir(storage.dir)
+		require.NoError(t, err)
+		assert.Len(t, files, 5) // 2 snapshots, 2 manifests and the index
+
+		for _, e := range idx.Snapshots {
+			assert.FileExists(t, filepath.Join(storage.dir, e.DataName()))
+			assert.FileExists(t, filepath.Join(storage.dir, e.ManifestName()))
+		}
+	})
+
+	t.Run("restore falls back to older snapshot", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 2, false)
+		snapshot := NewNatsDBSnapshot(source, storage)
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 1}))
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 2}))
+
+		// Truncate the newest snapshot
+		idx := readTestIndex(t, storage)
+		newest := idx.Newest()[0]
+		require.NoError(t, os.Truncate(filepath.Join(storage.dir, newest.DataName()), 100))
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), manifest.Sequences["stream"])
+		assert.Equal(t, 2, countTestRows(t, target.GetPath()))
+	})
+
+	t.Run("restore fails when every snapshot is invalid", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 1, false)
+		require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(nil))
+
+		idx := readTestIndex(t, storage)
+		require.NoError(t, os.Truncate(filepath.Join(storage.dir, idx.Snapshots[0].DataName()), 10))
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		_, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		assert.ErrorIs(t, err, ErrNoValidSnapshot)
+	})
+
+	t.Run("lost index is rebuilt from manifests", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 2, false)
+		snapshot := NewNatsDBSnapshot(source, storage)
+		for i := 1; i <= 2; i++ {
+			require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": uint64(i)}))
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		oldest := readTestIndex(t, storage).Snapshots[0]
+		require.NoError(t, storage.Delete(indexFileName))
+
+		// Restores still use the newest version
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), manifest.Sequences["stream"])
+
+		// Retained versions are still expired
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 3}))
+		assert.Len(t, readTestIndex(t, storage).Snapshots, 2)
+		assert.NoFileExists(t, filepath.Join(storage.dir, oldest.DataName()))
+		assert.NoFileExists(t, filepath.Join(storage.dir, oldest.ManifestName()))
+	})
+}
+
+func TestNatsDBSnapshot_Integrity(t *testing.T) {
+	t.Run("checksum mismatch falls back", func(t *testing.T) {
+		original := cfg.Config.Snapshot.Compression
+		defer func() {
+			cfg.Config.Snapshot.Compression = original
+		}()
+		cfg.Config.Snapshot.Compression.Enable = false
+
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 2, false)
+		snapshot := NewNatsDBSnapshot(source, storage)
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 1}))
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, snapshot.SaveSnapshot(map[string]uint64{"stream": 2}))
+
+		idx := readTestIndex(t, storage)
+		newest := idx.Newest()[0]
+		assert.Len(t, newest.SHA256, 64)
+
+		// Flip a byte keeping the size intact
+		p := filepath.Join(storage.dir, newest.DataName())
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(p, data, 0644))
+
+		entry := *newest
+		err = verifySnapshot(p, &entry)
+		assert.ErrorIs(t, err, ErrCorruptSnapshot)
+		assert.ErrorContains(t, err, "sha256 mismatch")
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), manifest.Sequences["stream"])
+	})
+
+	t.Run("unversioned snapshot failing integrity check is refused", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 200, false)
+		p := filepath.Join(storage.dir, snapshotFileName)
+		require.NoError(t, source.BackupTo(p))
+
+		// Overwrite the second page, keeping the header valid
+		f, err := os.OpenFile(p, os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt(make([]byte, 1024), 4096)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		_, err = NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		assert.ErrorIs(t, err, ErrCorruptSnapshot)
+		assert.Equal(t, 0, countTestRows(t, target.GetPath()))
+	})
+}
+
+func readTestIndex(t *testing.T, storage Storage) *Index {
+	idx := &Index{}
+	require.NoError(t, downloadJSON(storage, indexFileName, idx))
+	return idx
+}
@@ -0,0 +1,23 @@
+package snapshot
+
+import (
+	"time"
+)
+
+// manifestFileName is the fixed name manifest of unversioned snapshots
+const manifestFileName = "snapshot.json"
+
+// Manifest describes a snapshot. Sequences holds, per stream, the last JetStream sequence
+// already included in the snapshot, so a restored node resumes replication right after it.
+type Manifest struct {
+	ID         string            `json:"id,omitempty"`
+	NodeID     uint64            `json:"node_id"`
+	SchemaHash string            `json:"schema_hash"`
+	CreatedAt  time.Time         `json:"created_at"`
+	SHA256     string            `json:"sha256,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	KeyID      string            `json:"key_id,omitempty"`
+	Compressed bool              `json:"compressed,omitempty"`
+	Base       string            `json:"base,omitempty"`
+	Sequences  map[string]uint64 `json:"sequences"`
+}
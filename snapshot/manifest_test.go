@@ -0,0 +1,166 @@
+package snapshot
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+)
+
+// openTestStreamDB creates a database with an items table, CDC is only installed when
+// requested since its file watcher outlives the test
+func openTestStreamDB(t *testing.T, name string, rows int, cdc bool) *db.SqliteStreamDB {
+	dbPath := filepath.Join(t.TempDir(), name)
+	raw, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)`)
+	require.NoError(t, err)
+	for i := 0; i < rows; i++ {
+		_, err = raw.Exec(`INSERT INTO items (name) VALUES ('item')`)
+		require.NoError(t, err)
+	}
+
+	streamDB, err := db.OpenStreamDB(dbPath)
+	require.NoError(t, err)
+	if cdc {
+		require.NoError(t, streamDB.InstallCDC([]string{"items"}))
+	}
+
+	return streamDB
+}
+
+func countTestRows(t *testing.T, dbPath string) int {
+	raw, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	var count int
+	require.NoError(t, raw.QueryRow(`SELECT count(*) FROM items`).Scan(&count))
+	return count
+}
+
+func TestNatsDBSnapshot_Manifest(t *testing.T) {
+	originalNodeID := cfg.Config.NodeID
+	cfg.Config.NodeID = 7
+	defer func() {
+		cfg.Config.NodeID = originalNodeID
+	}()
+
+	t.Run("round trip", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 3, true)
+		sequences := map[string]uint64{"harmonylite-changes-1": 42, "harmonylite-changes-2": 7}
+		require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(sequences))
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		require.NotNil(t, manifest)
+		assert.Equal(t, uint64(7), manifest.NodeID)
+		assert.Equal(t, source.GetSchemaHash(), manifest.SchemaHash)
+		assert.Equal(t, sequences, manifest.Sequences)
+		assert.False(t, manifest.CreatedAt.IsZero())
+		assert.Equal(t, 3, countTestRows(t, target.GetPath()))
+	})
+
+	t.Run("rejected manifest leaves the database", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 3, false)
+		require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(map[string]uint64{"stream": 1}))
+
+		rejected := errors.New("too old")
+		target := openTestStreamDB(t, "target.db", 5, false)
+		_, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(func(m *Manifest) error {
+			assert.Equal(t, uint64(1), m.Sequences["stream"])
+			return rejected
+		})
+		assert.ErrorIs(t, err, rejected)
+		assert.Equal(t, 5, countTestRows(t, target.GetPath()))
+	})
+
+	t.Run("online restore", func(t *testing.T) {
+		cfg.Config.Snapshot.RestoreMode = cfg.OnlineRestore
+		defer func() {
+			cfg.Config.Snapshot.RestoreMode = cfg.OfflineRestore
+		}()
+
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 3, false)
+		require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(map[string]uint64{"stream": 1}))
+
+		target := openTestStreamDB(t, "target.db", 5, true)
+		reader, err := sql.Open("sqlite3", target.GetPath()+"?_busy_timeout=5000")
+		require.NoError(t, err)
+		defer reader.Close()
+		require.NoError(t, reader.Ping())
+
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), manifest.Sequences["stream"])
+
+		var count int
+		require.NoError(t, reader.QueryRow(`SELECT count(*) FROM items`).Scan(&count))
+		assert.Equal(t, 3, count)
+		assert.Equal(t, 1, target.GetTrackedTablesCount())
+	})
+
+	t.Run("online bootstrap replaces files", func(t *testing.T) {
+		cfg.Config.Snapshot.RestoreMode = cfg.OnlineRestore
+		defer func() {
+			cfg.Config.Snapshot.RestoreMode = cfg.OfflineRestore
+		}()
+
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 3, false)
+		require.NoError(t, NewNatsDBSnapshot(source, storage).SaveSnapshot(map[string]uint64{"stream": 1}))
+
+		// A new database whose page size differs from the snapshot
+		targetPath := filepath.Join(t.TempDir(), "target.db")
+		raw, err := sql.Open("sqlite3", targetPath)
+		require.NoError(t, err)
+		_, err = raw.Exec("PRAGMA page_size=8192; PRAGMA journal_mode=WAL; PRAGMA user_version=1;")
+		require.NoError(t, err)
+		require.NoError(t, raw.Close())
+		target, err := db.OpenStreamDB(targetPath)
+		require.NoError(t, err)
+
+		_, err = NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		assert.ErrorIs(t, err, db.ErrPageSizeMismatch)
+
+		_, err = NewNatsDBSnapshot(target, storage).BootstrapSnapshot(nil)
+		require.NoError(t, err)
+		assert.Equal(t, 3, countTestRows(t, targetPath))
+	})
+
+	t.Run("unversioned snapshot without manifest", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		source := openTestStreamDB(t, "source.db", 2, false)
+		require.NoError(t, source.BackupTo(filepath.Join(storage.dir, snapshotFileName)))
+
+		target := openTestStreamDB(t, "target.db", 0, false)
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		require.NoError(t, err)
+		assert.Nil(t, manifest)
+		assert.Equal(t, 2, countTestRows(t, target.GetPath()))
+	})
+
+	t.Run("bootstrap requires a snapshot", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		target := openTestStreamDB(t, "target.db", 0, false)
+
+		manifest, err := NewNatsDBSnapshot(target, storage).RestoreSnapshot(nil)
+		assert.NoError(t, err)
+		assert.Nil(t, manifest)
+
+		_, err = NewNatsDBSnapshot(target, storage).BootstrapSnapshot(nil)
+		assert.ErrorIs(t, err, ErrNoSnapshotFound)
+	})
+}
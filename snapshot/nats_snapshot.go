@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"errors"
+	"io"
 
 	"github.com/wongfei2009/harmonylite/cfg"
 )
@@ -10,17 +11,47 @@ var ErrInvalidStorageType = errors.New("invalid snapshot storage type")
 var ErrNoSnapshotFound = errors.New("no snapshot found")
 var ErrRequiredParameterMissing = errors.New("required parameter missing")
 
+// NatsSnapshot saves and restores database snapshots. Sequences passed to SaveSnapshot are
+// recorded in the snapshot manifest, restores return that manifest (nil for snapshots taken
+// before manifests existed). RestoreFile applies a snapshot obtained outside the storage,
+// e.g. from a peer. Bootstrap variants apply snapshots to a newly created database.
 type NatsSnapshot interface {
-	SaveSnapshot() error
-	RestoreSnapshot() error
+	SaveSnapshot(sequences map[string]uint64) error
+	RestoreSnapshot(check ManifestCheck) (*Manifest, error)
+	BootstrapSnapshot(check ManifestCheck) (*Manifest, error)
+	RestoreFile(p string, manifest *Manifest) error
+	BootstrapFile(p string, manifest *Manifest) error
 }
 
+// ManifestCheck is called with the manifest of a verified snapshot before it replaces the
+// database, an error aborts the restore
+type ManifestCheck func(manifest *Manifest) error
+
+// Storage stores snapshot objects by name. Objects are streamed in both directions,
+// Download returns ErrNoSnapshotFound when the object does not exist. Uploading replaces an
+// existing object without removing it first, readers see either version. List returns the
+// names of every stored object.
 type Storage interface {
-	Upload(name, filePath string) error
-	Download(filePath, name string) error
+	Upload(name string, rd io.Reader) error
+	Download(name string, w io.Writer) error
+	Delete(name string) error
+	List() ([]string, error)
 }
 
 func NewSnapshotStorage() (Storage, error) {
+	storage, err := newBackendStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Config.Snapshot.Encryption.Enable {
+		return newEncryptedStorage(storage)
+	}
+
+	return storage, nil
+}
+
+func newBackendStorage() (Storage, error) {
 	c := cfg.Config
 
 	switch c.SnapshotStorageType() {
@@ -32,6 +63,8 @@ func NewSnapshotStorage() (Storage, error) {
 		return newNatsStorage()
 	case cfg.S3:
 		return newS3Storage()
+	case cfg.File:
+		return newFileStorage()
 	}
 
 	return nil, ErrInvalidStorageType
@@ -1,7 +1,7 @@
 package snapshot
 
 import (
-	"os"
+	"io"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -10,65 +10,44 @@ import (
 	"github.com/wongfei2009/harmonylite/stream"
 )
 
-const hashHeaderKey = "harmonylite-snapshot-tag"
-
 type natsStorage struct {
 	nc *nats.Conn
 }
 
-func (n *natsStorage) Upload(name, filePath string) error {
+func (n *natsStorage) Upload(name string, rd io.Reader) error {
 	blb, err := getBlobStore(n.nc)
 	if err != nil {
 		return err
 	}
 
-	err = blb.Delete(name)
-	if err != nil && err != nats.ErrObjectNotFound {
-		return err
-	}
-
-	hash, err := fileHash(filePath)
-	if err != nil {
-		return err
-	}
-
-	rfl, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer rfl.Close()
-
-	info, err := blb.Put(&nats.ObjectMeta{
-		Name: name,
-		Headers: map[string][]string{
-			hashHeaderKey: {hash},
-		},
-	}, rfl)
+	// Put replaces an existing object once the new one is complete
+	info, err := blb.Put(&nats.ObjectMeta{Name: name}, rd)
 	if err != nil {
 		return err
 	}
 
 	log.Info().
-		Str("hash", hash).
 		Str("file_name", name).
-		Str("file_path", filePath).
 		Uint64("size", info.Size).
 		Uint32("chunks", info.Chunks).
+		Str("digest", info.Digest).
 		Msg("Snapshot saved to NATS")
 
 	return nil
 }
 
-func (n *natsStorage) Download(filePath, name string) error {
+func (n *natsStorage) Download(name string, w io.Writer) error {
 	blb, err := getBlobStore(n.nc)
 	if err != nil {
 		return err
 	}
 
 	for {
-		err = blb.GetFile(name, filePath)
+		res, err := blb.Get(name)
 		if err == nil {
-			return nil
+			defer res.Close()
+			_, err = io.Copy(w, res)
+			return err
 		}
 
 		if err == nats.ErrObjectNotFound {
@@ -91,8 +70,45 @@ func (n *natsStorage) Download(filePath, name string) error {
 	}
 }
 
+func (n *natsStorage) Delete(name string) error {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return err
+	}
+
+	err = blb.Delete(name)
+	if err != nil && err != nats.ErrObjectNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (n *natsStorage) List() ([]string, error) {
+	blb, err := getBlobStore(n.nc)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := blb.List()
+	if err == nats.ErrNoObjectsFound {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return names, nil
+}
+
 func getBlobStore(conn *nats.Conn) (nats.ObjectStore, error) {
-	js, err := conn.JetStream(nats.MaxWait(30 * time.Second))
+	js, err := conn.JetStream(stream.JetStreamOptions(nats.MaxWait(30 * time.Second))...)
 	if err != nil {
 		return nil, err
 	}
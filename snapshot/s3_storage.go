@@ -3,7 +3,9 @@ package snapshot
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -16,11 +18,11 @@ type s3Storage struct {
 	mc *minio.Client
 }
 
-func (s s3Storage) Upload(name, filePath string) error {
+func (s s3Storage) Upload(name string, rd io.Reader) error {
 	ctx := context.Background()
 	cS3 := cfg.Config.Snapshot.S3
 	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
-	info, err := s.mc.FPutObject(ctx, cS3.Bucket, bucketPath, filePath, minio.PutObjectOptions{})
+	info, err := s.mc.PutObject(ctx, cS3.Bucket, bucketPath, rd, -1, minio.PutObjectOptions{})
 	if err != nil {
 		return err
 	}
@@ -28,27 +30,63 @@ func (s s3Storage) Upload(name, filePath string) error {
 	log.Info().
 		Str("file_name", name).
 		Int64("size", info.Size).
-		Str("file_path", filePath).
 		Str("bucket", info.Bucket).
 		Msg("Snapshot saved to S3")
 
 	return nil
 }
 
-func (s s3Storage) Download(filePath, name string) error {
+func (s s3Storage) Download(name string, w io.Writer) error {
 	ctx := context.Background()
 	cS3 := cfg.Config.Snapshot.S3
 	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
-	err := s.mc.FGetObject(ctx, cS3.Bucket, bucketPath, filePath, minio.GetObjectOptions{})
+	obj, err := s.mc.GetObject(ctx, cS3.Bucket, bucketPath, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	// Errors, including missing objects, surface on first access
+	_, err = obj.Stat()
 	if mErr, ok := err.(minio.ErrorResponse); ok {
 		if mErr.StatusCode == http.StatusNotFound {
 			return ErrNoSnapshotFound
 		}
 	}
 
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, obj)
 	return err
 }
 
+func (s s3Storage) Delete(name string) error {
+	ctx := context.Background()
+	cS3 := cfg.Config.Snapshot.S3
+	bucketPath := fmt.Sprintf("%s/%s", cS3.DirPath, name)
+	return s.mc.RemoveObject(ctx, cS3.Bucket, bucketPath, minio.RemoveObjectOptions{})
+}
+
+func (s s3Storage) List() ([]string, error) {
+	cS3 := cfg.Config.Snapshot.S3
+	prefix := fmt.Sprintf("%s/", cS3.DirPath)
+	names := make([]string, 0)
+	for obj := range s.mc.ListObjects(context.Background(), cS3.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
 func newS3Storage() (*s3Storage, error) {
 	c := cfg.Config
 	cS3 := c.Snapshot.S3
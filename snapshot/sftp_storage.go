@@ -1,6 +1,7 @@
 package snapshot
 
 import (
+	"io"
 	"net"
 	"net/url"
 	"os"
@@ -17,18 +18,12 @@ type sftpStorage struct {
 	uploadPath string
 }
 
-func (s *sftpStorage) Upload(name, filePath string) error {
+func (s *sftpStorage) Upload(name string, rd io.Reader) error {
 	err := s.client.MkdirAll(s.uploadPath)
 	if err != nil {
 		return err
 	}
 
-	srcFile, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
 	uploadPath := path.Join(s.uploadPath, name)
 	dstFile, err := s.client.OpenFile(uploadPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
@@ -36,21 +31,20 @@ func (s *sftpStorage) Upload(name, filePath string) error {
 	}
 	defer dstFile.Close()
 
-	bytes, err := dstFile.ReadFrom(srcFile)
+	bytes, err := dstFile.ReadFrom(rd)
 	if err != nil {
 		return err
 	}
 
 	log.Info().
 		Str("file_name", name).
-		Str("file_path", filePath).
 		Str("sftp_path", uploadPath).
 		Int64("bytes", bytes).
 		Msg("Snapshot uploaded to SFTP server")
 	return nil
 }
 
-func (s *sftpStorage) Download(filePath, name string) error {
+func (s *sftpStorage) Download(name string, w io.Writer) error {
 	remotePath := path.Join(s.uploadPath, name)
 	srcFile, err := s.client.Open(remotePath)
 	if err != nil {
@@ -61,22 +55,44 @@ func (s *sftpStorage) Download(filePath, name string) error {
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	bytes, err := dstFile.ReadFrom(srcFile)
+	bytes, err := srcFile.WriteTo(w)
 	log.Info().
 		Str("file_name", name).
-		Str("file_path", filePath).
 		Str("sftp_path", remotePath).
 		Int64("bytes", bytes).
 		Msg("Snapshot downloaded from SFTP server")
 	return err
 }
 
+func (s *sftpStorage) Delete(name string) error {
+	err := s.client.Remove(path.Join(s.uploadPath, name))
+	if err != nil && (os.IsNotExist(err) || err.Error() == "file does not exist") {
+		return nil
+	}
+
+	return err
+}
+
+func (s *sftpStorage) List() ([]string, error) {
+	entries, err := s.client.ReadDir(s.uploadPath)
+	if err != nil && (os.IsNotExist(err) || err.Error() == "file does not exist") {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
 func newSFTPStorage() (*sftpStorage, error) {
 	// Get the SFTP URL from the environment
 	sftpURL := cfg.Config.Snapshot.SFTP.Url
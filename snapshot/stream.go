@@ -0,0 +1,168 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// uploadStream uploads whatever produce writes, without buffering it on disk
+func uploadStream(storage Storage, name string, produce func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(produce(pw))
+	}()
+
+	err := storage.Upload(name, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+// downloadStream downloads name and hands its content to consume as it arrives
+func downloadStream(storage Storage, name string, consume func(r io.Reader) error) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := consume(pr)
+		if err == nil {
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	err := storage.Download(name, pw)
+	pw.CloseWithError(err)
+	cErr := <-done
+	if err != nil {
+		return err
+	}
+
+	return cErr
+}
+
+// uploadFile streams the file at p to storage, zstd compressed when level > 0.
+// Returns the SHA-256 of the uncompressed content.
+func uploadFile(storage Storage, name, p string, level int) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	rd := io.TeeReader(f, h)
+	if level <= 0 {
+		err = storage.Upload(name, rd)
+	} else {
+		err = uploadStream(storage, name, func(w io.Writer) error {
+			return compressStream(w, rd, level)
+		})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadFile downloads name into the file at p, decompressing it if needed
+func downloadFile(storage Storage, name, p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	err = downloadStream(storage, name, func(r io.Reader) error {
+		return decompressStream(f, r)
+	})
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+func compressStream(dst io.Writer, src io.Reader, level int) error {
+	enc, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return err
+	}
+
+	_, err = enc.ReadFrom(src)
+	if cErr := enc.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+// compressedWriter hands produce a writer compressing into dst, or dst itself when level is 0
+func compressedWriter(dst io.Writer, level int, produce func(w io.Writer) error) error {
+	if level <= 0 {
+		return produce(dst)
+	}
+
+	enc, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return err
+	}
+
+	err = produce(enc)
+	if cErr := enc.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+// decompressStream copies src into dst, decompressing it when it starts with a zstd frame
+func decompressStream(dst io.Writer, src io.Reader) error {
+	rd := bufio.NewReader(src)
+	magic, err := rd.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if !bytes.Equal(magic, zstdMagic) {
+		_, err = io.Copy(dst, rd)
+		return err
+	}
+
+	dec, err := zstd.NewReader(rd)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	_, err = io.Copy(dst, dec)
+	return err
+}
+
+func uploadJSON(storage Storage, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return storage.Upload(name, bytes.NewReader(data))
+}
+
+func downloadJSON(storage Storage, name string, v any) error {
+	buf := &bytes.Buffer{}
+	err := storage.Download(name, buf)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf.Bytes(), v)
+}
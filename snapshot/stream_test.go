@@ -0,0 +1,74 @@
+package snapshot
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadFile_Compression(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "plain")
+	plain := bytes.Repeat([]byte("harmonylite snapshot page "), 10000)
+	require.NoError(t, os.WriteFile(src, plain, 0644))
+	expected, err := fileHash(src)
+	require.NoError(t, err)
+
+	t.Run("compressed", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		digest, err := uploadFile(storage, "object", src, 3)
+		require.NoError(t, err)
+		assert.Equal(t, expected, digest, "digest covers uncompressed content")
+
+		stored, err := os.ReadFile(filepath.Join(storage.dir, "object"))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(stored, zstdMagic))
+		assert.Less(t, len(stored), len(plain))
+
+		dst := filepath.Join(t.TempDir(), "restored")
+		require.NoError(t, downloadFile(storage, "object", dst))
+		restored, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, plain, restored)
+	})
+
+	t.Run("uncompressed objects are restored as is", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		digest, err := uploadFile(storage, "object", src, 0)
+		require.NoError(t, err)
+		assert.Equal(t, expected, digest)
+
+		stored, err := os.ReadFile(filepath.Join(storage.dir, "object"))
+		require.NoError(t, err)
+		assert.Equal(t, plain, stored)
+
+		dst := filepath.Join(t.TempDir(), "restored")
+		require.NoError(t, downloadFile(storage, "object", dst))
+		restored, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, plain, restored)
+	})
+
+	t.Run("truncated compressed object fails", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		_, err := uploadFile(storage, "object", src, 3)
+		require.NoError(t, err)
+
+		p := filepath.Join(storage.dir, "object")
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(p, info.Size()/2))
+
+		err = downloadFile(storage, "object", filepath.Join(t.TempDir(), "restored"))
+		assert.Error(t, err)
+	})
+
+	t.Run("missing object", func(t *testing.T) {
+		storage := &fileStorage{dir: t.TempDir()}
+		err := downloadFile(storage, "object", filepath.Join(t.TempDir(), "restored"))
+		assert.ErrorIs(t, err, ErrNoSnapshotFound)
+	})
+}
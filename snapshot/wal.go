@@ -0,0 +1,228 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// SQLite WAL layout, see https://www.sqlite.org/fileformat.html#the_write_ahead_log
+const walHeaderSize = 32
+const walFrameHeaderSize = 24
+const walMagic = 0x377f0682
+
+// WAL segments start with walSegmentMagic, the time frames were read (8 bytes, unix nanoseconds)
+// and the page size (4 bytes), followed by WAL frames exactly as SQLite wrote them
+var walSegmentMagic = []byte("HLWALSG1")
+
+var errNoWAL = errors.New("database has no WAL")
+
+type walHeader struct {
+	bigEndian bool // Byte order of checksummed words
+	pageSize  int
+	ckptSeq   uint32
+	salt      [8]byte
+	checksum  [2]uint32
+}
+
+// readWALHeader reads the header of the WAL at p, errNoWAL when there is none yet
+func readWALHeader(p string) (*walHeader, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, errNoWAL
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, walHeaderSize)
+	_, err = io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errNoWAL
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	magic := binary.BigEndian.Uint32(buf[0:4])
+	if magic&^1 != walMagic {
+		return nil, fmt.Errorf("invalid WAL magic %x", magic)
+	}
+
+	h := &walHeader{
+		bigEndian: magic&1 == 1,
+		pageSize:  int(binary.BigEndian.Uint32(buf[8:12])),
+		ckptSeq:   binary.BigEndian.Uint32(buf[12:16]),
+		checksum:  [2]uint32{binary.BigEndian.Uint32(buf[24:28]), binary.BigEndian.Uint32(buf[28:32])},
+	}
+	copy(h.salt[:], buf[16:24])
+	if h.pageSize == 1 {
+		h.pageSize = 65536
+	}
+
+	if walChecksum(h.bigEndian, [2]uint32{}, buf[:24]) != h.checksum {
+		return nil, fmt.Errorf("invalid WAL header checksum")
+	}
+
+	return h, nil
+}
+
+// walChecksum continues the WAL checksum s over b
+func walChecksum(bigEndian bool, s [2]uint32, b []byte) [2]uint32 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	for i := 0; i+8 <= len(b); i += 8 {
+		s[0] += order.Uint32(b[i:]) + s[1]
+		s[1] += order.Uint32(b[i+4:]) + s[0]
+	}
+
+	return s
+}
+
+// walCursor is a position in the WAL, right after a commit frame or the header
+type walCursor struct {
+	hdr      *walHeader
+	offset   int64
+	checksum [2]uint32
+}
+
+func newWALCursor(hdr *walHeader) walCursor {
+	return walCursor{hdr: hdr, offset: walHeaderSize, checksum: hdr.checksum}
+}
+
+func (c walCursor) frameSize() int64 {
+	return walFrameHeaderSize + int64(c.hdr.pageSize)
+}
+
+// next reads the frames following the cursor in the WAL at p, up to the last commit frame.
+// Reading stops at the first commit frame past limit bytes when limit > 0. It returns the
+// frames and the cursor after them, along with the end of the valid frames, committed or not.
+// Frames are valid while their salt matches the header and their checksums chain.
+func (c walCursor) next(p string, limit int64) ([]byte, walCursor, int64, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, c, 0, errNoWAL
+	}
+
+	if err != nil {
+		return nil, c, 0, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReaderSize(io.NewSectionReader(f, c.offset, math.MaxInt64-c.offset), 64*1024)
+	frames := &bytes.Buffer{}
+	frame := make([]byte, c.frameSize())
+	committed := c
+	end, checksum := c.offset, c.checksum
+	for {
+		_, err := io.ReadFull(rd, frame)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, c, 0, err
+		}
+
+		if !bytes.Equal(frame[8:16], c.hdr.salt[:]) {
+			break
+		}
+
+		checksum = walChecksum(c.hdr.bigEndian, checksum, frame[:8])
+		checksum = walChecksum(c.hdr.bigEndian, checksum, frame[walFrameHeaderSize:])
+		if checksum[0] != binary.BigEndian.Uint32(frame[16:20]) || checksum[1] != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+
+		frames.Write(frame)
+		end += c.frameSize()
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			committed.offset = end
+			committed.checksum = checksum
+			if limit > 0 && end-c.offset >= limit {
+				break
+			}
+		}
+	}
+
+	frames.Truncate(int(committed.offset - c.offset))
+	return frames.Bytes(), committed, end, nil
+}
+
+func writeWALSegment(w io.Writer, t time.Time, pageSize int, frames []byte) error {
+	header := bytes.NewBuffer(nil)
+	header.Write(walSegmentMagic)
+	binary.Write(header, binary.BigEndian, t.UnixNano())
+	binary.Write(header, binary.BigEndian, uint32(pageSize))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	_, err := w.Write(frames)
+	return err
+}
+
+// readWALSegment returns the time and page size of a segment, leaving rd at its frames
+func readWALSegment(rd io.Reader) (time.Time, int, error) {
+	header := make([]byte, len(walSegmentMagic)+12)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.Equal(header[:len(walSegmentMagic)], walSegmentMagic) {
+		return time.Time{}, 0, fmt.Errorf("%w: invalid WAL segment header", ErrCorruptSnapshot)
+	}
+
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(header[len(walSegmentMagic):])))
+	pageSize := int(binary.BigEndian.Uint32(header[len(walSegmentMagic)+8:]))
+	return t, pageSize, nil
+}
+
+// applyWALFrames writes the pages of the frames read from rd to the database file f, resizing
+// it on every commit frame. Frames must end with a commit frame.
+func applyWALFrames(f *os.File, rd io.Reader, pageSize int) error {
+	frame := make([]byte, walFrameHeaderSize+pageSize)
+	committed := true
+	for {
+		_, err := io.ReadFull(rd, frame)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: truncated WAL segment: %v", ErrCorruptSnapshot, err)
+		}
+
+		pgno := binary.BigEndian.Uint32(frame[0:4])
+		if pgno == 0 {
+			return fmt.Errorf("%w: invalid WAL frame page number", ErrCorruptSnapshot)
+		}
+
+		if _, err := f.WriteAt(frame[walFrameHeaderSize:], int64(pgno-1)*int64(pageSize)); err != nil {
+			return err
+		}
+
+		committed = false
+		if size := binary.BigEndian.Uint32(frame[4:8]); size != 0 {
+			if err := f.Truncate(int64(size) * int64(pageSize)); err != nil {
+				return err
+			}
+
+			committed = true
+		}
+	}
+
+	if !committed {
+		return fmt.Errorf("%w: WAL segment ends with uncommitted frames", ErrCorruptSnapshot)
+	}
+
+	return nil
+}
@@ -0,0 +1,587 @@
+package snapshot
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+)
+
+const walIndexFileName = "wal-index.json"
+
+// walCheckpointFrames is the WAL size, in frames, after which the archiver lets SQLite
+// checkpoint and restart the WAL
+const walCheckpointFrames = 1000
+
+// walSegmentMaxSize caps the frames held in memory for a single segment
+const walSegmentMaxSize = 16 * 1024 * 1024
+
+var ErrNoWALGeneration = errors.New("no archived WAL covers the requested time")
+var errWALGap = errors.New("WAL continuity lost")
+
+// walTable is written to by the archiver so the WAL always holds frames it can pin
+var walTable = db.HarmonyLitePrefix + "wal_archive"
+
+// WALGeneration is a base copy of the database followed by the WAL segments shipped after it.
+// The first segment holds the WAL present when the base was copied and is always applied.
+type WALGeneration struct {
+	ID        string    `json:"id"`
+	NodeID    uint64    `json:"node_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	PageSize  int       `json:"page_size"`
+	SHA256    string    `json:"sha256"`
+	Segments  int       `json:"segments"`
+}
+
+// WALIndex lists archived WAL generations, oldest first
+type WALIndex struct {
+	Generations []*WALGeneration `json:"generations"`
+}
+
+// BaseName is the storage object name of the base copy of the database
+func (g *WALGeneration) BaseName() string {
+	return fmt.Sprintf("wal-%s-base.db", g.ID)
+}
+
+// SegmentName is the storage object name of the i-th WAL segment
+func (g *WALGeneration) SegmentName(i int) string {
+	return fmt.Sprintf("wal-%s-%08d.frames", g.ID, i)
+}
+
+// Put adds or replaces a generation
+func (idx *WALIndex) Put(g *WALGeneration) {
+	for i, e := range idx.Generations {
+		if e.ID == g.ID {
+			idx.Generations[i] = g
+			return
+		}
+	}
+
+	idx.Generations = append(idx.Generations, g)
+	sort.SliceStable(idx.Generations, func(i, j int) bool {
+		return idx.Generations[i].CreatedAt.Before(idx.Generations[j].CreatedAt)
+	})
+}
+
+// At returns the newest generation created at or before t, nil if there is none
+func (idx *WALIndex) At(t time.Time) *WALGeneration {
+	for i := len(idx.Generations) - 1; i >= 0; i-- {
+		if !idx.Generations[i].CreatedAt.After(t) {
+			return idx.Generations[i]
+		}
+	}
+
+	return nil
+}
+
+// ApplyRetention drops generations superseded by a generation created before now-retention
+// and returns them, so every point in time within retention stays restorable. The newest
+// generation is always kept.
+func (idx *WALIndex) ApplyRetention(retention time.Duration, now time.Time) []*WALGeneration {
+	cutoff := now.Add(-retention)
+	removed := make([]*WALGeneration, 0)
+	for len(idx.Generations) > 1 && !idx.Generations[1].CreatedAt.After(cutoff) {
+		removed = append(removed, idx.Generations[0])
+		idx.Generations = idx.Generations[1:]
+	}
+
+	return removed
+}
+
+// WALArchiver ships the WAL of the database to snapshot storage while this node is the
+// snapshot leader. It holds a read transaction so SQLite can't restart the WAL before frames
+// are shipped, and releases it every walCheckpointFrames frames to let the WAL be checkpointed.
+// When continuity can't be guaranteed, a new generation is started.
+type WALArchiver struct {
+	dbPath  string
+	storage Storage
+
+	db     *sql.DB
+	rtx    *sql.Tx
+	index  *WALIndex
+	gen    *WALGeneration
+	cursor walCursor
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewWALArchiver(dbPath string, storage Storage) *WALArchiver {
+	return &WALArchiver{
+		dbPath:  dbPath,
+		storage: storage,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Start ships WAL every configured interval while isLeader returns true
+func (a *WALArchiver) Start(isLeader func() bool) {
+	interval, _, _ := walArchivePolicy()
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer a.release()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stopCh:
+				return
+			case <-ticker.C:
+				a.sync(isLeader())
+			}
+		}
+	}()
+
+	log.Info().Dur("interval", interval).Msg("WAL archiving started")
+}
+
+// Stop stops shipping WAL and releases the database
+func (a *WALArchiver) Stop() {
+	close(a.stopCh)
+	a.wg.Wait()
+}
+
+func (a *WALArchiver) sync(leader bool) {
+	if !leader {
+		if a.gen != nil {
+			log.Info().Str("generation", a.gen.ID).Msg("Not the snapshot leader anymore, pausing WAL archiving")
+		}
+
+		a.release()
+		return
+	}
+
+	_, generationInterval, _ := walArchivePolicy()
+	if a.gen == nil || time.Since(a.gen.CreatedAt) >= generationInterval {
+		if err := a.startGeneration(); err != nil {
+			log.Warn().Err(err).Msg("Unable to start WAL generation")
+			a.release()
+			return
+		}
+	}
+
+	err := a.ship()
+	if errors.Is(err, errWALGap) {
+		log.Warn().Str("generation", a.gen.ID).Msg("WAL continuity lost, starting new generation")
+		a.gen = nil
+		return
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Str("generation", a.gen.ID).Msg("Unable to ship WAL")
+		return
+	}
+
+	if a.cursor.offset >= walHeaderSize+walCheckpointFrames*a.cursor.frameSize() {
+		a.checkpoint()
+	}
+}
+
+// startGeneration uploads a base copy of the database along with the WAL it was copied with
+func (a *WALArchiver) startGeneration() error {
+	if a.db == nil {
+		d, err := sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=5000", a.dbPath))
+		if err != nil {
+			return err
+		}
+
+		d.SetMaxOpenConns(2)
+		a.db = d
+	}
+
+	// Writing first makes sure the WAL holds frames, so the read lock pins it
+	a.releaseReadLock()
+	if err := a.touch(); err != nil {
+		return err
+	}
+
+	if err := a.acquireReadLock(); err != nil {
+		return err
+	}
+
+	hdr, err := readWALHeader(a.walPath())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	gen := &WALGeneration{ID: newSnapshotID(now), NodeID: cfg.Config.NodeID, CreatedAt: now, PageSize: hdr.pageSize}
+
+	// Pages checkpointed while the database is copied are overwritten by the first segment,
+	// which holds every frame of the WAL
+	gen.SHA256, err = uploadFile(a.storage, gen.BaseName(), a.dbPath, compressionLevel())
+	if err != nil {
+		return err
+	}
+
+	a.gen, a.cursor = gen, newWALCursor(hdr)
+	if _, err := a.shipFrames(); err != nil {
+		a.gen = nil
+		return err
+	}
+
+	if gen.Segments > 0 {
+		gen.CreatedAt = gen.UpdatedAt
+	}
+
+	idx := &WALIndex{}
+	err = downloadJSON(a.storage, walIndexFileName, idx)
+	if err != nil && !errors.Is(err, ErrNoSnapshotFound) {
+		a.gen = nil
+		return err
+	}
+
+	_, _, retention := walArchivePolicy()
+	idx.Put(gen)
+	removed := idx.ApplyRetention(retention, now)
+	a.index = idx
+	if err := uploadJSON(a.storage, walIndexFileName, idx); err != nil {
+		a.gen = nil
+		return err
+	}
+
+	for _, g := range removed {
+		names := []string{g.BaseName()}
+		for i := 0; i < g.Segments; i++ {
+			names = append(names, g.SegmentName(i))
+		}
+
+		for _, name := range names {
+			if err := a.storage.Delete(name); err != nil {
+				log.Warn().Err(err).Str("name", name).Msg("Unable to delete expired WAL")
+			}
+		}
+	}
+
+	log.Info().
+		Str("generation", gen.ID).
+		Int("page_size", gen.PageSize).
+		Int("expired", len(removed)).
+		Msg("Started WAL generation")
+	return nil
+}
+
+// ship uploads frames committed since the last segment
+func (a *WALArchiver) ship() error {
+	shipped, err := a.shipFrames()
+	if err != nil || !shipped {
+		return err
+	}
+
+	a.index.Put(a.gen)
+	return uploadJSON(a.storage, walIndexFileName, a.index)
+}
+
+func (a *WALArchiver) shipFrames() (bool, error) {
+	hdr, err := readWALHeader(a.walPath())
+	if errors.Is(err, errNoWAL) {
+		return false, errWALGap
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	shipped := false
+	if hdr.salt != a.cursor.hdr.salt {
+		shipped, err = a.followRestart(hdr)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for {
+		frames, next, _, err := a.cursor.next(a.walPath(), walSegmentMaxSize)
+		if errors.Is(err, errNoWAL) {
+			return false, errWALGap
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if len(frames) == 0 {
+			return shipped, nil
+		}
+
+		if err := a.uploadSegment(frames); err != nil {
+			return false, err
+		}
+
+		a.cursor = next
+		shipped = true
+	}
+}
+
+// followRestart moves the cursor to a WAL restarted by a checkpoint. Frames committed to the
+// previous WAL after the cursor are shipped first, unless the new WAL may have overwritten them.
+func (a *WALArchiver) followRestart(hdr *walHeader) (bool, error) {
+	if hdr.ckptSeq != a.cursor.hdr.ckptSeq+1 {
+		return false, errWALGap
+	}
+
+	restarted := newWALCursor(hdr)
+	overlaps := func() (bool, error) {
+		_, _, end, err := restarted.next(a.walPath(), 0)
+		return end+restarted.frameSize() > a.cursor.offset, err
+	}
+
+	if o, err := overlaps(); err != nil || o {
+		return false, errWALGap
+	}
+
+	tail, _, _, err := a.cursor.next(a.walPath(), 0)
+	if err != nil {
+		return false, err
+	}
+
+	if o, err := overlaps(); err != nil || o {
+		return false, errWALGap
+	}
+
+	if len(tail) > 0 {
+		if err := a.uploadSegment(tail); err != nil {
+			return false, err
+		}
+	}
+
+	a.cursor = restarted
+	return len(tail) > 0, nil
+}
+
+func (a *WALArchiver) uploadSegment(frames []byte) error {
+	now := time.Now()
+	name := a.gen.SegmentName(a.gen.Segments)
+	err := uploadStream(a.storage, name, func(w io.Writer) error {
+		return compressedWriter(w, compressionLevel(), func(w io.Writer) error {
+			return writeWALSegment(w, now, a.gen.PageSize, frames)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	a.gen.Segments++
+	a.gen.UpdatedAt = now
+	return nil
+}
+
+// checkpoint releases the read lock so the WAL can be checkpointed, and restarted by the
+// following write. Frames committed meanwhile are picked up by followRestart.
+func (a *WALArchiver) checkpoint() {
+	a.releaseReadLock()
+
+	var busy, frames, checkpointed int
+	err := a.db.QueryRow("PRAGMA wal_checkpoint(PASSIVE);").Scan(&busy, &frames, &checkpointed)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to checkpoint WAL")
+	}
+
+	if err := a.touch(); err != nil {
+		log.Warn().Err(err).Msg("Unable to restart WAL")
+	}
+
+	if err := a.acquireReadLock(); err != nil {
+		log.Warn().Err(err).Msg("Unable to lock WAL, starting new generation")
+		a.gen = nil
+		return
+	}
+
+	log.Debug().Int("frames", frames).Int("checkpointed", checkpointed).Msg("WAL checkpointed")
+}
+
+func (a *WALArchiver) touch() error {
+	_, err := a.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, seq INTEGER NOT NULL)", walTable))
+	if err != nil {
+		return err
+	}
+
+	_, err = a.db.Exec(fmt.Sprintf("INSERT INTO %s (id, seq) VALUES (1, 1) ON CONFLICT (id) DO UPDATE SET seq = seq + 1", walTable))
+	return err
+}
+
+func (a *WALArchiver) acquireReadLock() error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	if err := tx.QueryRow("SELECT COUNT(1) FROM sqlite_master").Scan(&n); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	a.rtx = tx
+	return nil
+}
+
+func (a *WALArchiver) releaseReadLock() {
+	if a.rtx == nil {
+		return
+	}
+
+	if err := a.rtx.Rollback(); err != nil {
+		log.Warn().Err(err).Msg("Unable to release WAL read lock")
+	}
+	a.rtx = nil
+}
+
+func (a *WALArchiver) release() {
+	a.releaseReadLock()
+	if a.db != nil {
+		a.db.Close()
+		a.db = nil
+	}
+
+	a.gen = nil
+}
+
+func (a *WALArchiver) walPath() string {
+	return a.dbPath + "-wal"
+}
+
+// WALRestore describes a database rebuilt from archived WAL
+type WALRestore struct {
+	Generation string    `json:"generation"`
+	Segments   int       `json:"segments"`
+	RestoredTo time.Time `json:"restored_to"`
+}
+
+// RestoreWAL rebuilds the database as of t into p, which must not exist, from the newest
+// generation started before t and its segments shipped up to t. Like snapshots, the rebuilt
+// database holds no HarmonyLite tables or triggers.
+func RestoreWAL(storage Storage, t time.Time, p string) (*WALRestore, error) {
+	idx := &WALIndex{}
+	err := downloadJSON(storage, walIndexFileName, idx)
+	if errors.Is(err, ErrNoSnapshotFound) {
+		return nil, ErrNoWALGeneration
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	gen := idx.At(t)
+	if gen == nil {
+		return nil, ErrNoWALGeneration
+	}
+
+	tmpDir, err := os.MkdirTemp(os.TempDir(), tempDirPattern)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupDir(tmpDir)
+
+	basePath := path.Join(tmpDir, gen.BaseName())
+	err = downloadFile(storage, gen.BaseName(), basePath)
+	if err != nil {
+		return nil, fmt.Errorf("downloading WAL base %s: %w", gen.ID, err)
+	}
+
+	if gen.SHA256 != "" {
+		digest, err := fileHash(basePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if digest != gen.SHA256 {
+			return nil, fmt.Errorf("%w: WAL base sha256 mismatch (expected %s, got %s)", ErrCorruptSnapshot, gen.SHA256, digest)
+		}
+	}
+
+	result := &WALRestore{Generation: gen.ID, RestoredTo: gen.CreatedAt}
+	err = applyWALSegments(storage, gen, t, basePath, result)
+	if err != nil {
+		return nil, err
+	}
+
+	streamDB, err := db.OpenStreamDB(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = streamDB.BackupTo(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkIntegrity(p)
+	if err != nil {
+		os.Remove(p)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// applyWALSegments applies segments of gen shipped up to t to the base database at p
+func applyWALSegments(storage Storage, gen *WALGeneration, t time.Time, p string, result *WALRestore) error {
+	f, err := os.OpenFile(p, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i := 0; ; i++ {
+		buf := &bytes.Buffer{}
+		err := downloadStream(storage, gen.SegmentName(i), func(r io.Reader) error {
+			return decompressStream(buf, r)
+		})
+		if errors.Is(err, ErrNoSnapshotFound) && i >= gen.Segments {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("downloading WAL segment %d of %s: %w", i, gen.ID, err)
+		}
+
+		shippedAt, pageSize, err := readWALSegment(buf)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 && shippedAt.After(t) {
+			break
+		}
+
+		if err := applyWALFrames(f, buf, pageSize); err != nil {
+			return fmt.Errorf("applying WAL segment %d of %s: %w", i, gen.ID, err)
+		}
+
+		result.Segments++
+		result.RestoredTo = shippedAt
+	}
+
+	return f.Sync()
+}
+
+// walArchivePolicy returns how often WAL is shipped, after how long a new generation is
+// started and for how long archived WAL is kept
+func walArchivePolicy() (time.Duration, time.Duration, time.Duration) {
+	c := cfg.Config.Snapshot.WAL
+	interval := time.Duration(c.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	generationInterval := time.Duration(c.GenerationInterval) * time.Second
+	if generationInterval <= 0 {
+		generationInterval = 24 * time.Hour
+	}
+
+	return interval, generationInterval, time.Duration(c.Retention) * time.Second
+}
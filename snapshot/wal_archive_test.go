@@ -0,0 +1,135 @@
+package snapshot
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openWALTestDB creates a WAL mode database with an items table, writes go through the
+// returned connection while the archiver works on the same file
+func openWALTestDB(t *testing.T) (string, *sql.DB) {
+	p := filepath.Join(t.TempDir(), "wal.db")
+	raw, err := sql.Open("sqlite3", p+"?_journal_mode=WAL&_busy_timeout=5000")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		raw.Close()
+	})
+
+	_, err = raw.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	require.NoError(t, err)
+	return p, raw
+}
+
+func insertWALTestRows(t *testing.T, raw *sql.DB, rows int) {
+	for i := 0; i < rows; i++ {
+		_, err := raw.Exec("INSERT INTO items (name) VALUES (?)", fmt.Sprintf("item-%d", i))
+		require.NoError(t, err)
+	}
+}
+
+func restoreWALTest(t *testing.T, storage Storage, at time.Time) (*WALRestore, int) {
+	p := filepath.Join(t.TempDir(), "restored.db")
+	result, err := RestoreWAL(storage, at, p)
+	require.NoError(t, err)
+	return result, countTestRows(t, p)
+}
+
+func TestWALArchiver(t *testing.T) {
+	p, raw := openWALTestDB(t)
+	storage := &fileStorage{dir: t.TempDir()}
+	archiver := NewWALArchiver(p, storage)
+	defer archiver.release()
+
+	insertWALTestRows(t, raw, 10)
+	archiver.sync(true)
+	require.NotNil(t, archiver.gen)
+	generation := archiver.gen.ID
+
+	insertWALTestRows(t, raw, 10)
+	archiver.sync(true)
+	time.Sleep(5 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	insertWALTestRows(t, raw, 10)
+	archiver.sync(true)
+
+	result, count := restoreWALTest(t, storage, middle)
+	assert.Equal(t, 20, count)
+	assert.Equal(t, generation, result.Generation)
+	assert.False(t, result.RestoredTo.After(middle))
+
+	_, count = restoreWALTest(t, storage, time.Now())
+	assert.Equal(t, 30, count)
+
+	t.Run("follows WAL restarts", func(t *testing.T) {
+		archiver.checkpoint()
+		insertWALTestRows(t, raw, 10)
+		archiver.sync(true)
+		assert.Equal(t, generation, archiver.gen.ID)
+
+		_, count := restoreWALTest(t, storage, time.Now())
+		assert.Equal(t, 40, count)
+	})
+
+	t.Run("starts new generation on gaps", func(t *testing.T) {
+		// Two restarts without the read lock lose frames the archiver never saw
+		archiver.releaseReadLock()
+		for i := 0; i < 3; i++ {
+			insertWALTestRows(t, raw, 5)
+			_, err := raw.Exec("PRAGMA wal_checkpoint(PASSIVE);")
+			require.NoError(t, err)
+		}
+		insertWALTestRows(t, raw, 5)
+		require.NoError(t, archiver.acquireReadLock())
+		hdr, err := readWALHeader(p + "-wal")
+		require.NoError(t, err)
+		require.Greater(t, hdr.ckptSeq, archiver.cursor.hdr.ckptSeq+1)
+
+		archiver.sync(true)
+		assert.Nil(t, archiver.gen)
+		archiver.sync(true)
+		require.NotNil(t, archiver.gen)
+		assert.NotEqual(t, generation, archiver.gen.ID)
+
+		result, count := restoreWALTest(t, storage, time.Now())
+		assert.Equal(t, archiver.gen.ID, result.Generation)
+		assert.Equal(t, 60, count)
+
+		idx := &WALIndex{}
+		require.NoError(t, downloadJSON(storage, walIndexFileName, idx))
+		assert.Len(t, idx.Generations, 2)
+	})
+
+	t.Run("before first generation", func(t *testing.T) {
+		_, err := RestoreWAL(storage, time.Now().Add(-time.Hour), filepath.Join(t.TempDir(), "restored.db"))
+		assert.ErrorIs(t, err, ErrNoWALGeneration)
+	})
+}
+
+func TestWALIndex_ApplyRetention(t *testing.T) {
+	now := time.Now()
+	idx := &WALIndex{}
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour, time.Hour} {
+		created := now.Add(-age)
+		idx.Put(&WALGeneration{ID: newSnapshotID(created), CreatedAt: created})
+	}
+
+	// The generation started 48h ago is needed to restore 36h back
+	removed := idx.ApplyRetention(36*time.Hour, now)
+	require.Len(t, removed, 1)
+	assert.Equal(t, now.Add(-72*time.Hour).Unix(), removed[0].CreatedAt.Unix())
+	assert.Len(t, idx.Generations, 3)
+	assert.Equal(t, idx.Generations[0], idx.At(now.Add(-36*time.Hour)))
+
+	removed = idx.ApplyRetention(0, now)
+	assert.Len(t, removed, 2)
+	require.Len(t, idx.Generations, 1)
+	assert.Nil(t, idx.At(now.Add(-2*time.Hour)))
+}
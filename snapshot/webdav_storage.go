@@ -23,20 +23,14 @@ type webDAVStorage struct {
 	path   string
 }
 
-func (w *webDAVStorage) Upload(name, filePath string) error {
-	rfl, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-	defer rfl.Close()
-
-	err = w.makeStoragePath()
+func (w *webDAVStorage) Upload(name string, rd io.Reader) error {
+	err := w.makeStoragePath()
 	if err != nil {
 		return err
 	}
 
 	nodePath := fmt.Sprintf("%s-%d-temp-%s", cfg.Config.NodeName(), time.Now().UnixMilli(), name)
-	err = w.client.WriteStream(nodePath, rfl, 0644)
+	err = w.client.WriteStream(nodePath, rd, 0644)
 	if err != nil {
 		return err
 	}
@@ -49,13 +43,12 @@ func (w *webDAVStorage) Upload(name, filePath string) error {
 
 	log.Info().
 		Str("file_name", name).
-		Str("file_path", filePath).
 		Str("webdav_path", completedPath).
 		Msg("Snapshot saved to WebDAV")
 	return nil
 }
 
-func (w *webDAVStorage) Download(filePath, name string) error {
+func (w *webDAVStorage) Download(name string, wr io.Writer) error {
 	completedPath := path.Join(w.path, name)
 	rst, err := w.client.ReadStream(completedPath)
 	if err != nil {
@@ -68,24 +61,42 @@ func (w *webDAVStorage) Download(filePath, name string) error {
 	}
 	defer rst.Close()
 
-	wst, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer wst.Close()
-
-	if _, err = io.Copy(wst, rst); err != nil {
+	if _, err = io.Copy(wr, rst); err != nil {
 		return err
 	}
 
 	log.Info().
 		Str("file_name", name).
-		Str("file_path", filePath).
 		Str("webdav_path", completedPath).
 		Msg("Snapshot downloaded from WebDAV")
 	return nil
 }
 
+func (w *webDAVStorage) Delete(name string) error {
+	return w.client.Remove(path.Join("/", w.path, name))
+}
+
+func (w *webDAVStorage) List() ([]string, error) {
+	entries, err := w.client.ReadDir(path.Join("/", w.path))
+	if err != nil {
+		if fsErr, ok := err.(*fs.PathError); ok {
+			if wdErr, ok := fsErr.Err.(gowebdav.StatusError); ok && wdErr.Status == 404 {
+				return []string{}, nil
+			}
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
 func (w *webDAVStorage) makeStoragePath() error {
 	err := w.client.MkdirAll(w.path, 0740)
 	if err == nil {
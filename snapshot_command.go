@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/db"
+	"github.com/wongfei2009/harmonylite/logstream"
+	"github.com/wongfei2009/harmonylite/snapshot"
+)
+
+const snapshotUsage = `Usage: harmonylite snapshot <command> [options]
+
+Commands:
+  save [options]             Save a snapshot of the local database and upload it
+  list [options]             List snapshot versions, newest first
+  inspect [options] <id>     Show size, checksum, schema hash and stream watermarks
+  download [options] <id>    Download and verify a snapshot
+  restore [options] [<id>]   Restore a snapshot into the database (default: latest)
+  delete [options] <id>      Delete a snapshot
+
+Snapshot IDs can be replaced with "latest".`
+
+type snapshotInspection struct {
+	*snapshot.IndexEntry
+	Manifest *snapshot.Manifest `json:"manifest"`
+}
+
+type snapshotSaved struct {
+	SavedAt   time.Time         `json:"saved_at"`
+	Sequences map[string]uint64 `json:"sequences"`
+}
+
+type snapshotResult struct {
+	ID        string            `json:"id"`
+	Path      string            `json:"path,omitempty"`
+	Sequences map[string]uint64 `json:"sequences,omitempty"`
+	Watermark bool              `json:"watermark_set,omitempty"`
+}
+
+func runSnapshotCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, snapshotUsage)
+		return fmt.Errorf("snapshot command required")
+	}
+
+	switch args[0] {
+	case "save":
+		return saveSnapshot(args[1:])
+	case "list":
+		return listSnapshots(args[1:])
+	case "inspect":
+		return inspectSnapshot(args[1:])
+	case "download":
+		return downloadSnapshot(args[1:])
+	case "restore":
+		return restoreSnapshot(args[1:])
+	case "delete":
+		return deleteSnapshot(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, snapshotUsage)
+	return fmt.Errorf("unknown snapshot command %q", args[0])
+}
+
+// openCatalog opens the catalog of the configured snapshot storage
+func openCatalog() (*snapshot.Catalog, error) {
+	storage, err := snapshot.NewSnapshotStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.NewCatalog(storage), nil
+}
+
+func saveSnapshot(args []string) error {
+	fs := newFlagSet("snapshot save", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	streamDB, err := db.OpenStreamDB(cfg.Config.DBPath)
+	if err != nil {
+		return err
+	}
+
+	storage, err := snapshot.NewSnapshotStorage()
+	if err != nil {
+		return err
+	}
+
+	replicator, err := logstream.NewReplicator(snapshot.NewNatsDBSnapshot(streamDB, storage))
+	if err != nil {
+		return err
+	}
+
+	replicator.ForceSaveSnapshot()
+	saved := snapshotSaved{
+		SavedAt:   replicator.LastSaveSnapshotTime(),
+		Sequences: replicator.ReplicationState(),
+	}
+	if saved.SavedAt.IsZero() {
+		return fmt.Errorf("snapshot not saved, see the logs for details")
+	}
+
+	return printOutput(*output, saved, func() {
+		fmt.Printf("Saved At: %s\n", saved.SavedAt.Format(time.RFC3339))
+	})
+}
+
+func listSnapshots(args []string) error {
+	fs := newFlagSet("snapshot list", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+
+	entries, err := catalog.List()
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, entries, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED AT\tSIZE\tTYPE\tSHA256")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", e.ID, e.CreatedAt.Format(time.RFC3339), e.Size, snapshotType(e), shortHash(e.SHA256))
+		}
+		w.Flush()
+	})
+}
+
+func inspectSnapshot(args []string) error {
+	fs := newFlagSet("snapshot inspect", "<id>")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("snapshot id required")
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+
+	entry, manifest, err := catalog.Inspect(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, snapshotInspection{entry, manifest}, func() {
+		fmt.Printf("ID: %s\n", entry.ID)
+		fmt.Printf("Created At: %s\n", entry.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("Node ID: %d\n", manifest.NodeID)
+		fmt.Printf("Type: %s\n", snapshotType(entry))
+		fmt.Printf("Size: %d bytes\n", entry.Size)
+		fmt.Printf("SHA256: %s\n", entry.SHA256)
+		fmt.Printf("Schema Hash: %s\n", manifest.SchemaHash)
+		fmt.Printf("Compressed: %t\n", manifest.Compressed)
+		if manifest.KeyID != "" {
+			fmt.Printf("Key ID: %s\n", manifest.KeyID)
+		}
+
+		fmt.Println("\nStream Watermarks:")
+		streams := make([]string, 0, len(manifest.Sequences))
+		for name := range manifest.Sequences {
+			streams = append(streams, name)
+		}
+		sort.Strings(streams)
+		for _, name := range streams {
+			fmt.Printf("  %s: %d\n", name, manifest.Sequences[name])
+		}
+	})
+}
+
+func downloadSnapshot(args []string) error {
+	fs := newFlagSet("snapshot download", "<id>")
+	dest := fs.String("dest", "", "Path to save the snapshot to, must not exist (default: snapshot-<id>.db)")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("snapshot id required")
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+
+	entry, _, err := catalog.Inspect(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	p := *dest
+	if p == "" {
+		p = fmt.Sprintf("snapshot-%s.db", entry.ID)
+	}
+
+	_, err = catalog.Download(entry.ID, p)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, snapshotResult{ID: entry.ID, Path: p}, func() {
+		fmt.Printf("Downloaded: %s\n", p)
+	})
+}
+
+func restoreSnapshot(args []string) error {
+	fs := newFlagSet("snapshot restore", "[<id>]")
+	dbPath := fs.String("db", "", "Database to restore into, the node using it must be stopped (default: db_path)")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if fs.NArg() > 1 {
+		return fmt.Errorf("at most one snapshot id expected")
+	}
+
+	if *dbPath == "" {
+		*dbPath = cfg.Config.DBPath
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := catalog.Restore(fs.Arg(0), *dbPath)
+	if err != nil {
+		return err
+	}
+
+	result := snapshotResult{ID: manifest.ID, Path: *dbPath, Sequences: manifest.Sequences}
+
+	// The node resumes replication right after the events included in the snapshot
+	if *dbPath == cfg.Config.DBPath {
+		if err := logstream.ResetReplicationState(manifest.Sequences); err != nil {
+			return fmt.Errorf("setting replication watermark: %w", err)
+		}
+
+		result.Watermark = true
+	}
+
+	return printOutput(*output, result, func() {
+		fmt.Printf("Restored: %s into %s\n", manifest.ID, *dbPath)
+		if result.Watermark {
+			fmt.Printf("Replication watermark set in %s\n", cfg.Config.SeqMapPath)
+		}
+	})
+}
+
+func deleteSnapshot(args []string) error {
+	fs := newFlagSet("snapshot delete", "<id>")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("snapshot id required")
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+
+	if err := catalog.Delete(fs.Arg(0)); err != nil {
+		return err
+	}
+
+	return printOutput(*output, snapshotResult{ID: fs.Arg(0)}, func() {
+		fmt.Printf("Deleted: %s\n", fs.Arg(0))
+	})
+}
+
+func runRestoreCommand(args []string) error {
+	fs := newFlagSet("restore", "")
+	to := fs.String("to", "", "Point in time to restore to (RFC 3339), latest archived state when empty")
+	dbPath := fs.String("db", "", "Path to write the restored database to, must not exist and can't be db_path")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	if *dbPath == "" {
+		fs.Usage()
+		return fmt.Errorf("-db is required")
+	}
+
+	// Archived WAL carries no stream sequences, a node can't resume replication from it
+	if sameFile(*dbPath, cfg.Config.DBPath) {
+		return fmt.Errorf("point in time restores are standalone copies and can't target db_path, pick another -db or restore a snapshot")
+	}
+
+	target := time.Now()
+	if *to != "" {
+		t, err := time.Parse(time.RFC3339Nano, *to)
+		if err != nil {
+			return fmt.Errorf("invalid restore time: %w", err)
+		}
+		target = t
+	}
+
+	if _, err := os.Stat(*dbPath); err == nil {
+		return fmt.Errorf("%s already exists, stop the node and move it away or pick another -db", *dbPath)
+	}
+
+	snpStore, err := snapshot.NewSnapshotStorage()
+	if err != nil {
+		return err
+	}
+
+	result, err := snapshot.RestoreWAL(snpStore, target, *dbPath)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, result, func() {
+		fmt.Printf("Restored: %s\n", *dbPath)
+		fmt.Printf("Generation: %s\n", result.Generation)
+		fmt.Printf("Segments Applied: %d\n", result.Segments)
+		fmt.Printf("Restored To: %s\n", result.RestoredTo.Format(time.RFC3339Nano))
+	})
+}
+
+// sameFile compares paths after making them absolute, the files need not exist
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	return absA == absB
+}
+
+func snapshotType(e *snapshot.IndexEntry) string {
+	if e.Base != "" {
+		return "incremental (base " + e.Base + ")"
+	}
+
+	return "full"
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 16 {
+		return hash[:16]
+	}
+
+	return hash
+}
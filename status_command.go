@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/health"
+)
+
+type nodeStatus struct {
+	URL       string            `json:"url"`
+	Healthy   bool              `json:"healthy"`
+	Ready     bool              `json:"ready"`
+	Health    *health.Status    `json:"health,omitempty"`
+	Readiness *health.Readiness `json:"readiness,omitempty"`
+}
+
+func runStatusCommand(args []string) error {
+	fs := newFlagSet("status", "")
+	url := fs.String("url", "", "Health check server of the node (default: from health_check.bind)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for each response")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	hc := cfg.Config.HealthCheck
+	status := nodeStatus{URL: *url}
+	if status.URL == "" {
+		if !hc.Enable {
+			return fmt.Errorf("health check server disabled, enable health_check or pass -url")
+		}
+		status.URL = healthCheckURL(hc.Bind)
+	}
+	status.URL = strings.TrimSuffix(status.URL, "/")
+
+	client := &http.Client{Timeout: *timeout}
+	status.Health = &health.Status{}
+	healthy, err := getStatus(client, status.URL+hc.Path, status.Health)
+	if err != nil {
+		return err
+	}
+
+	status.Readiness = &health.Readiness{}
+	ready, err := getStatus(client, status.URL+hc.ReadinessPath, status.Readiness)
+	if err != nil {
+		return err
+	}
+
+	status.Healthy, status.Ready = healthy, ready
+	if status.Health.Status == "" {
+		status.Health = nil
+	}
+	if status.Readiness.Status == "" {
+		status.Readiness = nil
+	}
+
+	err = printOutput(*output, status, func() {
+		printNodeStatus(&status)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !status.Healthy {
+		return fmt.Errorf("node at %s is unhealthy", status.URL)
+	}
+
+	return nil
+}
+
+// healthCheckURL turns the listening address of the health check server into a local URL
+func healthCheckURL(bind string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "http://" + bind
+	}
+
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// getStatus requests url and decodes the detailed response into v when there is one,
+// returns whether the endpoint answered 200 OK
+func getStatus(client *http.Client, url string, v any) (bool, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && len(body) > 0 {
+		if err := json.Unmarshal(body, v); err != nil {
+			return false, fmt.Errorf("decoding %s: %w", url, err)
+		}
+	}
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func printNodeStatus(status *nodeStatus) {
+	fmt.Printf("URL: %s\n", status.URL)
+	fmt.Printf("Healthy: %t\n", status.Healthy)
+	fmt.Printf("Ready: %t\n", status.Ready)
+
+	if h := status.Health; h != nil {
+		fmt.Printf("Node ID: %d\n", h.NodeID)
+		fmt.Printf("Version: %s\n", h.Version)
+		fmt.Printf("Uptime: %s\n", time.Duration(h.UptimeSeconds)*time.Second)
+		fmt.Printf("Tables Tracked: %d\n", h.TablesTracked)
+		fmt.Printf("Replication Lag: %d\n", h.ReplicationLag)
+	}
+
+	if r := status.Readiness; r != nil && len(r.Reasons) > 0 {
+		fmt.Println("\nNot Ready:")
+		for _, reason := range r.Reasons {
+			fmt.Printf("  - %s\n", reason)
+		}
+	}
+
+	if status.Health == nil && status.Readiness == nil {
+		fmt.Println("\nEnable health_check.detailed for node details")
+	}
+}
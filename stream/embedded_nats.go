@@ -61,7 +61,8 @@ func startEmbeddedServer(nodeName string) (*embeddedNats, error) {
 		Cluster: server.ClusterOpts{
 			Name: cfg.EmbeddedClusterName,
 		},
-		LeafNode: server.LeafNodeOpts{},
+		LeafNode:        server.LeafNodeOpts{},
+		JetStreamDomain: cfg.Config.NATS.JetStreamDomain,
 	}
 
 	if *cfg.ClusterPeersFlag != "" {
@@ -132,7 +133,7 @@ func (e *embeddedNats) prepareConnection(opts ...nats.Option) (*nats.Conn, error
 			continue
 		}
 
-		j, err := c.JetStream()
+		j, err := c.JetStream(JetStreamOptions()...)
 		if err != nil {
 			return nil, err
 		}
@@ -2,13 +2,29 @@ package stream
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/telemetry"
 )
 
+type connStats struct {
+	disconnects telemetry.Counter
+	reconnects  telemetry.Counter
+}
+
+// connMetrics are shared by every connection, created on first use as the replicator and
+// the snapshot storage both connect
+var connMetrics = sync.OnceValue(func() *connStats {
+	return &connStats{
+		disconnects: telemetry.NewCounter("nats_disconnects_total", "NATS client disconnections"),
+		reconnects:  telemetry.NewCounter("nats_reconnects_total", "NATS client reconnections"),
+	}
+})
+
 func Connect() (*nats.Conn, error) {
 	opts := setupConnOptions()
 
@@ -61,6 +77,15 @@ func getNatsAuthFromConfig() ([]nats.Option, error) {
 		opts = append(opts, opt)
 	}
 
+	if cfg.Config.NATS.Token != "" {
+		opts = append(opts, nats.Token(cfg.Config.NATS.Token))
+	}
+
+	// The .creds file is read again on every connect, rotated credentials are picked up on reconnect
+	if cfg.Config.NATS.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Config.NATS.CredsFile))
+	}
+
 	if cfg.Config.NATS.SeedFile != "" {
 		opt, err := nats.NkeyOptionFromSeed(cfg.Config.NATS.SeedFile)
 		if err != nil {
@@ -73,16 +98,31 @@ func getNatsAuthFromConfig() ([]nats.Option, error) {
 	return opts, nil
 }
 
+// JetStreamOptions returns the options every JetStream context is created with, selecting the
+// configured domain or API prefix
+func JetStreamOptions(opts ...nats.JSOpt) []nats.JSOpt {
+	if cfg.Config.NATS.JetStreamDomain != "" {
+		opts = append(opts, nats.Domain(cfg.Config.NATS.JetStreamDomain))
+	}
+
+	if cfg.Config.NATS.JetStreamAPIPrefix != "" {
+		opts = append(opts, nats.APIPrefix(cfg.Config.NATS.JetStreamAPIPrefix))
+	}
+
+	return opts
+}
+
 func getNatsTLSFromConfig() ([]nats.Option, error) {
 	opts := make([]nats.Option, 0)
+	conf := cfg.Current().NATS
 
-	if cfg.Config.NATS.CAFile != "" {
-		opt := nats.RootCAs(cfg.Config.NATS.CAFile)
+	if conf.CAFile != "" {
+		opt := nats.RootCAs(conf.CAFile)
 		opts = append(opts, opt)
 	}
 
-	if cfg.Config.NATS.CertFile != "" && cfg.Config.NATS.KeyFile != "" {
-		opt := nats.ClientCert(cfg.Config.NATS.CertFile, cfg.Config.NATS.KeyFile)
+	if conf.CertFile != "" && conf.KeyFile != "" {
+		opt := nats.ClientCert(conf.CertFile, conf.KeyFile)
 		opts = append(opts, opt)
 	}
 
@@ -90,6 +130,7 @@ func getNatsTLSFromConfig() ([]nats.Option, error) {
 }
 
 func setupConnOptions() []nats.Option {
+	stats := connMetrics()
 	return []nats.Option{
 		nats.Name(cfg.Config.NodeName()),
 		nats.RetryOnFailedConnect(true),
@@ -101,11 +142,13 @@ func setupConnOptions() []nats.Option {
 				Msg("NATS client exiting")
 		}),
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			stats.disconnects.Inc()
 			log.Error().
 				Err(err).
 				Msg("NATS client disconnected")
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
+			stats.reconnects.Inc()
 			log.Info().
 				Str("url", nc.ConnectedUrl()).
 				Msg("NATS client reconnected")
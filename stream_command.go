@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wongfei2009/harmonylite/logstream"
+)
+
+const streamUsage = `Usage: harmonylite stream <command> [options]
+
+Commands:
+  info [options]        Show the state of every shard stream and the replication lag
+  watermark [options]   Show the local replication watermark, the node may be stopped`
+
+func runStreamCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, streamUsage)
+		return fmt.Errorf("stream command required")
+	}
+
+	switch args[0] {
+	case "info":
+		return streamInfo(args[1:])
+	case "watermark":
+		return streamWatermark(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, streamUsage)
+	return fmt.Errorf("unknown stream command %q", args[0])
+}
+
+func streamInfo(args []string) error {
+	fs := newFlagSet("stream info", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	replicator, err := logstream.NewReplicator(nil)
+	if err != nil {
+		return err
+	}
+
+	streams, err := replicator.GetStreamStatus()
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, streams, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SHARD\tSTREAM\tMESSAGES\tBYTES\tFIRST SEQ\tLAST SEQ\tLAST MESSAGE\tAPPLIED SEQ\tLAG")
+		for _, s := range streams {
+			last := "-"
+			if !s.LastTime.IsZero() {
+				last = s.LastTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%s\t%d\t%d\n",
+				s.Shard, s.Stream, s.Messages, s.Bytes, s.FirstSeq, s.LastSeq, last, s.AppliedSeq, s.Lag)
+		}
+		w.Flush()
+	})
+}
+
+func streamWatermark(args []string) error {
+	fs := newFlagSet("stream watermark", "")
+	output := outputFlag(fs)
+	if err := parseCommand(fs, args, output); err != nil {
+		return err
+	}
+
+	seq, err := logstream.LoadReplicationState()
+	if err != nil {
+		return err
+	}
+
+	return printOutput(*output, seq, func() {
+		streams := make([]string, 0, len(seq))
+		for name := range seq {
+			streams = append(streams, name)
+		}
+		sort.Strings(streams)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STREAM\tAPPLIED SEQ")
+		for _, name := range streams {
+			fmt.Fprintf(w, "%s\t%d\n", name, seq[name])
+		}
+		w.Flush()
+	})
+}
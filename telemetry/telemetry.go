@@ -1,8 +1,10 @@
 package telemetry
 
 import (
+	"context"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,6 +13,7 @@ import (
 )
 
 var registry *prometheus.Registry
+var server *http.Server
 
 type Histogram interface {
 	Observe(float64)
@@ -30,6 +33,18 @@ type Gauge interface {
 	SetToCurrentTime()
 }
 
+type GaugeVec interface {
+	WithLabelValues(lvs ...string) Gauge
+}
+
+type CounterVec interface {
+	WithLabelValues(lvs ...string) Counter
+}
+
+type HistogramVec interface {
+	WithLabelValues(lvs ...string) Histogram
+}
+
 type NoopStat struct{}
 
 func (n NoopStat) Observe(float64) {
@@ -53,6 +68,23 @@ func (n NoopStat) Inc() {
 func (n NoopStat) Add(float64) {
 }
 
+func (n NoopStat) WithLabelValues(...string) Gauge {
+	return n
+}
+
+// noopCounterVec and noopHistogramVec stand in for vectors when metrics are disabled
+type noopCounterVec struct{}
+
+func (n noopCounterVec) WithLabelValues(...string) Counter {
+	return NoopStat{}
+}
+
+type noopHistogramVec struct{}
+
+func (n noopHistogramVec) WithLabelValues(...string) Histogram {
+	return NoopStat{}
+}
+
 func NewCounter(name string, help string) Counter {
 	if registry == nil {
 		return NoopStat{}
@@ -91,6 +123,61 @@ func NewGauge(name string, help string) Gauge {
 	return ret
 }
 
+func NewGaugeVec(name string, help string, labels []string) GaugeVec {
+	if registry == nil {
+		return NoopStat{}
+	}
+
+	ret := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: cfg.Config.Prometheus.Namespace,
+		Subsystem: cfg.Config.Prometheus.Subsystem,
+		Name:      name,
+		Help:      help,
+		ConstLabels: map[string]string{
+			"node_id": strconv.FormatUint(cfg.Config.NodeID, 10),
+		},
+	}, labels)
+
+	registry.MustRegister(ret)
+	return gaugeVec{ret}
+}
+
+// gaugeVec adapts prometheus.GaugeVec, whose WithLabelValues returns prometheus.Gauge
+type gaugeVec struct {
+	vec *prometheus.GaugeVec
+}
+
+func (g gaugeVec) WithLabelValues(lvs ...string) Gauge {
+	return g.vec.WithLabelValues(lvs...)
+}
+
+func NewCounterVec(name string, help string, labels []string) CounterVec {
+	if registry == nil {
+		return noopCounterVec{}
+	}
+
+	ret := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: cfg.Config.Prometheus.Namespace,
+		Subsystem: cfg.Config.Prometheus.Subsystem,
+		Name:      name,
+		Help:      help,
+		ConstLabels: map[string]string{
+			"node_id": strconv.FormatUint(cfg.Config.NodeID, 10),
+		},
+	}, labels)
+
+	registry.MustRegister(ret)
+	return counterVec{ret}
+}
+
+type counterVec struct {
+	vec *prometheus.CounterVec
+}
+
+func (c counterVec) WithLabelValues(lvs ...string) Counter {
+	return c.vec.WithLabelValues(lvs...)
+}
+
 func NewHistogram(name string, help string) Histogram {
 	if registry == nil {
 		return NoopStat{}
@@ -110,20 +197,71 @@ func NewHistogram(name string, help string) Histogram {
 	return ret
 }
 
+// NewHistogramVec creates a histogram partitioned by labels, buckets are the Prometheus
+// defaults when nil
+func NewHistogramVec(name string, help string, buckets []float64, labels []string) HistogramVec {
+	if registry == nil {
+		return noopHistogramVec{}
+	}
+
+	ret := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.Config.Prometheus.Namespace,
+		Subsystem: cfg.Config.Prometheus.Subsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+		ConstLabels: map[string]string{
+			"node_id": strconv.FormatUint(cfg.Config.NodeID, 10),
+		},
+	}, labels)
+
+	registry.MustRegister(ret)
+	return histogramVec{ret}
+}
+
+type histogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+func (h histogramVec) WithLabelValues(lvs ...string) Histogram {
+	return h.vec.WithLabelValues(lvs...)
+}
+
 func InitializeTelemetry() {
 	if !cfg.Config.Prometheus.Enable {
 		return
 	}
 
 	registry = prometheus.NewRegistry()
-	server := http.Server{
-		Addr:    cfg.Config.Prometheus.Bind,
+	startServer()
+}
+
+// RestartServer moves the metrics endpoint to the configured bind address, metrics are
+// only served when enabled at startup
+func RestartServer() error {
+	if registry == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	startServer()
+	return nil
+}
+
+func startServer() {
+	server = &http.Server{
+		Addr:    cfg.Current().Prometheus.Bind,
 		Handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}),
 	}
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
+	go func(server *http.Server) {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Error().Err(err).Msg("Unable to start controller listener")
 		}
-	}()
+	}(server)
 }
@@ -0,0 +1,39 @@
+package telemetry
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVecs(t *testing.T) {
+	t.Run("noop when disabled", func(t *testing.T) {
+		assert.Equal(t, NoopStat{}, NewCounterVec("changes_total", "Changes", []string{"table"}).WithLabelValues("users"))
+		assert.Equal(t, NoopStat{}, NewHistogramVec("latency_seconds", "Latency", nil, []string{"shard"}).WithLabelValues("1"))
+	})
+
+	t.Run("registered when enabled", func(t *testing.T) {
+		registry = prometheus.NewRegistry()
+		t.Cleanup(func() { registry = nil })
+
+		counters := NewCounterVec("changes_total", "Changes", []string{"table"})
+		counters.WithLabelValues("users").Inc()
+		counters.WithLabelValues("users").Add(2)
+
+		histograms := NewHistogramVec("latency_seconds", "Latency", []float64{.1, 1}, []string{"shard"})
+		histograms.WithLabelValues("1").Observe(.5)
+
+		assert.Equal(t, 2, testutil.CollectAndCount(registry))
+		assert.Equal(t, float64(3), testutil.ToFloat64(counters.(counterVec).vec.WithLabelValues("users")))
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			labels := family.GetMetric()[0].GetLabel()
+			assert.Equal(t, "node_id", labels[0].GetName())
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/wongfei2009/harmonylite/cfg"
+	"github.com/wongfei2009/harmonylite/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/wongfei2009/harmonylite"
+
+var tracerProvider *sdktrace.TracerProvider
+
+// propagator carries trace context in NATS message headers
+var propagator = propagation.TraceContext{}
+
+// InitializeTracing exports the spans of the change pipeline when tracing is enabled, spans
+// are dropped otherwise
+func InitializeTracing() error {
+	if !cfg.Config.Tracing.Enable {
+		return nil
+	}
+
+	exporter, err := newSpanExporter(&cfg.Config.Tracing)
+	if err != nil {
+		return fmt.Errorf("creating %s trace exporter: %w", cfg.Config.Tracing.Exporter, err)
+	}
+
+	// Attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME take precedence
+	res, err := resource.New(
+		context.Background(),
+		resource.WithAttributes(
+			attribute.String("service.name", "harmonylite"),
+			attribute.String("service.version", version.Get().Version),
+			attribute.String("service.instance.id", strconv.FormatUint(cfg.Config.NodeID, 10)),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagator)
+	return nil
+}
+
+func newSpanExporter(c *cfg.TracingConfiguration) (sdktrace.SpanExporter, error) {
+	if c.Exporter == cfg.StdoutExporter {
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	}
+
+	opts := make([]otlptracehttp.Option, 0)
+	if c.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+	}
+
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// ShutdownTracing flushes the spans not exported yet
+func ShutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+
+	return tracerProvider.Shutdown(ctx)
+}
+
+// StartSpan starts a span of the change pipeline, a no-op span when tracing is disabled
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// EndSpan records err on span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// InjectHeader adds the trace context of ctx to the headers of a NATS message
+func InjectHeader(ctx context.Context, header nats.Header) {
+	propagator.Inject(ctx, headerCarrier(header))
+}
+
+// ExtractHeader returns ctx with the trace context of the headers of a NATS message
+func ExtractHeader(ctx context.Context, header nats.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+
+	return propagator.Extract(ctx, headerCarrier(header))
+}
+
+// headerCarrier adapts NATS headers, whose keys are case sensitive, to the propagator
+type headerCarrier nats.Header
+
+func (h headerCarrier) Get(key string) string {
+	for k, v := range h {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+
+	return ""
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	nats.Header(h).Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
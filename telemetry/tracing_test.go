@@ -0,0 +1,33 @@
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHeaderPropagation(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	msg := nats.NewMsg("subject")
+	InjectHeader(ctx, msg.Header)
+
+	got := trace.SpanContextFromContext(ExtractHeader(context.Background(), msg.Header))
+	assert.Equal(t, span.SpanContext().TraceID(), got.TraceID())
+	assert.True(t, got.IsRemote())
+
+	// NATS header keys are case sensitive, other clients may send canonical HTTP keys
+	received := nats.Header{"Traceparent": msg.Header.Values("traceparent")}
+	got = trace.SpanContextFromContext(ExtractHeader(context.Background(), received))
+	assert.Equal(t, span.SpanContext().TraceID(), got.TraceID())
+
+	assert.False(t, trace.SpanContextFromContext(ExtractHeader(context.Background(), nil)).IsValid())
+}
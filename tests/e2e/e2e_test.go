@@ -137,6 +137,45 @@ var _ = Describe("HarmonyLite End-to-End Tests", Ordered, func() {
 				return countBooksByID(filepath.Join(dbDir, "harmonylite-3.db"), id)
 			}, maxWaitTime*2, pollInterval).Should(Equal(1), "Snapshot restore failed on node 3")
 		})
+
+		It("should bootstrap a node from file snapshot storage", func() {
+			id := insertBook(filepath.Join(dbDir, "harmonylite-1.db"), "File Snapshot Test", "Author", 2020)
+			Eventually(func() int {
+				return countBooksByID(filepath.Join(dbDir, "harmonylite-3.db"), id)
+			}, maxWaitTime, pollInterval).Should(Equal(1), "Initial insert not replicated for file snapshot test")
+
+			// Switch node 3 to file snapshot storage, the [snapshot] table is last in the config
+			stopNodes(node3)
+			snapshotDir := filepath.Join(dbDir, "harmonylite-3-snapshots")
+			tmpConfigPath := filepath.Join(dbDir, "node-3-file-snapshot.toml")
+			originalConfig, err := os.ReadFile(filepath.Join(wd, "examples/node-3-config.toml"))
+			Expect(err).To(BeNil(), "Failed to read original config file")
+			modifiedConfig := append(originalConfig, []byte(fmt.Sprintf("\nstore = \"file\"\n\n[snapshot.file]\npath = %q\n", snapshotDir))...)
+			Expect(os.WriteFile(tmpConfigPath, modifiedConfig, 0644)).To(Succeed())
+			defer os.Remove(tmpConfigPath)
+
+			node3Cmd := exec.Command(filepath.Join(wd, "harmonylite"),
+				"-config", tmpConfigPath,
+				"-node-id", "3",
+				"-save-snapshot")
+			node3Cmd.Dir = wd
+			node3Cmd.Stdout = GinkgoWriter
+			node3Cmd.Stderr = GinkgoWriter
+			Expect(node3Cmd.Run()).To(Succeed(), "Failed to save snapshot to file storage")
+			Expect(filepath.Join(snapshotDir, "snapshot-index.json")).To(BeARegularFile())
+
+			// Start from an empty data directory, node 3 bootstraps from the file snapshot
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(filepath.Join(dbDir, "harmonylite-3.db"+suffix))
+			}
+			node3 = startNode(tmpConfigPath, "127.0.0.1:4223", "nats://127.0.0.1:4221/,nats://127.0.0.1:4222/", 3)
+			Eventually(func() int {
+				return countBooksByID(filepath.Join(dbDir, "harmonylite-3.db"), id)
+			}, maxWaitTime*2, pollInterval).Should(Equal(1), "Bootstrap from file snapshot failed on node 3")
+
+			stopNodes(node3)
+			node3 = startNode("examples/node-3-config.toml", "127.0.0.1:4223", "nats://127.0.0.1:4221/,nats://127.0.0.1:4222/", 3)
+		})
 	})
 
 	Context("Node Failure and Recovery", func() {
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+var cronDayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names []string // Names for values starting at min
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: cronMonthNames}
+	cronDow    = cronField{name: "day of week", min: 0, max: 7, names: cronDayNames}
+)
+
+// CronSchedule is a parsed cron expression with the five standard fields: minute, hour,
+// day of month, month and day of week. Fields take *, values, ranges (1-5), lists (1,15)
+// and steps (*/15, 0-30/10), months and days of week can also be named (JAN, MON).
+// The @yearly, @monthly, @weekly, @daily and @hourly shortcuts are accepted as well.
+// Times are local unless the expression starts with CRON_TZ=<zone>.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like cron, day of month and day of week match either one unless one of them is *
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	loc := time.Local
+	if strings.HasPrefix(expr, "CRON_TZ=") {
+		zone, rest, _ := strings.Cut(expr, " ")
+		l, err := time.LoadLocation(strings.TrimPrefix(zone, "CRON_TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron time zone: %w", err)
+		}
+
+		loc = l
+		expr = strings.TrimSpace(rest)
+	}
+
+	if shortcut, ok := cronShortcuts[strings.ToLower(expr)]; ok {
+		expr = shortcut
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, found %d", expr, len(fields))
+	}
+
+	c := &CronSchedule{
+		loc:    loc,
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+
+	var err error
+	for i, f := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&c.minute, cronMinute},
+		{&c.hour, cronHour},
+		{&c.dom, cronDom},
+		{&c.month, cronMonth},
+		{&c.dow, cronDow},
+	} {
+		*f.bits, err = f.field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Sunday can be written as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+// Next returns the first time matching the schedule strictly after t, or the zero time
+// when nothing matches within the next five years (e.g. February 30th)
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+// parse returns the bitset of values matched by a field
+func (f cronField) parse(expr string) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(expr, ",") {
+		rng, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			s, err := strconv.Atoi(stepExpr)
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q in cron %s field", stepExpr, f.name)
+			}
+
+			step = s
+		}
+
+		var lo, hi int
+		var err error
+		if rng == "*" {
+			lo, hi = f.min, f.max
+		} else if from, to, isRange := strings.Cut(rng, "-"); isRange {
+			if lo, err = f.value(from); err != nil {
+				return 0, err
+			}
+
+			if hi, err = f.value(to); err != nil {
+				return 0, err
+			}
+		} else {
+			if lo, err = f.value(rng); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+			if hasStep {
+				hi = f.max
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q in cron %s field", rng, f.name)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (f cronField) value(expr string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(expr, name) {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(expr)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in cron %s field, expected %d-%d", expr, f.name, f.min, f.max)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronSchedule_Next(t *testing.T) {
+	from := time.Date(2024, 1, 15, 10, 30, 45, 0, time.UTC) // Monday
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"CRON_TZ=UTC * * * * *", time.Date(2024, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC */15 * * * *", time.Date(2024, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 0 3 * * *", time.Date(2024, 1, 16, 3, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 0 1-5/2 * * *", time.Date(2024, 1, 16, 1, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 30 2 * * SAT,SUN", time.Date(2024, 1, 20, 2, 30, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 0 0 * * 7", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 0 0 1 mar *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC 0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Restricted day of month and day of week match either one
+		{"CRON_TZ=UTC 0 0 20 * MON", time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC @monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=UTC @hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, c.Next(from))
+		})
+	}
+
+	t.Run("time zone", func(t *testing.T) {
+		c, err := ParseCron("CRON_TZ=America/New_York 0 3 * * *")
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2024, 1, 16, 8, 0, 0, 0, time.UTC), c.Next(from).UTC())
+	})
+
+	t.Run("never matches", func(t *testing.T) {
+		c, err := ParseCron("0 0 30 2 *")
+		require.NoError(t, err)
+		assert.True(t, c.Next(from).IsZero())
+	})
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * FOO *",
+		"CRON_TZ=Nowhere/City * * * * *",
+	} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}